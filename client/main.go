@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"strings"
@@ -12,6 +16,11 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
 
 	"github.com/anterpin/interview/server/apiobj"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -22,19 +31,106 @@ var (
 
 	PORT = kingpin.Flag("port", "port").Envar("PORT").Default("8443").Uint16()
 
+	serverCert = kingpin.Flag("serverCert", "certificate, or CA issuing the certificate, of the server").Default("server_cert.pem").String()
+
 	start         = kingpin.Command("start", "run command")
 	startCommands = start.Arg("command", "specific command to run").Required().Strings()
+	startShell    = start.Flag("shell", "run the command as a script of /bin/sh, the next arguments are $1 $2 ...").Bool()
+	startIsolate  = start.Flag("isolate", "run the command in its own pid, mount, uts and network namespaces").Bool()
+	startNetwork  = start.Flag("network", "keep the host network when isolated").Bool()
+	startUserns   = start.Flag("userns", "run the isolated command in a new user namespace").Bool()
+	startEnv      = start.Flag("env", "environment variable KEY=VAL of the command, repeatable").Strings()
+	startCleanEnv = start.Flag("cleanEnv", "start from an empty environment instead of the server one").Bool()
+	startCwd      = start.Flag("cwd", "absolute working directory of the command").String()
+	startStdin    = start.Flag("stdin", "file sent to the standard input of the command, - for the client stdin").String()
+	startTimeout  = start.Flag("timeout", "stop the command after running for this duration").Duration()
+	startDeadline = start.Flag("deadline", "stop the command at this RFC3339 time").String()
+	startNs       = start.Flag("namespace", "share the command with the members of the namespace").String()
+	startPriority = start.Flag("priority", "order of the command among the pending ones of the client").Enum("low", "normal", "high")
+
+	stop        = kingpin.Command("stop", "stop running process or cancel a pending one")
+	stopId      = stop.Arg("id", "process identifier").Required().String()
+	stopSignal  = stop.Flag("signal", "signal sent first like SIGTERM or TERM").Short('s').Default("SIGTERM").String()
+	stopTimeout = stop.Flag("timeout", "grace period before SIGKILL is sent, server default if not set").Duration()
+
+	remove   = kingpin.Command("remove", "delete a terminated process and its output")
+	removeId = remove.Arg("id", "process identifier").Required().String()
 
-	stop   = kingpin.Command("stop", "stop running process")
-	stopId = stop.Arg("id", "process identifier").Required().String()
+	list          = kingpin.Command("list", "list running processes")
+	listNamespace = list.Flag("namespace", "list only the processes of the namespace").String()
 
-	_ = kingpin.Command("list", "list running processes")
+	_ = kingpin.Command("health", "show the server state and the expiry of its certificate")
 
-	_log   = kingpin.Command("log", "get ouptut of running process")
-	_logId = _log.Arg("id", "process identifier").Required().String()
+	_ = kingpin.Command("quota", "show the limits on the processes of the client and how much is used")
+
+	_log       = kingpin.Command("log", "get ouptut of running process")
+	_logId     = _log.Arg("id", "process identifier").Required().String()
+	_logFollow = _log.Flag("follow", "stream the output until the process terminates").Short('f').Bool()
+	_logStream = _log.Flag("stream", "output stream to show").Default("both").Enum("stdout", "stderr", "both")
+	_logSince  = _log.Flag("since", "show the output written since a RFC3339 timestamp or a duration ago like 10m").String()
+	_logUntil  = _log.Flag("until", "show the output written until a RFC3339 timestamp or a duration ago like 10m").String()
+	_logTime   = _log.Flag("timestamps", "show the timestamp of every line").Short('t').Bool()
+	_logColor  = _log.Flag("color", "show stderr in red").Bool()
 
 	status   = kingpin.Command("status", "query status of running process")
 	statusId = status.Arg("id", "process identifier").Required().String()
+
+	admin = kingpin.Command("admin", "administer the server")
+	_     = admin.Command("reload", "reload the client registry and the CRL")
+
+	revoke       = admin.Command("revoke", "refuse a client certificate")
+	revokeSerial = revoke.Arg("serial", "hexadecimal serial of the certificate").Required().String()
+	revokeReason = revoke.Flag("reason", "reason kept in the revocation list").String()
+
+	unrevoke       = admin.Command("unrevoke", "accept again a revoked client certificate")
+	unrevokeSerial = unrevoke.Arg("serial", "hexadecimal serial of the certificate").Required().String()
+
+	_ = admin.Command("revocations", "list the revoked client certificates")
+
+	schedules = kingpin.Command("schedules", "run commands at a time or repeatedly")
+
+	scheduleCreate   = schedules.Command("create", "schedule a command")
+	scheduleCommands = scheduleCreate.Arg("command", "specific command to run").Required().Strings()
+	scheduleCron     = scheduleCreate.Flag("cron", "run on every match of a cron expression like '*/15 * * * *' or @daily").String()
+	scheduleAt       = scheduleCreate.Flag("at", "run once at this RFC3339 time").String()
+	scheduleOverlap  = scheduleCreate.Flag("overlap", "what a run does while the previous process is still running").Default("skip").Enum("skip", "queue", "replace")
+	scheduleShell    = scheduleCreate.Flag("shell", "run the command as a script of /bin/sh, the next arguments are $1 $2 ...").Bool()
+	scheduleEnv      = scheduleCreate.Flag("env", "environment variable KEY=VAL of the command, repeatable").Strings()
+	scheduleCwd      = scheduleCreate.Flag("cwd", "absolute working directory of the command").String()
+	scheduleTimeout  = scheduleCreate.Flag("timeout", "stop every run after running for this duration").Duration()
+	scheduleNs       = scheduleCreate.Flag("namespace", "share the schedule and its processes with the members of the namespace").String()
+	schedulePriority = scheduleCreate.Flag("priority", "order of the runs among the pending processes of the client").Enum("low", "normal", "high")
+
+	_ = schedules.Command("list", "list the schedules")
+
+	scheduleShow   = schedules.Command("show", "show a schedule and its runs")
+	scheduleShowId = scheduleShow.Arg("id", "schedule identifier").Required().String()
+
+	scheduleDelete   = schedules.Command("delete", "remove a schedule, the processes it started are kept")
+	scheduleDeleteId = scheduleDelete.Arg("id", "schedule identifier").Required().String()
+
+	schedulePause   = schedules.Command("pause", "stop running a schedule until resumed")
+	schedulePauseId = schedulePause.Arg("id", "schedule identifier").Required().String()
+
+	scheduleResume   = schedules.Command("resume", "run a paused schedule again")
+	scheduleResumeId = scheduleResume.Arg("id", "schedule identifier").Required().String()
+
+	workflows = kingpin.Command("workflows", "run commands once the ones they depend on succeed")
+
+	workflowCreate    = workflows.Command("create", "submit a workflow")
+	workflowFile      = workflowCreate.Arg("file", "json workflow with its steps and their depends_on, - for the client stdin").Required().String()
+	workflowNamespace = workflowCreate.Flag("namespace", "share the workflow and its processes with the members of the namespace").String()
+
+	_ = workflows.Command("list", "list the workflows")
+
+	workflowShow   = workflows.Command("show", "show a workflow and its steps")
+	workflowShowId = workflowShow.Arg("id", "workflow identifier").Required().String()
+
+	workflowCancel   = workflows.Command("cancel", "stop the running steps and skip the waiting ones")
+	workflowCancelId = workflowCancel.Arg("id", "workflow identifier").Required().String()
+
+	enroll      = kingpin.Command("enroll", "obtain the client certificate in certDir with a one-time token")
+	enrollToken = enroll.Arg("token", "token given by the server administrator").Required().String()
 )
 
 func main() {
@@ -44,24 +140,136 @@ func main() {
 	command := kingpin.Parse()
 	var buffer bytes.Buffer
 	id := ""
+	// get parameters of the endpoints without id
+	var query url.Values
 	method := "POST"
+	// generated by enroll, the server only sees its public part
+	var enrollKey *ecdsa.PrivateKey
 	switch command {
 	case "start":
-		startCommand := strings.Join(*startCommands, " ")
-		json.NewEncoder(&buffer).Encode(apiobj.Command{Command: startCommand})
+		commandObj := apiobj.Command{
+			Argv:      *startCommands,
+			Shell:     *startShell,
+			Env:       *startEnv,
+			CleanEnv:  *startCleanEnv,
+			Cwd:       *startCwd,
+			Namespace: *startNs,
+			Priority:  *startPriority,
+		}
+		if *startStdin != "" {
+			commandObj.Stdin = readFile(*startStdin)
+		}
+		if *startIsolate {
+			commandObj.Isolation = &apiobj.Isolation{Enabled: true, Network: *startNetwork, UserNamespace: *startUserns}
+		}
+		if *startTimeout != 0 {
+			commandObj.Timeout = startTimeout.String()
+		}
+		if *startDeadline != "" {
+			deadline, err := time.Parse(time.RFC3339, *startDeadline)
+			if err != nil {
+				log.Fatalf("Invalid deadline: %v", err)
+			}
+			commandObj.Deadline = &deadline
+		}
+		json.NewEncoder(&buffer).Encode(commandObj)
 	case "stop":
-		json.NewEncoder(&buffer).Encode(apiobj.UUID{UUID: *stopId})
+		stopObj := apiobj.Stop{UUID: *stopId, Signal: *stopSignal}
+		if *stopTimeout != 0 {
+			stopObj.Timeout = stopTimeout.String()
+		}
+		json.NewEncoder(&buffer).Encode(stopObj)
+	case "remove":
+		json.NewEncoder(&buffer).Encode(apiobj.UUID{UUID: *removeId})
 	case "list":
 		method = "GET"
+		if *listNamespace != "" {
+			query = url.Values{"namespace": {*listNamespace}}
+		}
+	case "health", "quota", "admin revocations":
+		method = "GET"
+	case "admin revoke":
+		json.NewEncoder(&buffer).Encode(apiobj.Revocation{Serial: *revokeSerial, Reason: *revokeReason})
+	case "admin unrevoke":
+		json.NewEncoder(&buffer).Encode(apiobj.Revocation{Serial: *unrevokeSerial})
+	case "enroll":
+		// check before using up the token
+		for _, name := range []string{"cert.pem", "key.pem"} {
+			if _, err := os.Stat(filepath.Join(*certDir, name)); err == nil {
+				log.Fatalf("%s already exists in %s", name, *certDir)
+			}
+		}
+		var csr []byte
+		enrollKey, csr = createCSR()
+		json.NewEncoder(&buffer).Encode(apiobj.Enroll{Token: *enrollToken, CSR: string(csr)})
 	case "status":
 		method = "GET"
 		id = *statusId
 	case "log":
 		method = "GET"
 		id = *_logId
+	case "schedules create":
+		scheduleObj := apiobj.Schedule{
+			Cron:    *scheduleCron,
+			Overlap: *scheduleOverlap,
+			Command: apiobj.Command{
+				Argv:      *scheduleCommands,
+				Shell:     *scheduleShell,
+				Env:       *scheduleEnv,
+				Cwd:       *scheduleCwd,
+				Namespace: *scheduleNs,
+				Priority:  *schedulePriority,
+			},
+		}
+		if *scheduleAt != "" {
+			at, err := time.Parse(time.RFC3339, *scheduleAt)
+			if err != nil {
+				log.Fatalf("Invalid time: %v", err)
+			}
+			scheduleObj.RunAt = &at
+		}
+		if *scheduleTimeout != 0 {
+			scheduleObj.Command.Timeout = scheduleTimeout.String()
+		}
+		json.NewEncoder(&buffer).Encode(scheduleObj)
+	case "schedules list":
+		method = "GET"
+	case "schedules show":
+		method = "GET"
+		id = *scheduleShowId
+	case "schedules delete":
+		json.NewEncoder(&buffer).Encode(apiobj.UUID{UUID: *scheduleDeleteId})
+	case "schedules pause":
+		json.NewEncoder(&buffer).Encode(apiobj.UUID{UUID: *schedulePauseId})
+	case "schedules resume":
+		json.NewEncoder(&buffer).Encode(apiobj.UUID{UUID: *scheduleResumeId})
+	case "workflows create":
+		workflowObj := apiobj.Workflow{}
+		if err := json.Unmarshal(readFile(*workflowFile), &workflowObj); err != nil {
+			log.Fatalf("Invalid workflow: %v", err)
+		}
+		if *workflowNamespace != "" {
+			workflowObj.Namespace = *workflowNamespace
+		}
+		json.NewEncoder(&buffer).Encode(workflowObj)
+	case "workflows list":
+		method = "GET"
+	case "workflows show":
+		method = "GET"
+		id = *workflowShowId
+	case "workflows cancel":
+		json.NewEncoder(&buffer).Encode(apiobj.UUID{UUID: *workflowCancelId})
 	}
 
-	URL := fmt.Sprintf("https://localhost:%d/%s", *PORT, command)
+	// the subcommands are nested endpoints like admin/reload
+	endpoint := strings.ReplaceAll(command, " ", "/")
+	switch command {
+	case "schedules list", "schedules show":
+		endpoint = "schedules"
+	case "workflows list", "workflows show":
+		endpoint = "workflows"
+	}
+	URL := fmt.Sprintf("https://localhost:%d/%s", *PORT, endpoint)
 
 	req, err := http.NewRequest(method, URL, &buffer)
 	if err != nil {
@@ -72,11 +280,17 @@ func main() {
 	if id != "" {
 		q := req.URL.Query()
 		q.Add("id", id)
+		if command == "log" {
+			setLogParameters(q)
+		}
 		req.URL.RawQuery = q.Encode()
 	}
+	if query != nil {
+		req.URL.RawQuery = query.Encode()
+	}
 
 	// setup certificate authority
-	caCert, err := ioutil.ReadFile("server_cert.pem")
+	caCert, err := ioutil.ReadFile(*serverCert)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -88,23 +302,32 @@ func main() {
 		log.Fatal("Cannot extract ca from cert.pem")
 	}
 	// we can also use separate cert and key for the client
-	cert, err := tls.LoadX509KeyPair(*certDir+"/cert.pem", *certDir+"/key.pem")
-	if err != nil {
-		log.Fatal(err)
+	// a client enrolling has no certificate yet
+	certificates := []tls.Certificate{}
+	if command != "enroll" {
+		cert, err := tls.LoadX509KeyPair(*certDir+"/cert.pem", *certDir+"/key.pem")
+		if err != nil {
+			log.Fatal(err)
+		}
+		certificates = append(certificates, cert)
 	}
 
 	// setup client tls with ca pool
 	client := &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
-				RootCAs:      caCertPool,              // client ca
-				Certificates: []tls.Certificate{cert}, // client certificate
+				RootCAs:      caCertPool,   // client ca
+				Certificates: certificates, // client certificate
 			},
 		},
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
+		// the server refuses the revoked certificates during the handshake
+		if strings.Contains(err.Error(), "bad certificate") {
+			log.Fatal("forbidden: the client certificate is revoked or not trusted")
+		}
 		log.Fatal(err)
 	}
 	defer resp.Body.Close()
@@ -123,35 +346,453 @@ func main() {
 
 		getServerResponse(resp.Body, &uuidObj)
 		fmt.Println(uuidObj.UUID)
-	case "stop":
+	case "stop", "remove", "admin reload", "admin revoke", "admin unrevoke", "schedules delete", "schedules pause", "schedules resume", "workflows cancel":
 		statusObj := apiobj.Status{}
 
 		getServerResponse(resp.Body, &statusObj)
 		fmt.Println(statusObj.Status)
+	case "health":
+		healthObj := apiobj.Health{}
+
+		getServerResponse(resp.Body, &healthObj)
+		fmt.Println(healthObj.Status)
+		fmt.Printf("certificate expires in %d days at %s\n", healthObj.CertificateDaysLeft, healthObj.CertificateExpiry.Local().Format(time.RFC3339))
+	case "quota":
+		usageObj := apiobj.QuotaUsage{}
+
+		getServerResponse(resp.Body, &usageObj)
+		printQuota(usageObj)
+	case "enroll":
+		enrollmentObj := apiobj.Enrollment{}
+
+		getServerResponse(resp.Body, &enrollmentObj)
+		saveEnrollment(enrollKey, enrollmentObj)
+		fmt.Printf("enrolled as client %d\n", enrollmentObj.ID)
+	case "admin revocations":
+		revocationsObj := apiobj.Revocations{}
+
+		getServerResponse(resp.Body, &revocationsObj)
+		printRevocations(revocationsObj.Revocations)
 	case "list":
 		listObj := apiobj.List{}
 
 		getServerResponse(resp.Body, &listObj)
-		// weird join behaviour
-		// ? maybe print a message on empty list
-		if len(listObj.List) != 0 {
-			fmt.Println(strings.Join(listObj.List, "\n"))
-		}
+		printList(listObj.List)
 	case "status":
 		statusObj := apiobj.State{}
 
 		getServerResponse(resp.Body, &statusObj)
-		if statusObj.State != nil {
-			fmt.Println(statusObj.State)
-		} else {
-			fmt.Println("active")
+		printStatus(statusObj.State)
+	case "schedules create":
+		scheduleObj := apiobj.Schedule{}
+
+		getServerResponse(resp.Body, &scheduleObj)
+		fmt.Println(scheduleObj.ID)
+	case "schedules list":
+		schedulesObj := apiobj.Schedules{}
+
+		getServerResponse(resp.Body, &schedulesObj)
+		printSchedules(schedulesObj.Schedules)
+	case "schedules show":
+		schedulesObj := apiobj.Schedules{}
+
+		getServerResponse(resp.Body, &schedulesObj)
+		for _, schedule := range schedulesObj.Schedules {
+			printSchedule(schedule)
+		}
+	case "workflows create":
+		workflowObj := apiobj.Workflow{}
+
+		getServerResponse(resp.Body, &workflowObj)
+		fmt.Println(workflowObj.ID)
+	case "workflows list":
+		workflowsObj := apiobj.Workflows{}
+
+		getServerResponse(resp.Body, &workflowsObj)
+		printWorkflows(workflowsObj.Workflows)
+	case "workflows show":
+		workflowsObj := apiobj.Workflows{}
+
+		getServerResponse(resp.Body, &workflowsObj)
+		for _, workflow := range workflowsObj.Workflows {
+			printWorkflow(workflow)
 		}
 	case "log":
+		if *_logFollow {
+			followLog(resp.Body)
+			return
+		}
 		logObj := apiobj.Log{}
 
 		getServerResponse(resp.Body, &logObj)
-		fmt.Print(logObj.Log)
+		if !withEntries() {
+			fmt.Print(logObj.Log)
+			return
+		}
+		printer := entryPrinter{lineStart: true}
+		for _, entry := range logObj.Entries {
+			printer.print(entry)
+		}
+	}
+}
+
+// generate the client key and its PEM encoded certificate request
+func createCSR() (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+// write the enrolled certificate and its key in certDir
+// an existing certificate is never overwritten
+func saveEnrollment(key *ecdsa.PrivateKey, enrollment apiobj.Enrollment) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.MkdirAll(*certDir, 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{"key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600},
+		{"cert.pem", []byte(enrollment.Cert), 0644},
+	}
+	for _, file := range files {
+		path := filepath.Join(*certDir, file.name)
+		output, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.mode)
+		if err != nil {
+			log.Fatalf("Cannot save the enrolled certificate: %v", err)
+		}
+		_, err = output.Write(file.data)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatalf("Cannot save the enrolled certificate: %v", err)
+		}
+	}
+}
+
+// read the file at path, the client stdin if -
+func readFile(path string) []byte {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		log.Fatalf("Cannot read %s: %v", path, err)
+	}
+	return data
+}
+
+// print a process snapshot per line
+func printList(list []apiobj.ProcessStatus) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSTATE\tOWNER\tNAMESPACE\tPID\tSTARTED\tCOMMAND")
+	for _, status := range list {
+		namespace := status.Namespace
+		if namespace == "" {
+			namespace = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n",
+			status.ID,
+			stateString(status),
+			status.Owner,
+			namespace,
+			status.PID,
+			status.StartTime.Local().Format(time.RFC3339),
+			strings.Join(append([]string{status.Command}, status.Args...), " "),
+		)
+	}
+	writer.Flush()
+}
+
+// print a schedule per line
+func printSchedules(schedules []apiobj.Schedule) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tOWNER\tWHEN\tOVERLAP\tNEXT RUN\tRUNS\tCOMMAND")
+	for _, schedule := range schedules {
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%s\t%d\t%s\n",
+			schedule.ID,
+			schedule.Owner,
+			scheduleWhen(schedule),
+			schedule.Overlap,
+			scheduleNext(schedule),
+			len(schedule.Runs),
+			commandString(schedule.Command),
+		)
+	}
+	writer.Flush()
+}
+
+// print every field of the schedule and its runs
+func printSchedule(schedule apiobj.Schedule) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "id:\t%s\n", schedule.ID)
+	fmt.Fprintf(writer, "owner:\t%d\n", schedule.Owner)
+	if schedule.Command.Namespace != "" {
+		fmt.Fprintf(writer, "namespace:\t%s\n", schedule.Command.Namespace)
+	}
+	fmt.Fprintf(writer, "when:\t%s\n", scheduleWhen(schedule))
+	fmt.Fprintf(writer, "overlap:\t%s\n", schedule.Overlap)
+	fmt.Fprintf(writer, "next run:\t%s\n", scheduleNext(schedule))
+	fmt.Fprintf(writer, "command:\t%s\n", commandString(schedule.Command))
+	fmt.Fprintf(writer, "created:\t%s\n", schedule.Created.Local().Format(time.RFC3339))
+	writer.Flush()
+
+	if len(schedule.Runs) == 0 {
+		return
+	}
+	fmt.Println()
+	writer = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "DUE\tOUTCOME\tPROCESS\tERROR")
+	for _, run := range schedule.Runs {
+		process := run.ProcessID
+		if process == "" {
+			process = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", run.Time.Local().Format(time.RFC3339), run.Outcome, process, run.Error)
+	}
+	writer.Flush()
+}
+
+func scheduleWhen(schedule apiobj.Schedule) string {
+	if schedule.RunAt != nil {
+		return "at " + schedule.RunAt.Local().Format(time.RFC3339)
+	}
+	return schedule.Cron
+}
+
+func scheduleNext(schedule apiobj.Schedule) string {
+	switch {
+	case schedule.Paused:
+		return "paused"
+	case schedule.NextRun == nil:
+		return "-"
+	}
+	return schedule.NextRun.Local().Format(time.RFC3339)
+}
+
+func commandString(command apiobj.Command) string {
+	if len(command.Argv) > 0 {
+		return strings.Join(command.Argv, " ")
+	}
+	return command.Command
+}
+
+// print a workflow per line
+func printWorkflows(workflows []apiobj.Workflow) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSTATE\tOWNER\tSTEPS\tCREATED")
+	for _, workflow := range workflows {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%s\n",
+			workflow.ID,
+			workflow.State,
+			workflow.Owner,
+			len(workflow.Steps),
+			workflow.Created.Local().Format(time.RFC3339),
+		)
+	}
+	writer.Flush()
+}
+
+// print the workflow and a step per line
+func printWorkflow(workflow apiobj.Workflow) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "id:\t%s\n", workflow.ID)
+	fmt.Fprintf(writer, "state:\t%s\n", workflow.State)
+	fmt.Fprintf(writer, "owner:\t%d\n", workflow.Owner)
+	if workflow.Namespace != "" {
+		fmt.Fprintf(writer, "namespace:\t%s\n", workflow.Namespace)
+	}
+	fmt.Fprintf(writer, "created:\t%s\n", workflow.Created.Local().Format(time.RFC3339))
+	if workflow.EndTime != nil {
+		fmt.Fprintf(writer, "ended:\t%s\n", workflow.EndTime.Local().Format(time.RFC3339))
+	}
+	writer.Flush()
+
+	fmt.Println()
+	writer = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "STEP\tSTATE\tDEPENDS ON\tPROCESS\tERROR")
+	for _, step := range workflow.Steps {
+		dependsOn := strings.Join(step.DependsOn, ",")
+		if dependsOn == "" {
+			dependsOn = "-"
+		}
+		process := step.ProcessID
+		if process == "" {
+			process = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", step.Name, step.State, dependsOn, process, step.Error)
+	}
+	writer.Flush()
+}
+
+func printRevocations(revocations []apiobj.Revocation) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "SERIAL\tREVOKED\tREASON")
+	for _, revocation := range revocations {
+		revoked := ""
+		if revocation.Time != nil {
+			revoked = revocation.Time.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", revocation.Serial, revoked, revocation.Reason)
+	}
+	writer.Flush()
+}
+
+// print every field of the process snapshot
+func printStatus(status apiobj.ProcessStatus) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "id:\t%s\n", status.ID)
+	fmt.Fprintf(writer, "state:\t%s\n", stateString(status))
+	if status.QueuePosition != 0 {
+		fmt.Fprintf(writer, "queue position:\t%d\n", status.QueuePosition)
+	}
+	if status.Priority != "" {
+		fmt.Fprintf(writer, "priority:\t%s\n", status.Priority)
+	}
+	fmt.Fprintf(writer, "pid:\t%d\n", status.PID)
+	fmt.Fprintf(writer, "owner:\t%d\n", status.Owner)
+	if status.Namespace != "" {
+		fmt.Fprintf(writer, "namespace:\t%s\n", status.Namespace)
+	}
+	fmt.Fprintf(writer, "command:\t%s\n", status.Command)
+	fmt.Fprintf(writer, "args:\t%q\n", status.Args)
+	if status.Isolated {
+		fmt.Fprintf(writer, "isolated:\tyes\n")
+	}
+	fmt.Fprintf(writer, "started:\t%s\n", status.StartTime.Local().Format(time.RFC3339))
+	if status.Deadline != nil {
+		fmt.Fprintf(writer, "deadline:\t%s\n", status.Deadline.Local().Format(time.RFC3339))
+	}
+	if status.EndTime != nil {
+		fmt.Fprintf(writer, "ended:\t%s\n", status.EndTime.Local().Format(time.RFC3339))
+	}
+	if status.StoppedBy != "" {
+		fmt.Fprintf(writer, "stopped by:\t%s\n", status.StoppedBy)
+	}
+	if status.CPUSeconds != 0 {
+		fmt.Fprintf(writer, "cpu seconds:\t%.2f\n", status.CPUSeconds)
+	}
+	writer.Flush()
+}
+
+// print the usage of each limit of the quota
+func printQuota(usage apiobj.QuotaUsage) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "LIMIT\tUSED\tMAX")
+	fmt.Fprintf(writer, "running or pending\t%d\t%s\n", usage.Running+usage.Pending, quotaLimit(float64(usage.Quota.MaxRunning), "%.0f"))
+	fmt.Fprintf(writer, "processes\t%d\t%s\n", usage.Processes, quotaLimit(float64(usage.Quota.MaxProcesses), "%.0f"))
+	fmt.Fprintf(writer, "output bytes\t%d\t%s\n", usage.OutputBytes, quotaLimit(float64(usage.Quota.MaxOutputBytes), "%.0f"))
+	fmt.Fprintf(writer, "cpu seconds per day\t%.1f\t%s\n", usage.CPUSeconds, quotaLimit(usage.Quota.CPUSecondsPerDay, "%.1f"))
+	writer.Flush()
+}
+
+// the limit or unlimited if 0
+func quotaLimit(limit float64, format string) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf(format, limit)
+}
+
+// the state followed by the exit code, the signal or the queue position
+func stateString(status apiobj.ProcessStatus) string {
+	switch {
+	case status.QueuePosition != 0:
+		return fmt.Sprintf("%s (#%d)", status.State, status.QueuePosition)
+	case status.Signal != "":
+		return fmt.Sprintf("%s (%s)", status.State, status.Signal)
+	case status.ExitCode != nil:
+		return fmt.Sprintf("%s (%d)", status.State, *status.ExitCode)
+	}
+	return status.State
+}
+
+// the entries are needed to show timestamps or colors
+func withEntries() bool {
+	return *_logTime || *_logColor
+}
+
+// set the get parameters selecting the log output
+func setLogParameters(q url.Values) {
+	q.Add("stream", *_logStream)
+	if *_logSince != "" {
+		q.Add("since", *_logSince)
+	}
+	if *_logUntil != "" {
+		q.Add("until", *_logUntil)
+	}
+	if withEntries() {
+		q.Add("entries", "true")
+	}
+	if *_logFollow {
+		q.Add("follow", "true")
+	}
+}
+
+// print the streamed output until the server closes the connection
+func followLog(body io.Reader) {
+	if !withEntries() {
+		// the output is streamed as raw text
+		_, err := io.Copy(os.Stdout, body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// the output is streamed as a log entry object per line
+	decoder := json.NewDecoder(body)
+	printer := entryPrinter{lineStart: true}
+	for {
+		entry := apiobj.LogEntry{}
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		printer.print(entry)
+	}
+}
+
+// print the log entries with the timestamp at the start of every line
+// and stderr in red if requested
+type entryPrinter struct {
+	lineStart bool
+}
+
+func (printer *entryPrinter) print(entry apiobj.LogEntry) {
+	if *_logTime && printer.lineStart {
+		fmt.Print(entry.Time.Local().Format(time.RFC3339Nano), " ")
+	}
+	data := entry.Data
+	printer.lineStart = strings.HasSuffix(data, "\n")
+	if *_logColor && entry.Stream == "stderr" {
+		// keep the new line out of the color
+		fmt.Print("\x1b[31m", strings.TrimSuffix(data, "\n"), "\x1b[0m")
+		if printer.lineStart {
+			fmt.Println()
+		}
+		return
 	}
+	fmt.Print(data)
 }
 
 func getServerResponse(body io.Reader, obj interface{}) interface{} {
@@ -1,7 +1,7 @@
 package apiobj
 
 import (
-	"os"
+	"time"
 )
 
 // wrap an error string
@@ -13,35 +13,356 @@ type Error struct {
 // wrap the command to execute
 // used in the /start endpoint
 type Command struct {
-	Command string `json:"command"`
+	// program and arguments separated by spaces
+	// kept for compatibility, Argv is preferred
+	Command string `json:"command,omitempty"`
+	// program followed by its arguments
+	Argv []string `json:"argv,omitempty"`
+	// run the command through /bin/sh -c
+	// with Argv the first one is the script
+	// and the rest are its positional parameters
+	Shell bool `json:"shell,omitempty"`
+	// environment variables as KEY=VALUE
+	// added to the server environment unless CleanEnv is set
+	Env      []string `json:"env,omitempty"`
+	CleanEnv bool     `json:"clean_env,omitempty"`
+	// absolute working directory, the server one if empty
+	Cwd string `json:"cwd,omitempty"`
+	// standard input of the process, base64 in json
+	// the process reads EOF after it, /dev/null if empty
+	Stdin     []byte     `json:"stdin,omitempty"`
+	Limits    *Limits    `json:"limits,omitempty"`
+	Isolation *Isolation `json:"isolation,omitempty"`
+	// maximum running time like 10m
+	Timeout string `json:"timeout,omitempty"`
+	// time after which the process is stopped
+	// the earliest of timeout and deadline applies
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// namespace sharing the process with its members, personal if empty
+	Namespace string `json:"namespace,omitempty"`
+	// order in which the pending processes of the client start
+	// low, normal or high, normal if empty
+	Priority string `json:"priority,omitempty"`
 }
 
-// wrap the uuid of the process
-// used in /start /stop /log /status endpoints
+// priorities of a process
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// namespaces isolating a process from the host
+// the server policy may require or restrict them
+type Isolation struct {
+	// run the process in new pid, mount, uts and network namespaces
+	// with a private /proc
+	Enabled bool `json:"enabled"`
+	// keep the host network instead of a network namespace with only loopback
+	Network bool `json:"network,omitempty"`
+	// run the process in a new user namespace as root mapped to the server user
+	UserNamespace bool `json:"user_namespace,omitempty"`
+}
+
+// resource limits of a process
+// the zero value of each field means no limit
+type Limits struct {
+	// relative share of cpu time between 1 and 10000, the default is 100
+	CPUWeight uint64 `json:"cpu_weight,omitempty"`
+	// maximum number of cpus used like 0.5 or 2, at least 0.01
+	CPUQuota float64 `json:"cpu_quota,omitempty"`
+	// maximum bytes of memory
+	MemoryMax int64 `json:"memory_max,omitempty"`
+	// relative share of io between 1 and 10000, the default is 100
+	IOWeight uint64 `json:"io_weight,omitempty"`
+	// maximum number of processes
+	PidsMax int64 `json:"pids_max,omitempty"`
+}
+
+// wrap the uuid of the process, of the schedule or of the workflow
+// used in /start /stop /log /status /schedules and /workflows endpoints
 type UUID struct {
 	UUID string `json:"uuid"`
 }
 
+// wrap the process to stop and how to stop it
+// used in the /stop endpoint
+type Stop struct {
+	UUID string `json:"uuid"`
+	// first signal sent like SIGTERM or TERM, SIGTERM if empty
+	Signal string `json:"signal,omitempty"`
+	// grace period before escalating to SIGKILL like 10s
+	// the server default if empty
+	Timeout string `json:"timeout,omitempty"`
+}
+
 // wrap the string ok
 // used in the /stop endpoint
 type Status struct {
 	Status string `json:"status"`
 }
 
-// wrap a list of strings
+// revoked client certificate
+// used in the /admin/revoke and /admin/unrevoke endpoints
+type Revocation struct {
+	// hexadecimal serial number of the certificate like 1A2B3C
+	Serial string `json:"serial"`
+	Reason string `json:"reason,omitempty"`
+	// set by the server when the certificate is revoked
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// wrap the certificates revoked through the admin endpoints
+// used in the /admin/revocations endpoint
+type Revocations struct {
+	Revocations []Revocation `json:"revocations"`
+}
+
+// request of a client certificate with a one-time token
+// used in the /enroll endpoint
+type Enroll struct {
+	Token string `json:"token"`
+	// PEM encoded certificate signing request, only its key is used
+	CSR string `json:"csr"`
+}
+
+// client certificate issued by the server CA
+// used in the /enroll endpoint
+type Enrollment struct {
+	// user id of the registered client
+	ID int `json:"id"`
+	// PEM encoded client certificate
+	Cert string `json:"cert"`
+	// PEM encoded CA certificate issuing the client and server certificates
+	CA string `json:"ca"`
+}
+
+// state of the server
+// used in the /health endpoint
+type Health struct {
+	Status string `json:"status"`
+	// time after which the server certificate is no longer valid
+	CertificateExpiry time.Time `json:"certificate_expiry"`
+	// whole days left before the server certificate expires, negative once expired
+	CertificateDaysLeft int `json:"certificate_days_left"`
+}
+
+// limits on the processes of a client, 0 means no limit
+type Quota struct {
+	// processes running or pending at the same time
+	MaxRunning int `json:"max_running,omitempty"`
+	// processes kept by the server, running or terminated
+	MaxProcesses int `json:"max_processes,omitempty"`
+	// output bytes stored for all the processes
+	MaxOutputBytes int64 `json:"max_output_bytes,omitempty"`
+	// cpu seconds used by the processes running or terminated in the last 24 hours
+	CPUSecondsPerDay float64 `json:"cpu_seconds_per_day,omitempty"`
+}
+
+// quota of a client and how much of it is used
+// used in the /quota endpoint
+type QuotaUsage struct {
+	Quota       Quota   `json:"quota"`
+	Running     int     `json:"running"`
+	Pending     int     `json:"pending"`
+	Processes   int     `json:"processes"`
+	OutputBytes int64   `json:"output_bytes"`
+	CPUSeconds  float64 `json:"cpu_seconds"`
+}
+
+// wrap the snapshots of the processes
 // used in the /list endpoint
 type List struct {
-	List []string `json:"list"`
+	List []ProcessStatus `json:"list"`
 }
 
 // wrap the process output
+// the entries replace the log if requested
 // used in the /log endpoint
 type Log struct {
-	Log string `json:"log"`
+	Log     string     `json:"log,omitempty"`
+	Entries []LogEntry `json:"entries,omitempty"`
 }
 
-// wrap the os.ProcessState object
+// a line, or part of it, written by the process
+// used in the /log endpoint and streamed one per line in follow mode
+type LogEntry struct {
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+	Data   string    `json:"data"`
+}
+
+// wrap the snapshot of a process
 // used in the /status endpoint
 type State struct {
-	State *os.ProcessState `json:"status"`
+	State ProcessStatus `json:"status"`
+}
+
+// states of a process
+const (
+	// waiting to be started
+	StatePending = "pending"
+	StateRunning = "running"
+	// terminated with exit code 0
+	StateExited = "exited"
+	// terminated by a signal
+	StateKilled = "killed"
+	// terminated with a non zero exit code
+	StateFailed = "failed"
+	// stopped for reaching its timeout or deadline
+	StateTimedOut = "timed_out"
+	// running when the server stopped, its exit state is unknown
+	StateLost = "lost"
+	// stopped while pending, it never ran
+	StateCancelled = "cancelled"
+)
+
+// snapshot of a process
+// used in the /status and /list endpoints
+type ProcessStatus struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// set once the process has terminated if it ran, -1 if killed by a signal
+	ExitCode *int `json:"exit_code,omitempty"`
+	// name of the signal that terminated the process like SIGKILL
+	Signal string `json:"signal,omitempty"`
+	// set if the process was killed for exceeding its memory limit
+	OOMKilled bool `json:"oom_killed,omitempty"`
+	// last signal sent by /stop before the process terminated
+	// SIGKILL if the stop signal was escalated after the grace period
+	StoppedBy string `json:"stopped_by,omitempty"`
+	PID       int    `json:"pid"`
+	// time the process started, or was queued while pending
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	Command   string     `json:"command"`
+	Args      []string   `json:"args"`
+	// id of the user owning the process
+	Owner int `json:"owner"`
+	// namespace sharing the process with its members, personal if empty
+	Namespace string `json:"namespace,omitempty"`
+	// set if the process runs in its own namespaces
+	Isolated bool `json:"isolated,omitempty"`
+	// time after which the process is stopped if still running
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// user and system cpu time used by the process and its children so far
+	CPUSeconds float64 `json:"cpu_seconds,omitempty"`
+	// position in the queue of a pending process starting from 1
+	QueuePosition int `json:"queue_position,omitempty"`
+	// low, normal or high
+	Priority string `json:"priority,omitempty"`
+}
+
+// command started at a time or repeatedly on a cron expression
+// used in the /schedules endpoints
+type Schedule struct {
+	// set by the server
+	ID string `json:"id,omitempty"`
+	// minute hour day-of-month month day-of-week in the server time zone
+	// like */15 * * * * or @daily, exclusive with RunAt
+	Cron string `json:"cron,omitempty"`
+	// time of a single run
+	RunAt *time.Time `json:"run_at,omitempty"`
+	// what a run does while the process of the previous one is still running
+	// skip, queue or replace, skip if empty
+	Overlap string  `json:"overlap,omitempty"`
+	Command Command `json:"command"`
+	// set by the server
+	Owner   int       `json:"owner"`
+	Created time.Time `json:"created"`
+	Paused  bool      `json:"paused,omitempty"`
+	// nil if paused or if it will not run anymore
+	NextRun *time.Time `json:"next_run,omitempty"`
+	// the last runs from the oldest to the newest
+	Runs []ScheduleRun `json:"runs,omitempty"`
+}
+
+// overlap policies of a schedule
+const (
+	// the run is recorded as skipped
+	OverlapSkip = "skip"
+	// the run starts once the previous process terminates
+	OverlapQueue = "queue"
+	// the previous process is stopped and the run starts once it terminates
+	OverlapReplace = "replace"
+)
+
+// a run of a schedule
+type ScheduleRun struct {
+	// time the run was due
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+	// process started by the run, empty if none
+	ProcessID string `json:"process_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// outcomes of a run
+const (
+	RunStarted = "started"
+	// started after the previous process terminated
+	RunQueued = "queued"
+	// started after stopping the previous process
+	RunReplaced = "replaced"
+	RunSkipped  = "skipped"
+	// the process could not be started
+	RunFailed = "failed"
+)
+
+// wrap the schedules
+// used in the /schedules endpoint
+type Schedules struct {
+	Schedules []Schedule `json:"schedules"`
+}
+
+// steps started as soon as the steps they depend on succeed
+// used in the /workflows endpoints
+type Workflow struct {
+	// set by the server
+	ID    string         `json:"id,omitempty"`
+	Steps []WorkflowStep `json:"steps"`
+	// namespace sharing the workflow and the processes of its steps, personal if empty
+	Namespace string `json:"namespace,omitempty"`
+	// set by the server
+	Owner   int        `json:"owner"`
+	Created time.Time  `json:"created"`
+	State   string     `json:"state,omitempty"`
+	EndTime *time.Time `json:"end_time,omitempty"`
+}
+
+// a command of a workflow
+type WorkflowStep struct {
+	// unique in the workflow
+	Name    string  `json:"name"`
+	Command Command `json:"command"`
+	// names of the steps whose process must exit 0 before this one starts
+	DependsOn []string `json:"depends_on,omitempty"`
+	// set by the server
+	State string `json:"state,omitempty"`
+	// process started by the step, empty if not started
+	ProcessID string `json:"process_id,omitempty"`
+	// why the step failed or was skipped
+	Error string `json:"error,omitempty"`
+}
+
+// states of a workflow and of its steps
+const (
+	// a step waiting for its dependencies
+	WorkflowWaiting = "waiting"
+	// a workflow with steps left to run, a step whose process is pending or running
+	WorkflowRunning   = "running"
+	WorkflowSucceeded = "succeeded"
+	// a step whose process did not exit 0 or could not start
+	// a workflow terminated with a step that did not succeed
+	WorkflowFailed = "failed"
+	// a step not started because a dependency did not succeed
+	WorkflowSkipped = "skipped"
+	// a workflow stopped through /workflows/cancel
+	WorkflowCancelled = "cancelled"
+)
+
+// wrap the workflows
+// used in the /workflows endpoint
+type Workflows struct {
+	Workflows []Workflow `json:"workflows"`
 }
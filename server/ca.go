@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// files of the certificate authority inside its directory
+const (
+	caCertName = "ca_cert.pem"
+	caKeyName  = "ca_key.pem"
+)
+
+// backdate the certificates to tolerate clocks slightly behind
+const clockSkew = 5 * time.Minute
+
+// certificate authority issuing the server and the client certificates
+type certificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// file of the CA certificate, trusted by the clients and the server
+	certPath string
+}
+
+// create the CA certificate and key in dir
+// an existing CA is never overwritten
+func initCA(dir string, name string, validity time.Duration) (*certificateAuthority, error) {
+	certPath := filepath.Join(dir, caCertName)
+	keyPath := filepath.Join(dir, caKeyName)
+	for _, path := range []string{certPath, keyPath} {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("%s already exists", path)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	if err := setValidity(template, validity); err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return nil, err
+	}
+	if err := saveCertificate(certPath, cert); err != nil {
+		return nil, err
+	}
+	return &certificateAuthority{cert: cert, key: key, certPath: certPath}, nil
+}
+
+// load the CA created by initCA in dir
+func loadCA(dir string) (*certificateAuthority, error) {
+	certPath := filepath.Join(dir, caCertName)
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readKey(filepath.Join(dir, caKeyName))
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certPath)
+	}
+	return &certificateAuthority{cert: cert, key: key, certPath: certPath}, nil
+}
+
+// set a random serial and the validity period starting now
+func setValidity(template *x509.Certificate, validity time.Duration) error {
+	if validity <= 0 {
+		return errors.New("the validity must be positive")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template.SerialNumber = serial
+	template.NotBefore = now.Add(-clockSkew)
+	template.NotAfter = now.Add(validity)
+	return nil
+}
+
+// sign a certificate for the public key
+// it never outlives the CA
+func (ca *certificateAuthority) issue(template *x509.Certificate, public crypto.PublicKey, validity time.Duration) (*x509.Certificate, error) {
+	if err := setValidity(template, validity); err != nil {
+		return nil, err
+	}
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, public, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// server certificate for the host names and the addresses
+func serverTemplate(names []string, addresses []net.IP) (*x509.Certificate, error) {
+	if len(names) == 0 && len(addresses) == 0 {
+		return nil, errors.New("the server certificate needs a DNS name or an IP address")
+	}
+	template := &x509.Certificate{
+		DNSNames:    names,
+		IPAddresses: addresses,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if len(names) > 0 {
+		template.Subject.CommonName = names[0]
+	}
+	return template, nil
+}
+
+// client certificate identified by its common name
+// and optionally by a URI SAN like spiffe://example.org/alice
+func clientTemplate(name string, uri string) (*x509.Certificate, error) {
+	if name == "" {
+		return nil, errors.New("the client certificate needs a name")
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		template.URIs = []*url.URL{parsed}
+	}
+	return template, nil
+}
+
+// generate a key pair and issue its certificate
+// written as cert.pem and key.pem in dir
+func (ca *certificateAuthority) issueKeyPair(dir string, template *x509.Certificate, validity time.Duration) (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ca.issue(template, &key.PublicKey, validity)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := writeKey(filepath.Join(dir, "key.pem"), key); err != nil {
+		return nil, err
+	}
+	return cert, saveCertificate(filepath.Join(dir, "cert.pem"), cert)
+}
+
+// parse a PEM encoded certificate signing request checking its signature
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no certificate request in the pem data")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return csr, csr.CheckSignature()
+}
+
+func encodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func saveCertificate(path string, cert *x509.Certificate) error {
+	return ioutil.WriteFile(path, encodeCertificate(cert), 0644)
+}
+
+// write the PKCS8 private key readable only by the owner
+func writeKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// read the PKCS8 private key written by writeKey
+func readKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a signing key", path)
+	}
+	return signer, nil
+}
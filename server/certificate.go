@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// keypair presented to the clients
+	server_certificate *tls.Certificate
+	// modification time of the files of the loaded keypair
+	certificate_modified [2]time.Time
+	// guards server_certificate and certificate_modified
+	certificate_mutex sync.RWMutex
+
+	// files of the server keypair, reloaded on SIGHUP or when they change
+	serverCertPath string
+	serverKeyPath  string
+	// log a warning when the server certificate expires within this time
+	expiryWarning time.Duration
+)
+
+// modification times of the keypair files
+func certificateModTimes() ([2]time.Time, error) {
+	times := [2]time.Time{}
+	for i, path := range []string{serverCertPath, serverKeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return times, err
+		}
+		times[i] = info.ModTime()
+	}
+	return times, nil
+}
+
+// load the server keypair replacing the one presented to the clients
+// the current one is kept if the new one is invalid
+func reloadServerCertificate() error {
+	modified, err := certificateModTimes()
+	if err != nil {
+		return err
+	}
+	keyPair, err := tls.LoadX509KeyPair(serverCertPath, serverKeyPath)
+	if err != nil {
+		return err
+	}
+	keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	certificate_mutex.Lock()
+	server_certificate = &keyPair
+	certificate_modified = modified
+	certificate_mutex.Unlock()
+	log.Printf("Loaded the server certificate %s valid until %v", certificateSerial(keyPair.Leaf), keyPair.Leaf.NotAfter)
+	warnCertificateExpiry()
+	return nil
+}
+
+// reload the server keypair if its files were modified
+// a half written keypair is retried on the next check
+func checkServerCertificate() {
+	modified, err := certificateModTimes()
+	if err != nil {
+		log.Printf("Cannot check the server certificate: %v", err)
+		return
+	}
+	certificate_mutex.RLock()
+	changed := modified != certificate_modified
+	certificate_mutex.RUnlock()
+	if !changed {
+		return
+	}
+	if err := reloadServerCertificate(); err != nil {
+		log.Printf("Cannot reload the server certificate: %v", err)
+	}
+}
+
+// check the keypair files every interval
+// and warn about the expiry once a day
+func watchServerCertificate(interval time.Duration) {
+	lastWarning := time.Now()
+	for range time.Tick(interval) {
+		checkServerCertificate()
+		if time.Since(lastWarning) >= 24*time.Hour {
+			warnCertificateExpiry()
+			lastWarning = time.Now()
+		}
+	}
+}
+
+// log a warning if the server certificate is expired or expiring soon
+func warnCertificateExpiry() {
+	expiry, err := serverCertificateExpiry()
+	if err != nil {
+		return
+	}
+	left := time.Until(expiry)
+	switch {
+	case left <= 0:
+		log.Printf("Warning: the server certificate expired at %v", expiry)
+	case left <= expiryWarning:
+		log.Printf("Warning: the server certificate expires in %d days at %v", daysUntil(expiry), expiry)
+	}
+}
+
+// time after which the server certificate is no longer valid
+func serverCertificateExpiry() (time.Time, error) {
+	certificate_mutex.RLock()
+	defer certificate_mutex.RUnlock()
+	if server_certificate == nil {
+		return time.Time{}, errors.New("no server certificate loaded")
+	}
+	return server_certificate.Leaf.NotAfter, nil
+}
+
+// whole days left before the time, negative once it has passed
+// rounded down so a time passed less than a day ago is -1
+func daysUntil(expiry time.Time) int {
+	return int(math.Floor(time.Until(expiry).Hours() / 24))
+}
+
+// present the current server keypair
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate_mutex.RLock()
+	defer certificate_mutex.RUnlock()
+	if server_certificate == nil {
+		return nil, errors.New("no server certificate loaded")
+	}
+	return server_certificate, nil
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anterpin/interview/server/apiobj"
+	"github.com/anterpin/interview/server/manager"
+)
+
+// entry of the client registry
+// a client is identified by the identity of a certificate issued by a trusted CA
+// so it keeps the same user when the certificate is renewed
+// or optionally by the fingerprint of its own pinned certificate
+type clientEntry struct {
+	// user id owning the processes of the client
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+	// pinned client certificate, matched by fingerprint
+	Cert string `json:"cert,omitempty"`
+	// URI SAN like spiffe://example.org/alice, DNS SAN, email SAN
+	// or common name of the client certificate
+	Identity string `json:"identity,omitempty"`
+	// CAs issuing the client certificate with Identity, the --clientCA ones if empty
+	CA string `json:"ca,omitempty"`
+	// admin, operator or viewer, operator if empty
+	Role string `json:"role,omitempty"`
+	// same as the admin role
+	Admin bool `json:"admin,omitempty"`
+	// namespaces sharing their processes with the client
+	Namespaces []string `json:"namespaces,omitempty"`
+	// unix user running the processes, the --runAs one or the server one if nil
+	Credential *manager.Credential `json:"credential,omitempty"`
+	// isolation of the processes of the client, the --requireIsolation and --allowNetwork one if nil
+	Policy *manager.Policy `json:"policy,omitempty"`
+	// limits on the processes of the client, the default ones if nil
+	Quota *apiobj.Quota `json:"quota,omitempty"`
+	// weight of the client in the share of the queued slots, 1 if 0
+	Share    int               `json:"share,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// client registry file
+// a registry directory holds instead a client entry per json file
+type clientRegistry struct {
+	Clients []clientEntry `json:"clients"`
+}
+
+// client identified by the identity of a certificate issued by a CA
+type identityKey struct {
+	ca       [sha256.Size]byte
+	identity string
+}
+
+var (
+	// client table that associates the identity of a certificate issued by a CA
+	// to the calling client
+	identity_table map[identityKey]Client
+	// certificates and CAs of the registered clients
+	client_cas *x509.CertPool
+	// CAs issuing the client certificates, the ones signing the CRL
+	issuer_cas []*x509.Certificate
+	// guards user_table, identity_table, namespace_table, client_cas and issuer_cas
+	// replaced on every reload of the client registry
+	tables_mutex sync.RWMutex
+
+	// client registry file or directory
+	registryPath string
+	// CAs issuing the client certificates of the registry entries without one
+	clientCAPath string
+	// unix users given on the command line
+	// used by the clients without their own
+	flagCredentials map[int]manager.Credential
+)
+
+// read the certificate in the pem file
+func readCertificate(file string) (*x509.Certificate, error) {
+	certPem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block in %s", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// read every certificate in the pem file
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	certPem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, certPem = pem.Decode(certPem)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return certs, nil
+}
+
+// identities of the certificate from the most to the least specific
+func certificateIdentities(cert *x509.Certificate) []string {
+	identities := []string{}
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return identities
+}
+
+// read the client entries from the registry file or directory
+// the certificate paths become relative to the registry
+func readClientRegistry(path string) ([]clientEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []clientEntry{}
+	dir := filepath.Dir(path)
+	if !info.IsDir() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		registry := clientRegistry{}
+		if err := json.Unmarshal(data, &registry); err != nil {
+			return nil, fmt.Errorf("invalid client registry %s: %v", path, err)
+		}
+		entries = registry.Clients
+	} else {
+		dir = path
+		files, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			entry := clientEntry{}
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return nil, fmt.Errorf("invalid client entry %s: %v", file, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	for i := range entries {
+		if entries[i].Cert != "" && !filepath.IsAbs(entries[i].Cert) {
+			entries[i].Cert = filepath.Join(dir, entries[i].Cert)
+		}
+		if entries[i].CA != "" && !filepath.IsAbs(entries[i].CA) {
+			entries[i].CA = filepath.Join(dir, entries[i].CA)
+		}
+	}
+	return entries, nil
+}
+
+// add the client entry to the registry file or directory
+// assign it the next free id if it has none
+// the registry is reloaded by the caller
+func registerClient(path string, entry clientEntry) (clientEntry, error) {
+	entries, err := readClientRegistry(path)
+	if os.IsNotExist(err) {
+		entries, err = []clientEntry{}, nil
+	}
+	if err != nil {
+		return entry, err
+	}
+	maxID := 0
+	for _, existing := range entries {
+		if existing.ID == entry.ID {
+			return entry, fmt.Errorf("client %d already registered", entry.ID)
+		}
+		if entry.Identity != "" && existing.Identity == entry.Identity {
+			return entry, fmt.Errorf("identity %q already registered", entry.Identity)
+		}
+		if existing.ID > maxID {
+			maxID = existing.ID
+		}
+	}
+	if entry.ID == 0 {
+		entry.ID = maxID + 1
+	}
+
+	info, err := os.Stat(path)
+	isDir := err == nil && info.IsDir()
+	dir := filepath.Dir(path)
+	if isDir {
+		dir = path
+	}
+	// the paths are kept relative to the registry like the ones written by hand
+	for _, file := range []*string{&entry.Cert, &entry.CA} {
+		if *file == "" {
+			continue
+		}
+		absFile, errFile := filepath.Abs(*file)
+		absDir, errDir := filepath.Abs(dir)
+		if errFile != nil || errDir != nil {
+			continue
+		}
+		if relative, err := filepath.Rel(absDir, absFile); err == nil {
+			*file = relative
+		}
+	}
+
+	if isDir {
+		name := entry.Name
+		if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			name = strconv.Itoa(entry.ID)
+		}
+		data, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return entry, err
+		}
+		file, err := os.OpenFile(filepath.Join(path, name+".json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return entry, err
+		}
+		_, err = file.Write(data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return entry, err
+	}
+
+	// read the file again to keep the paths as written
+	registry := clientRegistry{}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &registry)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return entry, err
+	}
+	registry.Clients = append(registry.Clients, entry)
+	data, err = json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return entry, err
+	}
+	return entry, manager.WriteFileAtomic(path, append(data, '\n'))
+}
+
+// load the client registry at path and replace the client tables
+// and the CAs used to verify the client certificates
+// the current ones are kept if the registry is invalid
+func reloadClients(path string) error {
+	entries, err := readClientRegistry(path)
+	if err != nil {
+		return err
+	}
+
+	trustedCAs := []*x509.Certificate{}
+	if clientCAPath != "" {
+		trustedCAs, err = readCertificates(clientCAPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	userTable := make(map[[sha256.Size]byte]Client)
+	namespaceTable := make(map[string]map[int]bool)
+	identityTable := make(map[identityKey]Client)
+	pool := x509.NewCertPool()
+	issuers := trustedCAs
+	for _, entry := range entries {
+		if entry.ID <= 0 {
+			return fmt.Errorf("client %q must have a positive id", entry.Name)
+		}
+		role, err := parseRole(entry.Role, entry.Admin)
+		if err != nil {
+			return fmt.Errorf("client %d: %v", entry.ID, err)
+		}
+		if entry.Quota != nil {
+			if err := manager.ValidateQuota(*entry.Quota); err != nil {
+				return fmt.Errorf("client %d: %v", entry.ID, err)
+			}
+		}
+		if entry.Share < 0 {
+			return fmt.Errorf("client %d: negative share", entry.ID)
+		}
+		client := Client{
+			id:         entry.ID,
+			name:       entry.Name,
+			role:       role,
+			credential: entry.Credential,
+			metadata:   entry.Metadata,
+		}
+		if credential, exists := flagCredentials[entry.ID]; exists && client.credential == nil {
+			client.credential = &credential
+		}
+		for _, namespace := range entry.Namespaces {
+			if namespace == "" {
+				return fmt.Errorf("client %d: empty namespace name", entry.ID)
+			}
+			if namespaceTable[namespace] == nil {
+				namespaceTable[namespace] = make(map[int]bool)
+			}
+			namespaceTable[namespace][entry.ID] = true
+		}
+
+		switch {
+		case entry.Cert != "" && entry.CA == "" && entry.Identity == "":
+			cert, err := readCertificate(entry.Cert)
+			if err != nil {
+				return fmt.Errorf("client %d: %v", entry.ID, err)
+			}
+			key := useCertificateAsKey(cert)
+			if _, exists := userTable[key]; exists {
+				return fmt.Errorf("client %d: certificate already registered", entry.ID)
+			}
+			userTable[key] = client
+			pool.AddCert(cert)
+		case entry.Cert == "" && entry.Identity != "":
+			cas := trustedCAs
+			if entry.CA != "" {
+				cas, err = readCertificates(entry.CA)
+				if err != nil {
+					return fmt.Errorf("client %d: %v", entry.ID, err)
+				}
+				issuers = append(issuers, cas...)
+			}
+			if len(cas) == 0 {
+				return fmt.Errorf("client %d: no ca issuing the identity %q", entry.ID, entry.Identity)
+			}
+			for _, ca := range cas {
+				key := identityKey{ca: useCertificateAsKey(ca), identity: entry.Identity}
+				if _, exists := identityTable[key]; exists {
+					return fmt.Errorf("client %d: identity %q already registered", entry.ID, entry.Identity)
+				}
+				identityTable[key] = client
+				pool.AddCert(ca)
+			}
+		default:
+			return fmt.Errorf("client %d must have either an identity or a pinned cert", entry.ID)
+		}
+	}
+
+	tables_mutex.Lock()
+	known := make(map[int]bool)
+	for _, client := range user_table {
+		known[client.id] = true
+	}
+	for _, client := range identity_table {
+		known[client.id] = true
+	}
+	user_table = userTable
+	identity_table = identityTable
+	namespace_table = namespaceTable
+	client_cas = pool
+	issuer_cas = issuers
+	tables_mutex.Unlock()
+
+	for _, entry := range entries {
+		if !known[entry.ID] {
+			_manager.AddUser(entry.ID)
+			known[entry.ID] = true
+		}
+		// a policy or a quota removed from the registry falls back to the default one
+		_manager.SetPolicy(entry.ID, entry.Policy)
+		_manager.SetQuota(entry.ID, entry.Quota)
+		_manager.SetShare(entry.ID, entry.Share)
+	}
+	for _, client := range userTable {
+		setClientCredential(client)
+	}
+	for _, client := range identityTable {
+		setClientCredential(client)
+	}
+	log.Printf("Loaded %d clients from %s", len(entries), path)
+	return nil
+}
+
+// a credential removed from the registry falls back to the user running the server
+func setClientCredential(client Client) {
+	_manager.SetCredential(client.id, client.credential)
+}
+
+// return the pool verifying the client certificates
+func clientCAs() *x509.CertPool {
+	tables_mutex.RLock()
+	defer tables_mutex.RUnlock()
+	return client_cas
+}
+
+// return the CAs issuing the client certificates
+func issuerCAs() []*x509.Certificate {
+	tables_mutex.RLock()
+	defer tables_mutex.RUnlock()
+	return issuer_cas
+}
+
+// retrieve the client calling the request
+// refuse it if its certificate was revoked
+// a pinned certificate is matched by fingerprint
+// otherwise by its first identity registered for the CA that verified it
+func getClient(r *http.Request) (Client, error) {
+	if r.TLS == nil {
+		return Client{}, errors.New("the request was made without a TLS connection")
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return Client{}, errors.New("there is no peer certifcate")
+	}
+	cert := r.TLS.PeerCertificates[0]
+
+	// the connection may be older than the revocation
+	chains := r.TLS.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{{cert}}
+	}
+	for _, chain := range chains {
+		if err := checkRevoked(chain); err != nil {
+			return Client{}, err
+		}
+	}
+
+	tables_mutex.RLock()
+	defer tables_mutex.RUnlock()
+
+	client, exists := user_table[useCertificateAsKey(cert)]
+	if exists {
+		return client, nil
+	}
+	identities := certificateIdentities(cert)
+	for _, chain := range r.TLS.VerifiedChains {
+		// the root of the chain is the trusted CA
+		ca := useCertificateAsKey(chain[len(chain)-1])
+		for _, identity := range identities {
+			client, exists := identity_table[identityKey{ca: ca, identity: identity}]
+			if exists {
+				return client, nil
+			}
+		}
+	}
+	return Client{}, errors.New("unknown user")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
+	"github.com/anterpin/interview/server/manager"
+)
+
+// name of the file in the data directory keeping the enrollment tokens
+const tokensName = "enroll.json"
+
+// returned for an unknown, used or expired enrollment token
+var errInvalidToken = errors.New("invalid or expired token")
+
+// one-time token letting a new client obtain its certificate
+type enrollToken struct {
+	// sha256 of the token, the token itself is shown only when created
+	Hash string `json:"hash"`
+	// identity of the client, the common name of its certificate
+	Name string `json:"name"`
+	// user id of the client, the next free one if 0
+	ID      int       `json:"id,omitempty"`
+	Role    string    `json:"role,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// enrollment tokens file
+type enrollTokens struct {
+	Tokens []enrollToken `json:"tokens"`
+}
+
+var (
+	// serializes the enrollments and the changes of the tokens file
+	enroll_mutex sync.Mutex
+
+	// file keeping the enrollment tokens
+	tokensPath string
+	// directory of the CA issuing the enrolled client certificates
+	caPath string
+	// validity of the enrolled client certificates
+	enrollValidity time.Duration
+)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// read the tokens that are not expired yet
+func readTokens(path string) ([]enrollToken, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []enrollToken{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokens := enrollTokens{}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid enrollment tokens %s: %v", path, err)
+	}
+	valid := []enrollToken{}
+	now := time.Now()
+	for _, token := range tokens.Tokens {
+		if now.Before(token.Expires) {
+			valid = append(valid, token)
+		}
+	}
+	return valid, nil
+}
+
+func writeTokens(path string, tokens []enrollToken) error {
+	data, err := json.MarshalIndent(enrollTokens{Tokens: tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return manager.WriteFileAtomic(path, data)
+}
+
+// create a token enrolling the client name valid for ttl
+// only its hash is stored
+func createToken(path string, name string, id int, role string, ttl time.Duration) (string, error) {
+	if name == "" {
+		return "", errors.New("the client needs a name")
+	}
+	if _, err := parseRole(role, false); err != nil {
+		return "", err
+	}
+	if ttl <= 0 {
+		return "", errors.New("the token lifetime must be positive")
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+
+	enroll_mutex.Lock()
+	defer enroll_mutex.Unlock()
+	tokens, err := readTokens(path)
+	if err != nil {
+		return "", err
+	}
+	tokens = append(tokens, enrollToken{
+		Hash:    hashToken(token),
+		Name:    name,
+		ID:      id,
+		Role:    role,
+		Expires: time.Now().Add(ttl),
+	})
+	return token, writeTokens(path, tokens)
+}
+
+// issue a client certificate for the key of the request
+// register the client with the identity of the token and use up the token
+func enrollClient(request apiobj.Enroll) (apiobj.Enrollment, error) {
+	enroll_mutex.Lock()
+	defer enroll_mutex.Unlock()
+
+	tokens, err := readTokens(tokensPath)
+	if err != nil {
+		return apiobj.Enrollment{}, err
+	}
+	hash := hashToken(request.Token)
+	index := -1
+	for i, token := range tokens {
+		if token.Hash == hash {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return apiobj.Enrollment{}, errInvalidToken
+	}
+	token := tokens[index]
+
+	ca, err := loadCA(caPath)
+	if err != nil {
+		return apiobj.Enrollment{}, fmt.Errorf("enrollment is not available: %v", err)
+	}
+	csr, err := parseCSR([]byte(request.CSR))
+	if err != nil {
+		return apiobj.Enrollment{}, err
+	}
+	template, err := clientTemplate(token.Name, "")
+	if err != nil {
+		return apiobj.Enrollment{}, err
+	}
+	cert, err := ca.issue(template, csr.PublicKey, enrollValidity)
+	if err != nil {
+		return apiobj.Enrollment{}, err
+	}
+
+	entry, err := registerClient(registryPath, clientEntry{
+		ID:       token.ID,
+		Name:     token.Name,
+		Identity: token.Name,
+		CA:       ca.certPath,
+		Role:     token.Role,
+	})
+	if err != nil {
+		return apiobj.Enrollment{}, err
+	}
+	// the token is used even if the registry cannot be reloaded
+	// the client is in the registry and the certificate is issued
+	tokens = append(tokens[:index], tokens[index+1:]...)
+	if err := writeTokens(tokensPath, tokens); err != nil {
+		log.Printf("Cannot remove the used enrollment token of %s: %v", token.Name, err)
+	}
+	if err := reloadClients(registryPath); err != nil {
+		return apiobj.Enrollment{}, err
+	}
+
+	log.Printf("Audit: enrolled client %d %s with the certificate %s", entry.ID, entry.Name, certificateSerial(cert))
+	return apiobj.Enrollment{
+		ID:   entry.ID,
+		Cert: string(encodeCertificate(cert)),
+		CA:   string(encodeCertificate(ca.cert)),
+	}, nil
+}
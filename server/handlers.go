@@ -1,35 +1,100 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/anterpin/interview/server/apiobj"
+	"github.com/anterpin/interview/server/manager"
 )
 
+// refuse the request of an unknown, revoked or unauthorized client
+func forbidden(rw http.ResponseWriter, err error) {
+	message := "forbidden"
+	if errors.Is(err, errCertificateRevoked) || errors.Is(err, errNotPermitted) {
+		message = "forbidden: " + err.Error()
+	}
+	rw.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: message})
+}
+
+// resolve the owner of the process checking the client can act on it
+// a process the client cannot read looks like a missing one
+func processOwner(client Client, id string, action permission) (int, int, error) {
+	status, err := _manager.Lookup(id)
+	if err != nil {
+		return -1, http.StatusBadRequest, err
+	}
+	if !client.can(permissionRead, status) {
+		return -1, http.StatusBadRequest, fmt.Errorf("do not exist process id %s", id)
+	}
+	if !client.can(action, status) {
+		return -1, http.StatusForbidden, errNotPermitted
+	}
+	return status.Owner, http.StatusOK, nil
+}
+
+// write the error of processOwner
+func processError(rw http.ResponseWriter, code int, err error) {
+	if code == http.StatusForbidden {
+		forbidden(rw, err)
+		return
+	}
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+}
+
 // schedule a process owned by the calling client
 // return the process id
 func start(rw http.ResponseWriter, r *http.Request) {
-	userid, err := getUserId(r)
+	client, err := getClient(r)
 	if err != nil {
-		rw.WriteHeader(http.StatusForbidden)
-		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "forbidden"})
+		forbidden(rw, err)
+		return
+	}
+	userid := client.id
+	if !client.allows(permissionStart) {
+		forbidden(rw, errNotPermitted)
 		return
 	}
 	commandObj := apiobj.Command{}
 	decoder := json.NewDecoder(r.Body)
 	err = decoder.Decode(&commandObj)
 
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	commandObj.Namespace = strings.TrimSpace(commandObj.Namespace)
+	err = client.canStart(commandObj.Namespace)
+	if err == errNotPermitted {
+		forbidden(rw, err)
+		return
+	}
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
 		return
 	}
 
-	command := strings.TrimSpace(commandObj.Command)
-	id, err := _manager.Start(command, userid)
+	commandObj.Command = strings.TrimSpace(commandObj.Command)
+	id, err := _manager.Start(commandObj, userid)
+	if errors.Is(err, manager.ErrQuotaExceeded) {
+		rw.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
@@ -39,19 +104,75 @@ func start(rw http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(rw).Encode(apiobj.UUID{UUID: id})
 }
 
-// stop a process given a id owned by the calling client
+// stop a process given a id managed by the calling client
+// sending the requested signal, SIGTERM by default
+// and SIGKILL if it is still running after the grace period
 func stop(rw http.ResponseWriter, r *http.Request) {
-	userid, err := getUserId(r)
+	client, err := getClient(r)
 	if err != nil {
-		rw.WriteHeader(http.StatusForbidden)
-		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "forbidden"})
+		forbidden(rw, err)
 		fmt.Fprint(rw, err.Error())
 		return
 	}
 
-	idObj := apiobj.UUID{}
+	stopObj := apiobj.Stop{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&stopObj)
+
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+
+	signal := syscall.SIGTERM
+	if stopObj.Signal != "" {
+		signal, err = manager.ParseSignal(stopObj.Signal)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+			return
+		}
+	}
+	// 0 lets the manager use its default
+	grace := time.Duration(0)
+	if stopObj.Timeout != "" {
+		grace, err = time.ParseDuration(stopObj.Timeout)
+		if err != nil || grace <= 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "timeout must be a positive duration"})
+			return
+		}
+	}
+
+	id := strings.TrimSpace(stopObj.UUID)
+	owner, code, err := processOwner(client, id, permissionStop)
+	if err != nil {
+		processError(rw, code, err)
+		return
+	}
+	err = _manager.Stop(id, owner, signal, grace)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+
+	_ = json.NewEncoder(rw).Encode(apiobj.Status{Status: "ok"})
+}
+
+// remove a terminated process given a id managed by the calling client
+// and its output, they do not count anymore in its quota
+func remove(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil {
+		forbidden(rw, err)
+		return
+	}
+
+	uuidObj := apiobj.UUID{}
 	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&idObj)
+	err = decoder.Decode(&uuidObj)
 
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -59,8 +180,13 @@ func stop(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := strings.TrimSpace(idObj.UUID)
-	err = _manager.Stop(id, userid)
+	id := strings.TrimSpace(uuidObj.UUID)
+	owner, code, err := processOwner(client, id, permissionStop)
+	if err != nil {
+		processError(rw, code, err)
+		return
+	}
+	err = _manager.Remove(id, owner)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
@@ -70,25 +196,37 @@ func stop(rw http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(rw).Encode(apiobj.Status{Status: "ok"})
 }
 
-// list all the processes owned by the calling client
+// list all the processes the calling client can read
+// its own, the ones of its namespaces or every one for the admins
+// the optional get parameter namespace selects the processes of a namespace
 func list(rw http.ResponseWriter, r *http.Request) {
-	userid, err := getUserId(r)
+	client, err := getClient(r)
 	if err != nil {
-		rw.WriteHeader(http.StatusForbidden)
-		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "forbidden"})
+		forbidden(rw, err)
 		return
 	}
 
-	strArr := _manager.List(userid)
-	_ = json.NewEncoder(rw).Encode(apiobj.List{List: strArr})
+	query := r.URL.Query()
+	namespaces, filtered := query["namespace"]
+	if filtered && len(namespaces) != 1 {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "get parameter namespace must be set once"})
+		return
+	}
+	statusArr := _manager.ListMatching(func(status apiobj.ProcessStatus) bool {
+		if filtered && status.Namespace != namespaces[0] {
+			return false
+		}
+		return client.can(permissionRead, status)
+	})
+	_ = json.NewEncoder(rw).Encode(apiobj.List{List: statusArr})
 }
 
-// return the process state object of the process having that id and owned by the client
+// return the snapshot of the process having that id and readable by the client
 func status(rw http.ResponseWriter, r *http.Request) {
-	userid, err := getUserId(r)
+	client, err := getClient(r)
 	if err != nil {
-		rw.WriteHeader(http.StatusForbidden)
-		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "forbidden"})
+		forbidden(rw, err)
 		return
 	}
 
@@ -100,7 +238,12 @@ func status(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	id := strings.TrimSpace(ids[0])
-	status, err := _manager.Status(id, userid)
+	owner, code, err := processOwner(client, id, permissionRead)
+	if err != nil {
+		processError(rw, code, err)
+		return
+	}
+	status, err := _manager.Status(id, owner)
 
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -110,28 +253,691 @@ func status(rw http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(rw).Encode(apiobj.State{State: status})
 }
 
-// return the output of the process given the id and owned by the client
+// return the output of the process given the id and readable by the client
+// the optional get parameters stream, since and until select the output
+// entries=true returns every entry with its stream and timestamp instead of the log
+// follow=true streams the output until the process terminates
 func _log(rw http.ResponseWriter, r *http.Request) {
-	userid, err := getUserId(r)
+	client, err := getClient(r)
 	if err != nil {
-		rw.WriteHeader(http.StatusForbidden)
-		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "forbidden"})
+		forbidden(rw, err)
 		return
 	}
 
-	ids, ok := r.URL.Query()["id"]
+	query := r.URL.Query()
+	ids, ok := query["id"]
 	if !ok || len(ids) != 1 || len(ids[0]) < 1 {
 		rw.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "missing get parameter id"})
 		return
 	}
 
+	filter, err := getLogFilter(query)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	follow, err := getBoolParameter(query, "follow")
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	withEntries, err := getBoolParameter(query, "entries")
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+
 	id := strings.TrimSpace(ids[0])
-	str, err := _manager.Log(id, userid)
+	owner, code, err := processOwner(client, id, permissionRead)
+	if err != nil {
+		processError(rw, code, err)
+		return
+	}
+	if follow {
+		followLog(rw, r, id, owner, filter, withEntries)
+		return
+	}
+
+	// the output is sent once, in the entries if requested
+	writer := &logWriter{rw: rw, withEntries: withEntries}
+	err = _manager.Log(id, owner, filter, writer.write)
+	// once the response is started the status code cannot be changed anymore
+	if err != nil && !writer.started {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Cannot send the output of the process %s: %v", id, err)
+		return
+	}
+	writer.close()
+}
+
+// write the apiobj.Log of a process one chunk of entries at a time
+// so the whole output is never held in memory
+type logWriter struct {
+	rw          http.ResponseWriter
+	withEntries bool
+	started     bool
+	// end of the log cut in the middle of a rune
+	// encoded with the next chunk
+	partial []byte
+}
+
+func (writer *logWriter) write(entries []manager.Entry) error {
+	buffer := bytes.Buffer{}
+	if writer.withEntries {
+		for _, entry := range entries {
+			data, err := json.Marshal(logEntry(entry))
+			if err != nil {
+				return err
+			}
+			writer.separator(&buffer, `{"entries":[`, ",")
+			buffer.Write(data)
+		}
+	} else {
+		data := writer.partial
+		for _, entry := range entries {
+			data = append(data, entry.Data...)
+		}
+		end := completeRunes(data)
+		writer.partial = append([]byte{}, data[end:]...)
+		writer.writeLog(&buffer, data[:end])
+	}
+	_, err := writer.rw.Write(buffer.Bytes())
+	return err
+}
+
+// write the separator, or the start of the object before the first value
+func (writer *logWriter) separator(buffer *bytes.Buffer, start string, separator string) {
+	if writer.started {
+		buffer.WriteString(separator)
+		return
+	}
+	writer.started = true
+	buffer.WriteString(start)
+}
+
+// write data escaped as part of the log string
+func (writer *logWriter) writeLog(buffer *bytes.Buffer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	writer.separator(buffer, `{"log":"`, "")
+	// the escaping of every rune does not depend on the others
+	str, _ := json.Marshal(string(data))
+	buffer.Write(str[1 : len(str)-1])
+}
+
+// end the object, the log cut in a rune included
+func (writer *logWriter) close() {
+	buffer := bytes.Buffer{}
+	writer.writeLog(&buffer, writer.partial)
+	switch {
+	case !writer.started:
+		buffer.WriteString("{}")
+	case writer.withEntries:
+		buffer.WriteString("]}")
+	default:
+		buffer.WriteString(`"}`)
+	}
+	buffer.WriteString("\n")
+	_, _ = writer.rw.Write(buffer.Bytes())
+}
+
+// return the length of the prefix of p not ending in the middle of a rune
+func completeRunes(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(p)
+}
+
+func logEntry(entry manager.Entry) apiobj.LogEntry {
+	return apiobj.LogEntry{
+		Stream: entry.Stream.String(),
+		Time:   entry.Time,
+		Data:   string(entry.Data),
+	}
+}
+
+// parse the optional boolean get parameter key, false if missing
+func getBoolParameter(query url.Values, key string) (bool, error) {
+	values, ok := query[key]
+	if !ok {
+		return false, nil
+	}
+	if len(values) != 1 {
+		return false, fmt.Errorf("get parameter %s must be set once", key)
+	}
+	value, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, fmt.Errorf("get parameter %s must be a boolean", key)
+	}
+	return value, nil
+}
+
+// parse the optional time get parameter key, the zero time if missing
+// it is either a RFC3339 timestamp or a duration before now like 10m
+func getTimeParameter(query url.Values, key string) (time.Time, error) {
+	values, ok := query[key]
+	if !ok {
+		return time.Time{}, nil
+	}
+	if len(values) != 1 {
+		return time.Time{}, fmt.Errorf("get parameter %s must be set once", key)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, values[0]); err == nil {
+		return t, nil
+	}
+	duration, err := time.ParseDuration(values[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get parameter %s must be a RFC3339 timestamp or a duration", key)
+	}
+	return time.Now().Add(-duration), nil
+}
+
+// build the output filter from the get parameters stream, since and until
+func getLogFilter(query url.Values) (manager.Filter, error) {
+	filter := manager.Filter{Streams: manager.Both}
+	if streams, ok := query["stream"]; ok {
+		if len(streams) != 1 {
+			return filter, errors.New("get parameter stream must be set once")
+		}
+		stream, err := manager.ParseStream(streams[0])
+		if err != nil {
+			return filter, err
+		}
+		filter.Streams = stream
+	}
+
+	var err error
+	filter.Since, err = getTimeParameter(query, "since")
 	if err != nil {
+		return filter, err
+	}
+	filter.Until, err = getTimeParameter(query, "until")
+	if err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// stream the output of the process given the id and owned by userid
+// using a chunked response that ends when the process terminates
+// or when the client goes away
+// the output is sent as raw text or as a log entry object per line
+func followLog(rw http.ResponseWriter, r *http.Request, id string, userid int, filter manager.Filter, withEntries bool) {
+	writer := &flushWriter{rw: rw, contentType: "text/plain; charset=utf-8"}
+	if withEntries {
+		writer.contentType = "application/x-ndjson"
+	}
+	encoder := json.NewEncoder(writer)
+	err := _manager.Follow(r.Context(), id, userid, filter, func(entries []manager.Entry) error {
+		for _, entry := range entries {
+			var err error
+			if withEntries {
+				err = encoder.Encode(logEntry(entry))
+			} else {
+				_, err = writer.Write(entry.Data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// once the stream is started the status code cannot be changed anymore
+	if err != nil && !writer.started {
 		rw.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
 		return
 	}
-	_ = json.NewEncoder(rw).Encode(apiobj.Log{Log: str})
+	if !writer.started {
+		// the process terminated without any output
+		writer.start()
+	}
+}
+
+// send every chunk to the client as soon as it is written
+type flushWriter struct {
+	rw          http.ResponseWriter
+	contentType string
+	started     bool
+}
+
+func (writer *flushWriter) start() {
+	writer.started = true
+	writer.rw.Header().Set("Content-Type", writer.contentType)
+	writer.rw.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.rw.WriteHeader(http.StatusOK)
+}
+
+func (writer *flushWriter) Write(p []byte) (int, error) {
+	if !writer.started {
+		writer.start()
+	}
+	n, err := writer.rw.Write(p)
+	if flusher, ok := writer.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// reload the client registry and the CRL, only for the admin clients
+func reloadRegistry(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil || !client.allows(permissionAdmin) {
+		forbidden(rw, err)
+		return
+	}
+
+	err = reloadClients(registryPath)
+	if err == nil {
+		err = reloadCRL(crlPath)
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(apiobj.Status{Status: "ok"})
+}
+
+// revoke a client certificate by serial, only for the admin clients
+func revoke(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil || !client.allows(permissionAdmin) {
+		forbidden(rw, err)
+		return
+	}
+
+	revocation := apiobj.Revocation{}
+	err = json.NewDecoder(r.Body).Decode(&revocation)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	revocation, err = revokeSerial(revocation)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	log.Printf("Audit: client %d revoked the certificate %s: %s", client.id, revocation.Serial, revocation.Reason)
+	_ = json.NewEncoder(rw).Encode(apiobj.Status{Status: "ok"})
+}
+
+// reinstate a client certificate revoked by serial, only for the admin clients
+func unrevoke(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil || !client.allows(permissionAdmin) {
+		forbidden(rw, err)
+		return
+	}
+
+	revocation := apiobj.Revocation{}
+	err = json.NewDecoder(r.Body).Decode(&revocation)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	err = unrevokeSerial(revocation.Serial)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	log.Printf("Audit: client %d reinstated the certificate %s", client.id, revocation.Serial)
+	_ = json.NewEncoder(rw).Encode(apiobj.Status{Status: "ok"})
+}
+
+// list the certificates revoked by serial, only for the admin clients
+func revocations(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil || !client.allows(permissionAdmin) {
+		forbidden(rw, err)
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(apiobj.Revocations{Revocations: listRevocations()})
+}
+
+// issue a certificate to a new client with a one-time token
+// callable without a client certificate
+func enroll(rw http.ResponseWriter, r *http.Request) {
+	request := apiobj.Enroll{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+
+	enrollment, err := enrollClient(request)
+	if errors.Is(err, errInvalidToken) {
+		log.Printf("Audit: refused an enrollment from %s: %v", r.RemoteAddr, err)
+		rw.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "forbidden: " + err.Error()})
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(enrollment)
+}
+
+// report the state of the server and its certificate
+// callable without a client certificate like /enroll
+func health(rw http.ResponseWriter, r *http.Request) {
+	expiry, err := serverCertificateExpiry()
+	if err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	healthObj := apiobj.Health{
+		Status:              "ok",
+		CertificateExpiry:   expiry,
+		CertificateDaysLeft: daysUntil(expiry),
+	}
+	if time.Now().After(expiry) {
+		healthObj.Status = "certificate expired"
+	}
+	_ = json.NewEncoder(rw).Encode(healthObj)
+}
+
+// report the quota of the calling client and how much of it is used
+func quota(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil {
+		forbidden(rw, err)
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(_manager.Usage(client.id))
+}
+
+// resolve the owner of the schedule checking the client can act on it
+// a schedule the client cannot read looks like a missing one
+func scheduleOwner(client Client, id string, action permission) (int, int, error) {
+	schedule, err := _manager.LookupSchedule(id)
+	if err != nil {
+		return -1, http.StatusBadRequest, err
+	}
+	if !client.canSchedule(permissionRead, schedule) {
+		return -1, http.StatusBadRequest, fmt.Errorf("do not exist schedule id %s", id)
+	}
+	if !client.canSchedule(action, schedule) {
+		return -1, http.StatusForbidden, errNotPermitted
+	}
+	return schedule.Owner, http.StatusOK, nil
+}
+
+// list the schedules the calling client can read with their runs
+// the optional get parameter id selects a schedule
+func schedules(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil {
+		forbidden(rw, err)
+		return
+	}
+
+	ids, selected := r.URL.Query()["id"]
+	if selected && len(ids) != 1 {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "get parameter id must be set once"})
+		return
+	}
+	if selected {
+		id := strings.TrimSpace(ids[0])
+		if _, code, err := scheduleOwner(client, id, permissionRead); err != nil {
+			processError(rw, code, err)
+			return
+		}
+		schedule, err := _manager.LookupSchedule(id)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(apiobj.Schedules{Schedules: []apiobj.Schedule{schedule}})
+		return
+	}
+	list := _manager.ListSchedules(func(schedule apiobj.Schedule) bool {
+		return client.canSchedule(permissionRead, schedule)
+	})
+	_ = json.NewEncoder(rw).Encode(apiobj.Schedules{Schedules: list})
+}
+
+// add a schedule owned by the calling client starting its command
+// at run_at or on every match of cron
+// return the schedule with its id
+func createSchedule(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil {
+		forbidden(rw, err)
+		return
+	}
+	if !client.allows(permissionStart) {
+		forbidden(rw, errNotPermitted)
+		return
+	}
+	scheduleObj := apiobj.Schedule{}
+	err = json.NewDecoder(r.Body).Decode(&scheduleObj)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	scheduleObj.Command.Namespace = strings.TrimSpace(scheduleObj.Command.Namespace)
+	err = client.canStart(scheduleObj.Command.Namespace)
+	if err == errNotPermitted {
+		forbidden(rw, err)
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+
+	scheduleObj.Command.Command = strings.TrimSpace(scheduleObj.Command.Command)
+	scheduleObj, err = _manager.CreateSchedule(scheduleObj, client.id)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(scheduleObj)
+}
+
+// remove a schedule given its id, the processes it started are kept
+func deleteSchedule(rw http.ResponseWriter, r *http.Request) {
+	manageSchedule(rw, r, _manager.DeleteSchedule)
+}
+
+// stop starting the command of a schedule given its id until resumed
+func pauseSchedule(rw http.ResponseWriter, r *http.Request) {
+	manageSchedule(rw, r, func(id string, owner int) error {
+		return _manager.PauseSchedule(id, owner, true)
+	})
+}
+
+// start again the command of a paused schedule given its id
+func resumeSchedule(rw http.ResponseWriter, r *http.Request) {
+	manageSchedule(rw, r, func(id string, owner int) error {
+		return _manager.PauseSchedule(id, owner, false)
+	})
+}
+
+// apply action to the schedule whose id is in the body
+// if the client can start processes on its behalf
+func manageSchedule(rw http.ResponseWriter, r *http.Request, action func(string, int) error) {
+	client, err := getClient(r)
+	if err != nil {
+		forbidden(rw, err)
+		return
+	}
+
+	uuidObj := apiobj.UUID{}
+	err = json.NewDecoder(r.Body).Decode(&uuidObj)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+
+	id := strings.TrimSpace(uuidObj.UUID)
+	owner, code, err := scheduleOwner(client, id, permissionStart)
+	if err != nil {
+		processError(rw, code, err)
+		return
+	}
+	err = action(id, owner)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(apiobj.Status{Status: "ok"})
+}
+
+// resolve the owner of the workflow checking the client can act on it
+// a workflow the client cannot read looks like a missing one
+func workflowOwner(client Client, id string, action permission) (int, int, error) {
+	workflow, err := _manager.LookupWorkflow(id)
+	if err != nil {
+		return -1, http.StatusBadRequest, err
+	}
+	if !client.canWorkflow(permissionRead, workflow) {
+		return -1, http.StatusBadRequest, fmt.Errorf("do not exist workflow id %s", id)
+	}
+	if !client.canWorkflow(action, workflow) {
+		return -1, http.StatusForbidden, errNotPermitted
+	}
+	return workflow.Owner, http.StatusOK, nil
+}
+
+// list the workflows the calling client can read with the state of their steps
+// the optional get parameter id selects a workflow
+func workflows(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil {
+		forbidden(rw, err)
+		return
+	}
+
+	ids, selected := r.URL.Query()["id"]
+	if selected && len(ids) != 1 {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: "get parameter id must be set once"})
+		return
+	}
+	if selected {
+		id := strings.TrimSpace(ids[0])
+		if _, code, err := workflowOwner(client, id, permissionRead); err != nil {
+			processError(rw, code, err)
+			return
+		}
+		workflow, err := _manager.LookupWorkflow(id)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(apiobj.Workflows{Workflows: []apiobj.Workflow{workflow}})
+		return
+	}
+	list := _manager.ListWorkflows(func(workflow apiobj.Workflow) bool {
+		return client.canWorkflow(permissionRead, workflow)
+	})
+	_ = json.NewEncoder(rw).Encode(apiobj.Workflows{Workflows: list})
+}
+
+// add a workflow owned by the calling client
+// starting every step once the steps it depends on succeed
+// return the workflow with its id and the processes of the first steps
+func createWorkflow(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil {
+		forbidden(rw, err)
+		return
+	}
+	if !client.allows(permissionStart) {
+		forbidden(rw, errNotPermitted)
+		return
+	}
+	workflowObj := apiobj.Workflow{}
+	err = json.NewDecoder(r.Body).Decode(&workflowObj)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	workflowObj.Namespace = strings.TrimSpace(workflowObj.Namespace)
+	err = client.canStart(workflowObj.Namespace)
+	if err == errNotPermitted {
+		forbidden(rw, err)
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+
+	for i := range workflowObj.Steps {
+		workflowObj.Steps[i].Command.Command = strings.TrimSpace(workflowObj.Steps[i].Command.Command)
+	}
+	workflowObj, err = _manager.CreateWorkflow(workflowObj, client.id)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(workflowObj)
+}
+
+// stop the running steps of a workflow given its id and skip the waiting ones
+func cancelWorkflow(rw http.ResponseWriter, r *http.Request) {
+	client, err := getClient(r)
+	if err != nil {
+		forbidden(rw, err)
+		return
+	}
+
+	uuidObj := apiobj.UUID{}
+	err = json.NewDecoder(r.Body).Decode(&uuidObj)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+
+	id := strings.TrimSpace(uuidObj.UUID)
+	owner, code, err := workflowOwner(client, id, permissionStop)
+	if err != nil {
+		processError(rw, code, err)
+		return
+	}
+	err = _manager.CancelWorkflow(id, owner)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(apiobj.Error{Err: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(apiobj.Status{Status: "ok"})
 }
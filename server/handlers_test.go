@@ -2,17 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/anterpin/interview/server/apiobj"
 	"github.com/anterpin/interview/server/manager"
@@ -35,10 +47,20 @@ func setupCert(file string, t *testing.T) *x509.Certificate {
 	return cert
 }
 
+// replace the global manager with a new one keeping the output in RAM
+// the tests may run as root
+func setupManager(t *testing.T) {
+	var err error
+	_manager, err = manager.NewManager(manager.Config{AllowRoot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestAuthorization(t *testing.T) {
 
 	// setup manager
-	_manager = manager.NewManager()
+	setupManager(t)
 	_manager.AddUser(1)
 	cert1 := setupCertAndManager("certs/client_cert.pem", 1) // add to user_table and to manager
 	cert2 := setupCert("certs/client_cert2.pem", t)          // get only the certificate
@@ -130,12 +152,12 @@ func makeRequest2(testServer *httptest.Server, certs []*x509.Certificate, endpoi
 	return req
 }
 func TestHandlers(t *testing.T) {
-	_manager = manager.NewManager()
+	setupManager(t)
 	_manager.AddUser(1)
 	cert1 := setupCertAndManager("certs/client_cert.pem", 1) // add to user_table and to manager
 	cert2 := setupCert("certs/client_cert2.pem", t)          // get only the certificate
 
-	uuid, err := _manager.Start("watch date", 1)
+	uuid, err := _manager.Start(apiobj.Command{Command: "watch date"}, 1)
 	if err != nil {
 		t.Fatal("cannot start the test")
 	}
@@ -164,13 +186,21 @@ func TestHandlers(t *testing.T) {
 				{makeRequest(srv, []*x509.Certificate{cert2}, "stop", nil, "", nil), http.StatusForbidden},
 			},
 		},
+		{
+			"bad stop options",
+			[]ET{
+				{makeRequest(srv, []*x509.Certificate{cert1}, "stop", apiobj.Stop{UUID: uuid, Signal: "SIGFOO"}, "", nil), http.StatusBadRequest},
+				{makeRequest(srv, []*x509.Certificate{cert1}, "stop", apiobj.Stop{UUID: uuid, Timeout: "ten"}, "", nil), http.StatusBadRequest},
+				{makeRequest(srv, []*x509.Certificate{cert1}, "stop", apiobj.Stop{UUID: uuid, Timeout: "-1s"}, "", nil), http.StatusBadRequest},
+			},
+		},
 		{
 			"normal request",
 			[]ET{
 				{makeRequest(srv, []*x509.Certificate{cert1}, "list", nil, "", nil), http.StatusOK},
 				{makeRequest(srv, []*x509.Certificate{cert1}, "log", nil, "id", []string{uuid}), http.StatusOK},
 				{makeRequest(srv, []*x509.Certificate{cert1}, "status", nil, "id", []string{uuid}), http.StatusOK},
-				{makeRequest(srv, []*x509.Certificate{cert1}, "stop", apiobj.UUID{UUID: uuid}, "", nil), http.StatusOK},
+				{makeRequest(srv, []*x509.Certificate{cert1}, "stop", apiobj.Stop{UUID: uuid, Signal: "TERM", Timeout: "1s"}, "", nil), http.StatusOK},
 			},
 		},
 		{
@@ -220,3 +250,1343 @@ func TestHandlers(t *testing.T) {
 		})
 	}
 }
+
+func TestLog(t *testing.T) {
+	setupManager(t)
+	_manager.AddUser(1)
+	cert1 := setupCertAndManager("certs/client_cert.pem", 1)
+
+	uuid, err := _manager.Start(apiobj.Command{Command: "echo hello"}, 1)
+	if err != nil {
+		t.Fatal("cannot start the test")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/log", _log)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tt := []struct {
+		name       string
+		uri        string
+		statusCode int
+		body       string
+	}{
+		{"follow", "id=" + uuid + "&follow=true", http.StatusOK, "hello\n"},
+		{"unknown id", "id=95bf5b81-74bc-47e7-8622-e2aace3e866f&follow=true", http.StatusBadRequest, ""},
+		{"not a boolean", "id=" + uuid + "&follow=yes", http.StatusBadRequest, ""},
+		{"repeated follow", "id=" + uuid + "&follow=true&follow=false", http.StatusBadRequest, ""},
+		{"stdout", "id=" + uuid + "&stream=stdout", http.StatusOK, `{"log":"hello\n"}`},
+		{"stderr", "id=" + uuid + "&stream=stderr", http.StatusOK, `{}`},
+		{"unknown stream", "id=" + uuid + "&stream=stdin", http.StatusBadRequest, ""},
+		{"since duration", "id=" + uuid + "&since=1h", http.StatusOK, `{"log":"hello\n"}`},
+		{"until timestamp", "id=" + uuid + "&until=2000-01-01T00:00:00Z", http.StatusOK, `{}`},
+		{"bad since", "id=" + uuid + "&since=yesterday", http.StatusBadRequest, ""},
+		// the output is not sent twice
+		{"entries", "id=" + uuid + "&entries=true", http.StatusOK, `{"entries":[{"stream":"stdout","time":`},
+		{"follow entries", "id=" + uuid + "&follow=true&entries=true", http.StatusOK, `{"stream":"stdout","time":`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, makeRequest2(srv, []*x509.Certificate{cert1}, "log", "", tc.uri))
+			res := rec.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.statusCode {
+				t.Fatalf("error on test %s %d", tc.name, res.StatusCode)
+			}
+			if tc.statusCode != http.StatusOK {
+				return
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			if !strings.Contains(string(body), tc.body) {
+				t.Fatalf("error on test %s unexpected body %q", tc.name, body)
+			}
+		})
+	}
+
+	t.Run("chunks", func(t *testing.T) {
+		// bigger than a read chunk
+		script := `head -c 100000 /dev/zero | tr '\0' '<'`
+		uuid, err := _manager.Start(apiobj.Command{Argv: []string{"sh", "-c", script}}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := _manager.Follow(context.Background(), uuid, 1, manager.Filter{}, func([]manager.Entry) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		for _, withEntries := range []bool{false, true} {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, makeRequest2(srv, []*x509.Certificate{cert1}, "log", "", "id="+uuid+"&entries="+strconv.FormatBool(withEntries)))
+			logObj := apiobj.Log{}
+			if err := json.NewDecoder(rec.Body).Decode(&logObj); err != nil {
+				t.Fatalf("invalid log %v", err)
+			}
+			output := logObj.Log
+			for _, entry := range logObj.Entries {
+				output += entry.Data
+			}
+			if output != strings.Repeat("<", 100000) {
+				t.Fatalf("unexpected log of %d bytes", len(output))
+			}
+		}
+	})
+
+	t.Run("rune between chunks", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		writer := &logWriter{rw: rec}
+		_ = writer.write([]manager.Entry{{Data: []byte("caf\xc3")}})
+		_ = writer.write([]manager.Entry{{Data: []byte("\xa9\n")}})
+		writer.close()
+		if rec.Body.String() != "{\"log\":\"café\\n\"}\n" {
+			t.Fatalf("the rune split between two chunks is not kept %q", rec.Body.String())
+		}
+	})
+}
+
+// write a certificate in a pem file inside dir
+func writeCertificate(t *testing.T, dir string, name string, cert *x509.Certificate) string {
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// create a CA for the client certificates
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// issue a client certificate with a new key and the subject and SANs of template
+func issueTestCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, template x509.Certificate) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestClientRegistry(t *testing.T) {
+	setupManager(t)
+	dir := t.TempDir()
+	cert1 := setupCert("certs/client_cert.pem", t)
+	cert2 := setupCert("certs/client_cert2.pem", t)
+	ca, caKey := newTestCA(t)
+	cert3 := issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	writeCertificate(t, dir, "client1.pem", cert1)
+	writeCertificate(t, dir, "client2.pem", cert2)
+	writeCertificate(t, dir, "ca.pem", ca)
+
+	path := filepath.Join(dir, "clients.json")
+	writeRegistry := func(registry string) {
+		if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRegistry(`{"clients": [
+		{"id": 1, "cert": "client1.pem", "admin": true},
+		{"id": 2, "cert": "client2.pem"},
+		{"id": 3, "ca": "ca.pem", "identity": "alice"}
+	]}`)
+	registryPath = path
+	if err := reloadClients(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client 3 is verified by the CA
+	request := func(endpoint string, cert *x509.Certificate) int {
+		req := httptest.NewRequest("POST", "/"+endpoint, nil)
+		req.TLS = new(tls.ConnectionState)
+		req.TLS.PeerCertificates = []*x509.Certificate{cert}
+		if cert == cert3 {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{cert3, ca}}
+		}
+		rec := httptest.NewRecorder()
+		switch endpoint {
+		case "list":
+			list(rec, req)
+		case "admin/reload":
+			reloadRegistry(rec, req)
+		}
+		return rec.Result().StatusCode
+	}
+	for _, cert := range []*x509.Certificate{cert1, cert2, cert3} {
+		if code := request("list", cert); code != http.StatusOK {
+			t.Fatalf("registered client %s refused %d", cert.Subject, code)
+		}
+	}
+	if code := request("admin/reload", cert2); code != http.StatusForbidden {
+		t.Fatalf("only the admins can reload the registry %d", code)
+	}
+
+	// the client 2 is removed
+	writeRegistry(`{"clients": [
+		{"id": 1, "cert": "client1.pem", "admin": true},
+		{"id": 3, "ca": "ca.pem", "identity": "bob"}
+	]}`)
+	if code := request("admin/reload", cert1); code != http.StatusOK {
+		t.Fatalf("cannot reload the registry %d", code)
+	}
+	if code := request("list", cert2); code != http.StatusForbidden {
+		t.Fatalf("removed client allowed %d", code)
+	}
+	if code := request("list", cert3); code != http.StatusForbidden {
+		t.Fatalf("client with another identity allowed %d", code)
+	}
+
+	// an invalid registry keeps the current clients
+	writeRegistry(`{"clients": [{"id": 1}]}`)
+	if code := request("admin/reload", cert1); code != http.StatusInternalServerError {
+		t.Fatalf("invalid registry loaded %d", code)
+	}
+	if code := request("list", cert1); code != http.StatusOK {
+		t.Fatalf("registered client refused %d", code)
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		clientsDir := filepath.Join(dir, "clients")
+		if err := os.Mkdir(clientsDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		entry := `{"id": 2, "cert": "` + filepath.Join(dir, "client2.pem") + `"}`
+		if err := ioutil.WriteFile(filepath.Join(clientsDir, "client2.json"), []byte(entry), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadClients(clientsDir); err != nil {
+			t.Fatal(err)
+		}
+		if code := request("list", cert2); code != http.StatusOK {
+			t.Fatalf("%s registered client refused %d", t.Name(), code)
+		}
+		if code := request("list", cert1); code != http.StatusForbidden {
+			t.Fatalf("%s removed client allowed %d", t.Name(), code)
+		}
+	})
+}
+
+func TestIdentity(t *testing.T) {
+	setupManager(t)
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t)
+	otherCA, otherKey := newTestCA(t)
+	clientCAPath = writeCertificate(t, dir, "ca.pem", ca)
+	defer func() { clientCAPath = "" }()
+
+	path := filepath.Join(dir, "clients.json")
+	registry := `{"clients": [
+		{"id": 1, "identity": "spiffe://example.org/alice"},
+		{"id": 2, "identity": "bob.example.org"},
+		{"id": 3, "identity": "carol"}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadClients(path); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := url.Parse("spiffe://example.org/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name   string
+		ca     *x509.Certificate
+		cert   *x509.Certificate
+		userid int
+	}{
+		{"uri san", ca, issueTestCertificate(t, ca, caKey, x509.Certificate{URIs: []*url.URL{alice}, Subject: pkix.Name{CommonName: "carol"}}), 1},
+		{"renewed uri san", ca, issueTestCertificate(t, ca, caKey, x509.Certificate{URIs: []*url.URL{alice}}), 1},
+		{"dns san", ca, issueTestCertificate(t, ca, caKey, x509.Certificate{DNSNames: []string{"bob.example.org"}}), 2},
+		{"common name", ca, issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: "carol"}}), 3},
+		{"unknown identity", ca, issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}}), -1},
+		{"untrusted ca", otherCA, issueTestCertificate(t, otherCA, otherKey, x509.Certificate{URIs: []*url.URL{alice}}), -1},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/list", nil)
+			req.TLS = new(tls.ConnectionState)
+			req.TLS.PeerCertificates = []*x509.Certificate{tc.cert}
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{tc.cert, tc.ca}}
+			userid, err := getUserId(req)
+			if tc.userid == -1 && err == nil {
+				t.Fatalf("%s should be refused", tc.name)
+			}
+			if tc.userid != -1 && userid != tc.userid {
+				t.Fatalf("%s unexpected user %d %v", tc.name, userid, err)
+			}
+		})
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	setupManager(t)
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t)
+	otherCA, otherKey := newTestCA(t)
+	clientCAPath = writeCertificate(t, dir, "ca.pem", ca)
+	revokedPath = filepath.Join(dir, "revoked.json")
+	defer func() {
+		clientCAPath = ""
+		revokedPath = ""
+		revoked_serials = nil
+		crl_serials = nil
+	}()
+
+	path := filepath.Join(dir, "clients.json")
+	registry := `{"clients": [
+		{"id": 1, "identity": "alice", "admin": true},
+		{"id": 2, "identity": "bob"}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadClients(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRevocations(revokedPath); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	bob := issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: "bob"}})
+	request := func(cert *x509.Certificate, handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		_ = json.NewEncoder(&buffer).Encode(body)
+		req := httptest.NewRequest("POST", "/", &buffer)
+		req.TLS = new(tls.ConnectionState)
+		req.TLS.PeerCertificates = []*x509.Certificate{cert}
+		req.TLS.VerifiedChains = [][]*x509.Certificate{{cert, ca}}
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+		return rw
+	}
+	expectRevoked := func(t *testing.T) {
+		rw := request(bob, list, nil)
+		if rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "certificate revoked") {
+			t.Fatalf("revoked client got %d %s", rw.Code, rw.Body.String())
+		}
+		err := verifyPeerCertificate(nil, [][]*x509.Certificate{{bob, ca}})
+		if err != errCertificateRevoked {
+			t.Fatalf("revoked certificate accepted by the handshake: %v", err)
+		}
+	}
+	expectAccepted := func(t *testing.T) {
+		if rw := request(bob, list, nil); rw.Code != http.StatusOK {
+			t.Fatalf("client refused %d %s", rw.Code, rw.Body.String())
+		}
+		if err := verifyPeerCertificate(nil, [][]*x509.Certificate{{bob, ca}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("serial", func(t *testing.T) {
+		expectAccepted(t)
+		if rw := request(bob, revoke, apiobj.Revocation{Serial: certificateSerial(alice)}); rw.Code != http.StatusForbidden {
+			t.Fatalf("not admin client could revoke %d", rw.Code)
+		}
+		if rw := request(alice, revoke, apiobj.Revocation{Serial: "not hex"}); rw.Code != http.StatusBadRequest {
+			t.Fatalf("invalid serial accepted %d", rw.Code)
+		}
+
+		// the serial may be written like openssl with colons and in lower case
+		serial := strings.ToLower(certificateSerial(bob))
+		if len(serial)%2 == 1 {
+			serial = "0" + serial
+		}
+		colons := []string{}
+		for i := 0; i < len(serial); i += 2 {
+			colons = append(colons, serial[i:i+2])
+		}
+		rw := request(alice, revoke, apiobj.Revocation{Serial: strings.Join(colons, ":"), Reason: "key leaked"})
+		if rw.Code != http.StatusOK {
+			t.Fatalf("revoke failed %d %s", rw.Code, rw.Body.String())
+		}
+		expectRevoked(t)
+
+		rw = request(alice, revocations, nil)
+		list := apiobj.Revocations{}
+		if err := json.NewDecoder(rw.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Revocations) != 1 || list.Revocations[0].Serial != certificateSerial(bob) || list.Revocations[0].Reason != "key leaked" {
+			t.Fatalf("unexpected revocations %+v", list.Revocations)
+		}
+
+		// the revocations survive a restart
+		revoked_serials = nil
+		if err := loadRevocations(revokedPath); err != nil {
+			t.Fatal(err)
+		}
+		expectRevoked(t)
+
+		if rw := request(alice, unrevoke, apiobj.Revocation{Serial: certificateSerial(bob)}); rw.Code != http.StatusOK {
+			t.Fatalf("unrevoke failed %d %s", rw.Code, rw.Body.String())
+		}
+		if rw := request(alice, unrevoke, apiobj.Revocation{Serial: certificateSerial(bob)}); rw.Code != http.StatusBadRequest {
+			t.Fatalf("unrevoked twice %d", rw.Code)
+		}
+		expectAccepted(t)
+	})
+
+	writeCRL := func(t *testing.T, issuer *x509.Certificate, key *ecdsa.PrivateKey) string {
+		revoked := []pkix.RevokedCertificate{{SerialNumber: bob.SerialNumber, RevocationTime: time.Now()}}
+		der, err := issuer.CreateCRL(rand.Reader, key, revoked, time.Now(), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, "crl.pem")
+		data := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	t.Run("crl", func(t *testing.T) {
+		if err := reloadCRL(writeCRL(t, otherCA, otherKey)); err == nil {
+			t.Fatal("CRL not signed by a client CA accepted")
+		}
+		expectAccepted(t)
+
+		if err := reloadCRL(writeCRL(t, ca, caKey)); err != nil {
+			t.Fatal(err)
+		}
+		expectRevoked(t)
+		if rw := request(alice, list, nil); rw.Code != http.StatusOK {
+			t.Fatalf("client not in the CRL refused %d", rw.Code)
+		}
+	})
+
+	// the CAs of the registry entries without --clientCA
+	t.Run("crl registry ca", func(t *testing.T) {
+		clientCAPath = ""
+		crl_serials = nil
+		registry := `{"clients": [
+			{"id": 1, "identity": "alice", "ca": "ca.pem", "admin": true},
+			{"id": 2, "identity": "bob", "ca": "ca.pem"}
+		]}`
+		if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadClients(path); err != nil {
+			t.Fatal(err)
+		}
+
+		// issued in the name of the client CA but signed by an unknown key
+		if err := reloadCRL(writeCRL(t, ca, otherKey)); err == nil {
+			t.Fatal("forged CRL accepted")
+		}
+		if err := reloadCRL(writeCRL(t, otherCA, otherKey)); err == nil {
+			t.Fatal("CRL not signed by a client CA accepted")
+		}
+		expectAccepted(t)
+
+		if err := reloadCRL(writeCRL(t, ca, caKey)); err != nil {
+			t.Fatal(err)
+		}
+		expectRevoked(t)
+	})
+}
+
+func TestEnrollment(t *testing.T) {
+	setupManager(t)
+	dir := t.TempDir()
+	ca, err := initCA(filepath.Join(dir, "ca"), "test ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := initCA(filepath.Join(dir, "ca"), "test ca", time.Hour); err == nil {
+		t.Fatal("existing CA overwritten")
+	}
+	caPath = filepath.Join(dir, "ca")
+	tokensPath = filepath.Join(dir, tokensName)
+	registryPath = filepath.Join(dir, "clients.json")
+	enrollValidity = 2 * time.Hour
+	defer func() {
+		caPath = ""
+		tokensPath = ""
+		registryPath = ""
+	}()
+	if err := ioutil.WriteFile(registryPath, []byte(`{"clients": [{"id": 4, "identity": "alice", "ca": "ca/ca_cert.pem"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadClients(registryPath); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := createToken(tokensPath, "bob", 0, roleAdmin, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "mallory"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	request := func(body apiobj.Enroll) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		_ = json.NewEncoder(&buffer).Encode(body)
+		rw := httptest.NewRecorder()
+		enroll(rw, httptest.NewRequest("POST", "/enroll", &buffer))
+		return rw
+	}
+
+	if rw := request(apiobj.Enroll{Token: "guess", CSR: csr}); rw.Code != http.StatusForbidden {
+		t.Fatalf("unknown token accepted %d", rw.Code)
+	}
+	// an invalid request does not use up the token
+	if rw := request(apiobj.Enroll{Token: token, CSR: "not a csr"}); rw.Code != http.StatusBadRequest {
+		t.Fatalf("invalid csr accepted %d", rw.Code)
+	}
+	rw := request(apiobj.Enroll{Token: token, CSR: csr})
+	if rw.Code != http.StatusOK {
+		t.Fatalf("enrollment failed %d %s", rw.Code, rw.Body.String())
+	}
+	enrollment := apiobj.Enrollment{}
+	if err := json.NewDecoder(rw.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if enrollment.ID != 5 {
+		t.Fatalf("expected the next free id 5, got %d", enrollment.ID)
+	}
+	if rw := request(apiobj.Enroll{Token: token, CSR: csr}); rw.Code != http.StatusForbidden {
+		t.Fatalf("token used twice %d", rw.Code)
+	}
+
+	block, _ := pem.Decode([]byte(enrollment.Cert))
+	if block == nil {
+		t.Fatal("no certificate in the enrollment")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the identity comes from the token, not from the request
+	if cert.Subject.CommonName != "bob" || !cert.PublicKey.(*ecdsa.PublicKey).Equal(&key.PublicKey) {
+		t.Fatalf("unexpected certificate %v", cert.Subject)
+	}
+	if cert.NotAfter.After(time.Now().Add(time.Hour + time.Minute)) {
+		t.Fatalf("the certificate outlives the CA: %v", cert.NotAfter)
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:     clientCAs(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/list", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: chains}
+	client, err := getClient(req)
+	if err != nil || client.id != 5 || client.role != roleAdmin {
+		t.Fatalf("enrolled client not registered %+v %v", client, err)
+	}
+
+	// the registry keeps the paths relative
+	entries := clientRegistry{}
+	data, err := ioutil.ReadFile(registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries.Clients) != 2 || entries.Clients[1].CA != filepath.Join("ca", caCertName) {
+		t.Fatalf("unexpected registry %+v", entries.Clients)
+	}
+	if ca.certPath != filepath.Join(dir, "ca", caCertName) {
+		t.Fatalf("unexpected CA path %s", ca.certPath)
+	}
+}
+
+func TestServerCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := initCA(filepath.Join(dir, "ca"), "test ca", 10000*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(validity time.Duration) *x509.Certificate {
+		template, err := serverTemplate([]string{"localhost"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := ca.issueKeyPair(dir, template, validity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	serverCertPath = filepath.Join(dir, "cert.pem")
+	serverKeyPath = filepath.Join(dir, "key.pem")
+	expiryWarning = 30 * 24 * time.Hour
+	defer func() {
+		server_certificate = nil
+		serverCertPath = ""
+		serverKeyPath = ""
+	}()
+
+	first := issue(100 * 24 * time.Hour)
+	if err := reloadServerCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	presented := func() *x509.Certificate {
+		keyPair, err := getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyPair.Leaf
+	}
+	if !presented().Equal(first) {
+		t.Fatal("the issued certificate is not presented")
+	}
+
+	rw := httptest.NewRecorder()
+	health(rw, httptest.NewRequest("GET", "/health", nil))
+	healthObj := apiobj.Health{}
+	if err := json.NewDecoder(rw.Body).Decode(&healthObj); err != nil {
+		t.Fatal(err)
+	}
+	if healthObj.Status != "ok" || healthObj.CertificateDaysLeft != 99 {
+		t.Fatalf("unexpected health %+v", healthObj)
+	}
+
+	// a rotated keypair is presented once its files change
+	second := issue(10 * 24 * time.Hour)
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{serverCertPath, serverKeyPath} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkServerCertificate()
+	if !presented().Equal(second) {
+		t.Fatal("the rotated certificate is not presented")
+	}
+
+	// an invalid keypair keeps the current one
+	if err := ioutil.WriteFile(serverKeyPath, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadServerCertificate(); err == nil {
+		t.Fatal("invalid keypair loaded")
+	}
+	if !presented().Equal(second) {
+		t.Fatal("the current certificate was replaced by an invalid one")
+	}
+
+	// expired less than a day ago
+	server_certificate = &tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(-time.Hour)}}
+	rw = httptest.NewRecorder()
+	health(rw, httptest.NewRequest("GET", "/health", nil))
+	healthObj = apiobj.Health{}
+	if err := json.NewDecoder(rw.Body).Decode(&healthObj); err != nil {
+		t.Fatal(err)
+	}
+	if healthObj.Status != "certificate expired" || healthObj.CertificateDaysLeft != -1 {
+		t.Fatalf("unexpected health of an expired certificate %+v", healthObj)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	setupManager(t)
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t)
+	registryPath = filepath.Join(dir, "clients.json")
+	defer func() { registryPath = "" }()
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), encodeCertificate(ca), 0600); err != nil {
+		t.Fatal(err)
+	}
+	registry := `{"clients": [
+		{"id": 1, "identity": "alice", "ca": "ca.pem", "role": "admin"},
+		{"id": 2, "identity": "bob", "ca": "ca.pem", "namespaces": ["team"]},
+		{"id": 3, "identity": "carol", "ca": "ca.pem", "role": "operator", "namespaces": ["team"]},
+		{"id": 4, "identity": "dave", "ca": "ca.pem", "role": "viewer", "namespaces": ["team"]},
+		{"id": 5, "identity": "erin", "ca": "ca.pem"},
+		{"id": 6, "identity": "frank", "ca": "ca.pem", "role": "viewer"}
+	]}`
+	if err := ioutil.WriteFile(registryPath, []byte(registry), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadClients(registryPath); err != nil {
+		t.Fatal(err)
+	}
+
+	certs := make(map[string]*x509.Certificate)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		certs[name] = issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: name}})
+	}
+	request := func(name string, handler http.HandlerFunc, target string, body interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		_ = json.NewEncoder(&buffer).Encode(body)
+		req := httptest.NewRequest("POST", target, &buffer)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{certs[name]},
+			VerifiedChains:   [][]*x509.Certificate{{certs[name], ca}},
+		}
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+		return rw
+	}
+	startSleep := func(name string, namespace string) string {
+		rw := request(name, start, "/start", apiobj.Command{Argv: []string{"sleep", "30"}, Namespace: namespace})
+		if rw.Code != http.StatusOK {
+			t.Fatalf("%s cannot start %d %s", name, rw.Code, rw.Body.String())
+		}
+		uuidObj := apiobj.UUID{}
+		if err := json.NewDecoder(rw.Body).Decode(&uuidObj); err != nil {
+			t.Fatal(err)
+		}
+		return uuidObj.UUID
+	}
+	teamJob := startSleep("carol", "team")
+	// personal jobs stay private even between members of a namespace
+	carolJob := startSleep("carol", "")
+	privateJob := startSleep("erin", "")
+	adminJob := startSleep("alice", "")
+	defer func() {
+		for _, id := range []string{teamJob, carolJob, privateJob, adminJob} {
+			if status, err := _manager.Lookup(id); err == nil {
+				_ = _manager.Stop(id, status.Owner, syscall.SIGKILL, time.Second)
+			}
+		}
+	}()
+
+	t.Run("start", func(t *testing.T) {
+		tt := []struct {
+			name      string
+			namespace string
+			code      int
+		}{
+			{"alice", "", http.StatusOK},
+			{"alice", "team", http.StatusOK},
+			{"bob", "", http.StatusOK},
+			{"bob", "team", http.StatusOK},
+			{"erin", "team", http.StatusForbidden},
+			{"bob", "unknown", http.StatusBadRequest},
+			{"dave", "", http.StatusForbidden},
+			{"dave", "team", http.StatusForbidden},
+			{"frank", "", http.StatusForbidden},
+		}
+		for _, tc := range tt {
+			rw := request(tc.name, start, "/start", apiobj.Command{Argv: []string{"true"}, Namespace: tc.namespace})
+			if rw.Code != tc.code {
+				t.Fatalf("%s start got %d %s", tc.name, rw.Code, rw.Body.String())
+			}
+		}
+	})
+
+	t.Run("status and log", func(t *testing.T) {
+		tt := []struct {
+			name string
+			id   string
+			code int
+		}{
+			{"alice", teamJob, http.StatusOK},
+			{"alice", privateJob, http.StatusOK},
+			{"bob", teamJob, http.StatusOK},
+			{"dave", teamJob, http.StatusOK},
+			{"bob", privateJob, http.StatusBadRequest},
+			{"erin", teamJob, http.StatusBadRequest},
+			{"frank", teamJob, http.StatusBadRequest},
+			{"carol", adminJob, http.StatusBadRequest},
+			{"carol", carolJob, http.StatusOK},
+			{"bob", carolJob, http.StatusBadRequest},
+			{"dave", carolJob, http.StatusBadRequest},
+		}
+		for _, tc := range tt {
+			for _, endpoint := range []struct {
+				path    string
+				handler http.HandlerFunc
+			}{{"/status", status}, {"/log", _log}} {
+				rw := request(tc.name, endpoint.handler, endpoint.path+"?id="+tc.id, nil)
+				if rw.Code != tc.code {
+					t.Fatalf("%s %s got %d %s", tc.name, endpoint.path, rw.Code, rw.Body.String())
+				}
+			}
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		tt := []struct {
+			name   string
+			target string
+			ids    []string
+		}{
+			{"alice", "/list", []string{teamJob, carolJob, privateJob, adminJob}},
+			{"alice", "/list?namespace=team", []string{teamJob}},
+			{"bob", "/list", []string{teamJob}},
+			{"carol", "/list", []string{teamJob, carolJob}},
+			{"carol", "/list?namespace=team", []string{teamJob}},
+			{"dave", "/list", []string{teamJob}},
+			{"erin", "/list", []string{privateJob}},
+			{"erin", "/list?namespace=team", []string{}},
+			{"frank", "/list", []string{}},
+		}
+		for _, tc := range tt {
+			rw := request(tc.name, list, tc.target, nil)
+			listObj := apiobj.List{}
+			if err := json.NewDecoder(rw.Body).Decode(&listObj); err != nil {
+				t.Fatal(err)
+			}
+			// the processes started by the start subtest are not running
+			running := []string{}
+			for _, status := range listObj.List {
+				if status.Command == "sleep" {
+					running = append(running, status.ID)
+				}
+			}
+			if strings.Join(running, ",") != strings.Join(tc.ids, ",") {
+				t.Fatalf("%s %s listed %v instead of %v", tc.name, tc.target, running, tc.ids)
+			}
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		tt := []struct {
+			name string
+			id   string
+			code int
+		}{
+			{"dave", teamJob, http.StatusForbidden},
+			{"erin", teamJob, http.StatusBadRequest},
+			{"bob", privateJob, http.StatusBadRequest},
+			{"bob", carolJob, http.StatusBadRequest},
+			{"bob", teamJob, http.StatusOK},
+			{"alice", privateJob, http.StatusOK},
+		}
+		for _, tc := range tt {
+			rw := request(tc.name, stop, "/stop", apiobj.Stop{UUID: tc.id, Signal: "SIGKILL"})
+			if rw.Code != tc.code {
+				t.Fatalf("%s stop got %d %s", tc.name, rw.Code, rw.Body.String())
+			}
+			if tc.code == http.StatusForbidden && !strings.Contains(rw.Body.String(), errNotPermitted.Error()) {
+				t.Fatalf("unclear error %s", rw.Body.String())
+			}
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		tt := []struct {
+			name string
+			code int
+		}{
+			{"alice", http.StatusOK},
+			{"bob", http.StatusForbidden},
+			{"dave", http.StatusForbidden},
+		}
+		for _, tc := range tt {
+			if rw := request(tc.name, reloadRegistry, "/admin/reload", nil); rw.Code != tc.code {
+				t.Fatalf("%s reload got %d", tc.name, rw.Code)
+			}
+			if rw := request(tc.name, revocations, "/admin/revocations", nil); rw.Code != tc.code {
+				t.Fatalf("%s revocations got %d", tc.name, rw.Code)
+			}
+		}
+	})
+
+	t.Run("invalid role", func(t *testing.T) {
+		for _, entry := range []string{
+			`{"id": 1, "identity": "alice", "ca": "ca.pem", "role": "root"}`,
+			`{"id": 1, "identity": "alice", "ca": "ca.pem", "role": "viewer", "admin": true}`,
+		} {
+			path := filepath.Join(dir, "invalid.json")
+			if err := ioutil.WriteFile(path, []byte(`{"clients": [`+entry+`]}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := reloadClients(path); err == nil {
+				t.Fatalf("invalid role accepted %s", entry)
+			}
+		}
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	setupManager(t)
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), encodeCertificate(ca), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "clients.json")
+	writeRegistry := func(t *testing.T, registry string) {
+		if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadClients(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	// the host network is refused by the policy before the process starts
+	startNetwork := func() *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		command := apiobj.Command{Argv: []string{"true"}, Isolation: &apiobj.Isolation{Enabled: true, Network: true}}
+		_ = json.NewEncoder(&buffer).Encode(command)
+		req := httptest.NewRequest("POST", "/start", &buffer)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{alice},
+			VerifiedChains:   [][]*x509.Certificate{{alice, ca}},
+		}
+		rw := httptest.NewRecorder()
+		start(rw, req)
+		return rw
+	}
+
+	writeRegistry(t, `{"clients": [{"id": 1, "identity": "alice", "ca": "ca.pem"}]}`)
+	if rw := startNetwork(); !strings.Contains(rw.Body.String(), "host network is not allowed") {
+		t.Fatalf("the default policy is not enforced %d %s", rw.Code, rw.Body.String())
+	}
+
+	writeRegistry(t, `{"clients": [{"id": 1, "identity": "alice", "ca": "ca.pem", "policy": {"allow_network": true}}]}`)
+	if rw := startNetwork(); strings.Contains(rw.Body.String(), "host network is not allowed") {
+		t.Fatalf("the policy of the client is not enforced %d %s", rw.Code, rw.Body.String())
+	}
+
+	// a policy removed from the registry falls back to the default one
+	writeRegistry(t, `{"clients": [{"id": 1, "identity": "alice", "ca": "ca.pem"}]}`)
+	if rw := startNetwork(); !strings.Contains(rw.Body.String(), "host network is not allowed") {
+		t.Fatalf("the removed policy is still enforced %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestCredential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the user requires root")
+	}
+	setupManager(t)
+	dir := t.TempDir()
+	ca, _ := newTestCA(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), encodeCertificate(ca), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "clients.json")
+	writeRegistry := func(t *testing.T, registry string) {
+		if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadClients(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the uid running the processes of the client
+	uid := func(t *testing.T) string {
+		id, err := _manager.Start(apiobj.Command{Argv: []string{"id", "-u"}}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			status, _ := _manager.Status(id, 1)
+			if status.EndTime != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the process is not terminated")
+			}
+		}
+		output := ""
+		err = _manager.Log(id, 1, manager.Filter{}, func(entries []manager.Entry) error {
+			for _, entry := range entries {
+				output += string(entry.Data)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(output)
+	}
+
+	writeRegistry(t, `{"clients": [{"id": 1, "identity": "alice", "ca": "ca.pem", "credential": {"uid": 65534, "gid": 65534}}]}`)
+	if str := uid(t); str != "65534" {
+		t.Fatalf("the credential of the client is not used %q", str)
+	}
+	// a credential removed from the registry is not kept
+	writeRegistry(t, `{"clients": [{"id": 1, "identity": "alice", "ca": "ca.pem"}]}`)
+	if str := uid(t); str != "0" {
+		t.Fatalf("the removed credential is still used %q", str)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	setupManager(t)
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), encodeCertificate(ca), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "clients.json")
+	writeRegistry := func(t *testing.T, registry string) error {
+		if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return reloadClients(path)
+	}
+	err := writeRegistry(t, `{"clients": [
+		{"id": 1, "identity": "alice", "ca": "ca.pem", "quota": {"max_running": 1}},
+		{"id": 2, "identity": "bob", "ca": "ca.pem"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := make(map[string]*x509.Certificate)
+	for _, name := range []string{"alice", "bob"} {
+		certs[name] = issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: name}})
+	}
+	request := func(name string, handler http.HandlerFunc, target string, body interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		_ = json.NewEncoder(&buffer).Encode(body)
+		req := httptest.NewRequest("POST", target, &buffer)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{certs[name]},
+			VerifiedChains:   [][]*x509.Certificate{{certs[name], ca}},
+		}
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+		return rw
+	}
+	sleep := apiobj.Command{Argv: []string{"sleep", "30"}}
+	defer func() {
+		for _, status := range _manager.ListMatching(nil) {
+			_ = _manager.Stop(status.ID, status.Owner, syscall.SIGKILL, time.Second)
+		}
+	}()
+
+	rw := request("alice", start, "/start", sleep)
+	started := apiobj.UUID{}
+	if err := json.NewDecoder(rw.Body).Decode(&started); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("alice cannot start %d %v", rw.Code, err)
+	}
+	rw = request("alice", start, "/start", sleep)
+	if rw.Code != http.StatusTooManyRequests || !strings.Contains(rw.Body.String(), "quota exceeded") {
+		t.Fatalf("the quota is not enforced %d %s", rw.Code, rw.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		if rw := request("bob", start, "/start", sleep); rw.Code != http.StatusOK {
+			t.Fatalf("bob cannot start %d %s", rw.Code, rw.Body.String())
+		}
+	}
+
+	rw = request("alice", quota, "/quota", nil)
+	usage := apiobj.QuotaUsage{}
+	if err := json.NewDecoder(rw.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusOK || usage.Quota.MaxRunning != 1 || usage.Running != 1 || usage.Processes != 1 {
+		t.Fatalf("unexpected usage %d %+v", rw.Code, usage)
+	}
+
+	t.Run("remove", func(t *testing.T) {
+		body := apiobj.UUID{UUID: started.UUID}
+		if rw := request("alice", remove, "/remove", body); rw.Code != http.StatusBadRequest {
+			t.Fatalf("a running process is removed %d %s", rw.Code, rw.Body.String())
+		}
+		if err := _manager.Stop(started.UUID, 1, syscall.SIGKILL, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			status, _ := _manager.Status(started.UUID, 1)
+			if status.EndTime != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the process is not terminated")
+			}
+		}
+		if rw := request("bob", remove, "/remove", body); rw.Code != http.StatusBadRequest {
+			t.Fatalf("bob removes the process of alice %d %s", rw.Code, rw.Body.String())
+		}
+		if rw := request("alice", remove, "/remove", body); rw.Code != http.StatusOK {
+			t.Fatalf("alice cannot remove %d %s", rw.Code, rw.Body.String())
+		}
+		rw := request("alice", quota, "/quota", nil)
+		usage := apiobj.QuotaUsage{}
+		if err := json.NewDecoder(rw.Body).Decode(&usage); err != nil {
+			t.Fatal(err)
+		}
+		if usage.Processes != 0 {
+			t.Fatalf("the removed process is still counted %+v", usage)
+		}
+	})
+
+	t.Run("invalid quota", func(t *testing.T) {
+		err := writeRegistry(t, `{"clients": [{"id": 1, "identity": "alice", "ca": "ca.pem", "quota": {"max_processes": -1}}]}`)
+		if err == nil {
+			t.Fatal("negative quota accepted")
+		}
+	})
+
+	t.Run("removed quota", func(t *testing.T) {
+		err := writeRegistry(t, `{"clients": [{"id": 1, "identity": "alice", "ca": "ca.pem"}]}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rw := request("alice", start, "/start", sleep); rw.Code != http.StatusOK {
+			t.Fatalf("the default quota is not restored %d %s", rw.Code, rw.Body.String())
+		}
+	})
+}
+
+func TestSchedules(t *testing.T) {
+	setupManager(t)
+	defer _manager.Shutdown(time.Second)
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), encodeCertificate(ca), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "clients.json")
+	registry := `{"clients": [
+		{"id": 1, "identity": "alice", "ca": "ca.pem", "namespaces": ["team"]},
+		{"id": 2, "identity": "bob", "ca": "ca.pem"},
+		{"id": 3, "identity": "dave", "ca": "ca.pem", "role": "viewer", "namespaces": ["team"]}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadClients(path); err != nil {
+		t.Fatal(err)
+	}
+
+	certs := make(map[string]*x509.Certificate)
+	for _, name := range []string{"alice", "bob", "dave"} {
+		certs[name] = issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: name}})
+	}
+	request := func(name string, handler http.HandlerFunc, target string, body interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		_ = json.NewEncoder(&buffer).Encode(body)
+		req := httptest.NewRequest("POST", target, &buffer)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{certs[name]},
+			VerifiedChains:   [][]*x509.Certificate{{certs[name], ca}},
+		}
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+		return rw
+	}
+	listSchedules := func(name string, target string) []apiobj.Schedule {
+		rw := request(name, schedules, target, nil)
+		schedulesObj := apiobj.Schedules{}
+		if err := json.NewDecoder(rw.Body).Decode(&schedulesObj); err != nil || rw.Code != http.StatusOK {
+			t.Fatalf("%s cannot list the schedules %d %v", name, rw.Code, err)
+		}
+		return schedulesObj.Schedules
+	}
+	daily := func(namespace string) apiobj.Schedule {
+		return apiobj.Schedule{Cron: "@daily", Command: apiobj.Command{Argv: []string{"true"}, Namespace: namespace}}
+	}
+
+	rw := request("alice", createSchedule, "/schedules/create", daily(""))
+	personal := apiobj.Schedule{}
+	if err := json.NewDecoder(rw.Body).Decode(&personal); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("alice cannot create a schedule %d %v", rw.Code, err)
+	}
+	if personal.ID == "" || personal.Owner != 1 || personal.NextRun == nil {
+		t.Fatalf("unexpected schedule %+v", personal)
+	}
+	rw = request("alice", createSchedule, "/schedules/create", daily("team"))
+	shared := apiobj.Schedule{}
+	if err := json.NewDecoder(rw.Body).Decode(&shared); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("alice cannot create a shared schedule %d %v", rw.Code, err)
+	}
+
+	if rw := request("alice", createSchedule, "/schedules/create", apiobj.Schedule{Cron: "@sometimes", Command: apiobj.Command{Argv: []string{"true"}}}); rw.Code != http.StatusBadRequest {
+		t.Fatalf("invalid schedule accepted %d %s", rw.Code, rw.Body.String())
+	}
+	if rw := request("bob", createSchedule, "/schedules/create", daily("team")); rw.Code != http.StatusForbidden {
+		t.Fatalf("bob created a schedule in a namespace without being a member %d", rw.Code)
+	}
+	if rw := request("dave", createSchedule, "/schedules/create", daily("team")); rw.Code != http.StatusForbidden {
+		t.Fatalf("a viewer created a schedule %d", rw.Code)
+	}
+
+	if list := listSchedules("alice", "/schedules"); len(list) != 2 {
+		t.Fatalf("alice does not see the schedules created %+v", list)
+	}
+	if list := listSchedules("bob", "/schedules"); len(list) != 0 {
+		t.Fatalf("bob sees the schedules of alice %+v", list)
+	}
+	if list := listSchedules("dave", "/schedules"); len(list) != 1 || list[0].ID != shared.ID {
+		t.Fatalf("dave does not see only the shared schedule %+v", list)
+	}
+	if list := listSchedules("dave", "/schedules?id="+shared.ID); len(list) != 1 || list[0].ID != shared.ID {
+		t.Fatalf("dave cannot show the shared schedule %+v", list)
+	}
+	if rw := request("dave", schedules, "/schedules?id="+personal.ID, nil); rw.Code != http.StatusBadRequest {
+		t.Fatalf("dave can show a personal schedule of alice %d", rw.Code)
+	}
+
+	if rw := request("bob", pauseSchedule, "/schedules/pause", apiobj.UUID{UUID: personal.ID}); rw.Code != http.StatusBadRequest {
+		t.Fatalf("bob paused the schedule of alice %d", rw.Code)
+	}
+	if rw := request("dave", pauseSchedule, "/schedules/pause", apiobj.UUID{UUID: shared.ID}); rw.Code != http.StatusForbidden {
+		t.Fatalf("a viewer paused a schedule %d", rw.Code)
+	}
+	if rw := request("alice", pauseSchedule, "/schedules/pause", apiobj.UUID{UUID: shared.ID}); rw.Code != http.StatusOK {
+		t.Fatalf("alice cannot pause the schedule %d %s", rw.Code, rw.Body.String())
+	}
+	if list := listSchedules("dave", "/schedules?id="+shared.ID); !list[0].Paused {
+		t.Fatalf("the schedule is not paused %+v", list)
+	}
+	if rw := request("alice", resumeSchedule, "/schedules/resume", apiobj.UUID{UUID: shared.ID}); rw.Code != http.StatusOK {
+		t.Fatalf("alice cannot resume the schedule %d %s", rw.Code, rw.Body.String())
+	}
+	if rw := request("alice", deleteSchedule, "/schedules/delete", apiobj.UUID{UUID: personal.ID}); rw.Code != http.StatusOK {
+		t.Fatalf("alice cannot delete the schedule %d %s", rw.Code, rw.Body.String())
+	}
+	if list := listSchedules("alice", "/schedules"); len(list) != 1 || list[0].ID != shared.ID || list[0].Paused {
+		t.Fatalf("unexpected schedules %+v", list)
+	}
+}
+
+func TestWorkflows(t *testing.T) {
+	setupManager(t)
+	defer _manager.Shutdown(time.Second)
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), encodeCertificate(ca), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "clients.json")
+	registry := `{"clients": [
+		{"id": 1, "identity": "alice", "ca": "ca.pem", "namespaces": ["team"]},
+		{"id": 2, "identity": "bob", "ca": "ca.pem"},
+		{"id": 3, "identity": "dave", "ca": "ca.pem", "role": "viewer", "namespaces": ["team"]}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(registry), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadClients(path); err != nil {
+		t.Fatal(err)
+	}
+
+	certs := make(map[string]*x509.Certificate)
+	for _, name := range []string{"alice", "bob", "dave"} {
+		certs[name] = issueTestCertificate(t, ca, caKey, x509.Certificate{Subject: pkix.Name{CommonName: name}})
+	}
+	request := func(name string, handler http.HandlerFunc, target string, body interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		_ = json.NewEncoder(&buffer).Encode(body)
+		req := httptest.NewRequest("POST", target, &buffer)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{certs[name]},
+			VerifiedChains:   [][]*x509.Certificate{{certs[name], ca}},
+		}
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+		return rw
+	}
+	listWorkflows := func(name string, target string) []apiobj.Workflow {
+		rw := request(name, workflows, target, nil)
+		workflowsObj := apiobj.Workflows{}
+		if err := json.NewDecoder(rw.Body).Decode(&workflowsObj); err != nil || rw.Code != http.StatusOK {
+			t.Fatalf("%s cannot list the workflows %d %v", name, rw.Code, err)
+		}
+		return workflowsObj.Workflows
+	}
+	pipeline := func(namespace string) apiobj.Workflow {
+		return apiobj.Workflow{Namespace: namespace, Steps: []apiobj.WorkflowStep{
+			{Name: "build", Command: apiobj.Command{Argv: []string{"sleep", "30"}}},
+			{Name: "test", Command: apiobj.Command{Argv: []string{"true"}}, DependsOn: []string{"build"}},
+		}}
+	}
+
+	rw := request("alice", createWorkflow, "/workflows/create", pipeline("team"))
+	shared := apiobj.Workflow{}
+	if err := json.NewDecoder(rw.Body).Decode(&shared); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("alice cannot create a workflow %d %v", rw.Code, err)
+	}
+	if shared.ID == "" || shared.Owner != 1 || shared.State != apiobj.WorkflowRunning || shared.Steps[0].ProcessID == "" {
+		t.Fatalf("unexpected workflow %+v", shared)
+	}
+	if status, err := _manager.Lookup(shared.Steps[0].ProcessID); err != nil || status.Namespace != "team" {
+		t.Fatalf("the step does not run in the namespace of the workflow %+v %v", status, err)
+	}
+	rw = request("alice", createWorkflow, "/workflows/create", pipeline(""))
+	personal := apiobj.Workflow{}
+	if err := json.NewDecoder(rw.Body).Decode(&personal); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("alice cannot create a personal workflow %d %v", rw.Code, err)
+	}
+
+	invalid := pipeline("")
+	invalid.Steps[0].DependsOn = []string{"test"}
+	if rw := request("alice", createWorkflow, "/workflows/create", invalid); rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "depends on itself") {
+		t.Fatalf("a cycle accepted %d %s", rw.Code, rw.Body.String())
+	}
+	if rw := request("bob", createWorkflow, "/workflows/create", pipeline("team")); rw.Code != http.StatusForbidden {
+		t.Fatalf("bob created a workflow in a namespace without being a member %d", rw.Code)
+	}
+	if rw := request("dave", createWorkflow, "/workflows/create", pipeline("team")); rw.Code != http.StatusForbidden {
+		t.Fatalf("a viewer created a workflow %d", rw.Code)
+	}
+
+	if list := listWorkflows("alice", "/workflows"); len(list) != 2 {
+		t.Fatalf("alice does not see the workflows created %+v", list)
+	}
+	if list := listWorkflows("bob", "/workflows"); len(list) != 0 {
+		t.Fatalf("bob sees the workflows of alice %+v", list)
+	}
+	if list := listWorkflows("dave", "/workflows?id="+shared.ID); len(list) != 1 || list[0].ID != shared.ID {
+		t.Fatalf("dave cannot show the shared workflow %+v", list)
+	}
+	if rw := request("dave", workflows, "/workflows?id="+personal.ID, nil); rw.Code != http.StatusBadRequest {
+		t.Fatalf("dave can show a personal workflow of alice %d", rw.Code)
+	}
+
+	if rw := request("bob", cancelWorkflow, "/workflows/cancel", apiobj.UUID{UUID: personal.ID}); rw.Code != http.StatusBadRequest {
+		t.Fatalf("bob cancelled the workflow of alice %d", rw.Code)
+	}
+	if rw := request("dave", cancelWorkflow, "/workflows/cancel", apiobj.UUID{UUID: shared.ID}); rw.Code != http.StatusForbidden {
+		t.Fatalf("a viewer cancelled a workflow %d", rw.Code)
+	}
+	for _, workflow := range []apiobj.Workflow{shared, personal} {
+		if rw := request("alice", cancelWorkflow, "/workflows/cancel", apiobj.UUID{UUID: workflow.ID}); rw.Code != http.StatusOK {
+			t.Fatalf("alice cannot cancel the workflow %d %s", rw.Code, rw.Body.String())
+		}
+	}
+}
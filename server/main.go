@@ -1,55 +1,129 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/anterpin/interview/server/apiobj"
 	"github.com/anterpin/interview/server/manager"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+var (
+	PORT = kingpin.Flag("port", "port").Envar("PORT").Default("8443").Uint16()
+
+	dataDir   = kingpin.Flag("dataDir", "directory storing the output and the snapshots of the processes, the schedules and the workflows").Envar("DATA_DIR").Default("data").String()
+	maxOutput = kingpin.Flag("maxOutput", "maximum bytes stored for the output of each process, entry headers included, 0 for no limit").Envar("MAX_OUTPUT").Default("67108864").Int64()
+
+	stopTimeout = kingpin.Flag("stopTimeout", "default grace period before a stopped process is killed").Envar("STOP_TIMEOUT").Default("10s").Duration()
+
+	cgroupRoot     = kingpin.Flag("cgroupRoot", "cgroup v2 directory holding the processes with resource limits, disabled if empty").Envar("CGROUP_ROOT").String()
+	rlimitFallback = kingpin.Flag("rlimitFallback", "enforce the resource limits with rlimits when cgroups are not available").Envar("RLIMIT_FALLBACK").Bool()
+
+	requireIsolation = kingpin.Flag("requireIsolation", "run every process in its own pid, mount, uts and network namespaces").Envar("REQUIRE_ISOLATION").Bool()
+	allowNetwork     = kingpin.Flag("allowNetwork", "let isolated processes keep the host network").Envar("ALLOW_NETWORK").Bool()
+
+	clientCA = kingpin.Flag("clientCA", "CAs issuing the client certificates identified by subject or SAN").Envar("CLIENT_CA").String()
+	clients  = kingpin.Flag("clients", "client registry file, or directory with a json file per client, reloaded on SIGHUP").Envar("CLIENTS").Default("clients.json").String()
+
+	crl     = kingpin.Flag("crl", "CRL file refusing the revoked client certificates, reloaded on SIGHUP").Envar("CRL").String()
+	revoked = kingpin.Flag("revoked", "file keeping the client certificates revoked through /admin/revoke, in dataDir if empty").Envar("REVOKED").String()
+
+	caDir      = kingpin.Flag("caDir", "directory of the CA created by ca init").Envar("CA_DIR").Default("certs/ca").String()
+	enrollTTL  = kingpin.Flag("enrollValidity", "validity of the client certificates issued by /enroll").Envar("ENROLL_VALIDITY").Default("8760h").Duration()
+	serverCert = kingpin.Flag("cert", "server certificate, reloaded on SIGHUP or when it changes").Envar("SERVER_CERT").Default("certs/cert.pem").String()
+	serverKey  = kingpin.Flag("key", "server private key, reloaded with the certificate").Envar("SERVER_KEY").Default("certs/key.pem").String()
+	certPoll   = kingpin.Flag("certPoll", "interval checking if the server keypair files changed").Envar("CERT_POLL").Default("1m").Duration()
+	certWarn   = kingpin.Flag("certWarn", "log a warning when the server certificate expires within this time").Envar("CERT_WARN").Default("720h").Duration()
+
+	maxConcurrent        = kingpin.Flag("maxConcurrent", "processes running at the same time, the others wait in a queue, 0 for no limit").Envar("MAX_CONCURRENT").Int()
+	maxConcurrentPerUser = kingpin.Flag("maxConcurrentPerUser", "processes of each client running at the same time, the others wait in a queue, 0 for no limit").Envar("MAX_CONCURRENT_PER_USER").Int()
+
+	quotaRunning   = kingpin.Flag("quotaRunning", "default maximum processes running at the same time for each client, 0 for no limit").Envar("QUOTA_RUNNING").Int()
+	quotaProcesses = kingpin.Flag("quotaProcesses", "default maximum processes kept for each client, 0 for no limit").Envar("QUOTA_PROCESSES").Int()
+	quotaOutput    = kingpin.Flag("quotaOutput", "default maximum output bytes stored for all the processes of each client, 0 for no limit").Envar("QUOTA_OUTPUT").Int64()
+	quotaCPU       = kingpin.Flag("quotaCPU", "default cpu seconds each client can use in 24 hours, 0 for no limit").Envar("QUOTA_CPU").Float64()
+
+	runAs     = kingpin.Flag("runAs", "unix user running the processes of a client as CLIENTID=UID:GID[:GROUP,...], repeatable").Strings()
+	allowRoot = kingpin.Flag("allowRoot", "let the processes run as root when the client has no unix user").Envar("ALLOW_ROOT").Bool()
+
+	serveCommand = kingpin.Command("serve", "run the server").Default()
+
+	caCommand = kingpin.Command("ca", "manage the CA issuing the server and client certificates")
+
+	caInit         = caCommand.Command("init", "create the CA in caDir")
+	caInitName     = caInit.Flag("name", "common name of the CA").Default("job server CA").String()
+	caInitValidity = caInit.Flag("validity", "validity of the CA certificate").Default("87600h").Duration()
+
+	caIssue = caCommand.Command("issue", "issue a certificate signed by the CA")
+
+	caIssueServer         = caIssue.Command("server", "issue the server certificate")
+	caIssueServerDNS      = caIssueServer.Flag("dns", "DNS name of the server, repeatable").Default("localhost").Strings()
+	caIssueServerIP       = caIssueServer.Flag("ip", "IP address of the server, repeatable").IPList()
+	caIssueServerOut      = caIssueServer.Flag("out", "directory receiving cert.pem and key.pem").Default("certs").String()
+	caIssueServerValidity = caIssueServer.Flag("validity", "validity of the certificate").Default("8760h").Duration()
+
+	caIssueClient           = caIssue.Command("client", "issue a client certificate and register the client")
+	caIssueClientName       = caIssueClient.Arg("name", "common name identifying the client").Required().String()
+	caIssueClientID         = caIssueClient.Flag("id", "user id of the client, the next free one if not set").Int()
+	caIssueClientRole       = caIssueClient.Flag("role", "role of the client").Default(roleOperator).Enum(roleAdmin, roleOperator, roleViewer)
+	caIssueClientNamespaces = caIssueClient.Flag("namespace", "namespace the client is a member of, repeatable").Strings()
+	caIssueClientURI        = caIssueClient.Flag("uri", "URI SAN identifying the client instead of the name like spiffe://example.org/alice").String()
+	caIssueClientOut        = caIssueClient.Flag("out", "directory receiving cert.pem and key.pem").Required().String()
+	caIssueClientValidity   = caIssueClient.Flag("validity", "validity of the certificate").Default("8760h").Duration()
+
+	caToken     = caCommand.Command("token", "create a one-time token enrolling a client")
+	caTokenName = caToken.Arg("name", "common name identifying the client").Required().String()
+	caTokenID   = caToken.Flag("id", "user id of the client, the next free one if not set").Int()
+	caTokenRole = caToken.Flag("role", "role of the client").Default(roleOperator).Enum(roleAdmin, roleOperator, roleViewer)
+	caTokenTTL  = caToken.Flag("ttl", "time before the token expires").Default("24h").Duration()
+)
+
+// time given to the open connections to be closed on termination
+const shutdownTimeout = 5 * time.Second
+
 // process scheduling manager
-var _manager manager.Manager
+var _manager *manager.Manager
 
 type Client struct {
-	id int
+	id   int
+	name string
+	// admin, operator or viewer
+	role string
+	// unix user running the processes, the server one if nil
+	credential *manager.Credential
+	metadata   map[string]string
 }
 
-// client table that associates a request certificate to the calling client
-var user_table map[[16]byte]Client
+// client table that associates a pinned request certificate to the calling client
+var user_table map[[sha256.Size]byte]Client
 
-// return the certificate fingerprint using md5
-// ? in the future can be implemented setting a certicate field to an encrypted client id
-// ? so the server can decrypt on request to extract the client id
-// ? it's similar to how jwt cookies works
-func useCertificateAsKey(cert *x509.Certificate) [16]byte {
-	return md5.Sum(cert.Raw)
+// return the certificate fingerprint using sha256
+// it changes on every renewal, the clients are better identified
+// by the identity of a certificate issued by a trusted CA
+func useCertificateAsKey(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.Raw)
 }
 
 // retrieve the user id from a request
 // extract the certificate from the request
-// hash it using the function useCertificateAsKey
-// get the client id through the user_table
+// and get the client through the user_table or the identity_table
 func getUserId(r *http.Request) (int, error) {
-	if r.TLS == nil {
-		return -1, errors.New("the request was made without a TLS connection")
-	}
-	if len(r.TLS.PeerCertificates) == 0 {
-		return -1, errors.New("there is no peer certifcate")
-	}
-	id := useCertificateAsKey(r.TLS.PeerCertificates[0])
-
-	client, exists := user_table[id]
-	if !exists {
-		return -1, errors.New("unknown user")
+	client, err := getClient(r)
+	if err != nil {
+		return -1, err
 	}
 	return client.id, nil
 }
@@ -58,26 +132,19 @@ func getUserId(r *http.Request) (int, error) {
 // create and entry in the user_table with the certificate and the userid
 // call the method AddUser on the global object manager
 func setupCertAndManager(file string, userid int) *x509.Certificate {
+	tables_mutex.Lock()
+	defer tables_mutex.Unlock()
 	// Setup global variable user_table
-	// it not suppose for concurrent access
 	if user_table == nil {
-		user_table = make(map[[16]byte]Client)
+		user_table = make(map[[sha256.Size]byte]Client)
 	}
 	// Setup client cert
-	caCertPem, err := ioutil.ReadFile(file)
-	if err != nil {
-		log.Fatal(err)
-	}
-	block, _ := pem.Decode(caCertPem)
-	if block == nil {
-		log.Fatal("Failing parsing pem block")
-	}
-	cert, err := x509.ParseCertificate(block.Bytes)
+	cert, err := readCertificate(file)
 	if err != nil {
 		log.Fatal(err)
 	}
 	// Setting the user list
-	client := Client{id: userid}
+	client := Client{id: userid, role: roleOperator}
 	// Setup user table
 	user_table[useCertificateAsKey(cert)] = client
 
@@ -86,43 +153,175 @@ func setupCertAndManager(file string, userid int) *x509.Certificate {
 	return cert
 }
 
+// parse the unix users of the clients given as CLIENTID=UID:GID[:GROUP,...]
+func parseCredentials(values []string) (map[int]manager.Credential, error) {
+	credentials := make(map[int]manager.Credential)
+	for _, value := range values {
+		invalid := fmt.Errorf("invalid unix user %q, expected CLIENTID=UID:GID[:GROUP,...]", value)
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, invalid
+		}
+		userid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, invalid
+		}
+		ids := strings.Split(parts[1], ":")
+		if len(ids) < 2 || len(ids) > 3 {
+			return nil, invalid
+		}
+		uid, err := strconv.ParseUint(ids[0], 10, 32)
+		if err != nil {
+			return nil, invalid
+		}
+		gid, err := strconv.ParseUint(ids[1], 10, 32)
+		if err != nil {
+			return nil, invalid
+		}
+		credential := manager.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+		if len(ids) == 3 && ids[2] != "" {
+			for _, group := range strings.Split(ids[2], ",") {
+				gid, err := strconv.ParseUint(group, 10, 32)
+				if err != nil {
+					return nil, invalid
+				}
+				credential.Groups = append(credential.Groups, uint32(gid))
+			}
+		}
+		credentials[userid] = credential
+	}
+	return credentials, nil
+}
+
+// Run as job init if started by the manager
+// Parse the command line
+// Manage the CA instead of running the server
 // Init global manager
 // Setup default server multiplexer
-// Setup port
-// Setup certificate pool to authenticate clients
+// Load the client registry to authenticate clients
+// Load the revoked client certificates
+// Enroll the clients with the CA if there is one
 // Setup TLS config
 // Setup server
+// Stop every process on termination
+// Reload the server keypair when its files change
+// Reload the client registry, the CRL and the server keypair on SIGHUP
 // Run the server
 func main() {
+	// Run as job init if started by the manager
+	manager.Init()
+
+	// Parse the command line
+	command := kingpin.Parse()
+
+	// Manage the CA instead of running the server
+	if command != serveCommand.FullCommand() {
+		if err := runCA(command); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Init global manager
-	_manager = manager.NewManager()
+	var err error
+	_manager, err = manager.NewManager(manager.Config{
+		DataDir:              *dataDir,
+		MaxOutputSize:        *maxOutput,
+		StopTimeout:          *stopTimeout,
+		CgroupRoot:           *cgroupRoot,
+		RlimitFallback:       *rlimitFallback,
+		AllowRoot:            *allowRoot,
+		MaxConcurrent:        *maxConcurrent,
+		MaxConcurrentPerUser: *maxConcurrentPerUser,
+		DefaultPolicy: manager.Policy{
+			RequireIsolation: *requireIsolation,
+			AllowNetwork:     *allowNetwork,
+		},
+		DefaultQuota: apiobj.Quota{
+			MaxRunning:       *quotaRunning,
+			MaxProcesses:     *quotaProcesses,
+			MaxOutputBytes:   *quotaOutput,
+			CPUSecondsPerDay: *quotaCPU,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// TODO: use a server multiplexer library https://github.com/gorilla/mux
 	// TODO: to limit an endpoint to a specific HTTP method
 	// Setup default server multiplexer
 	mux := http.DefaultServeMux
-	mux.HandleFunc("/start", start)   // POST
-	mux.HandleFunc("/stop", stop)     // POST
-	mux.HandleFunc("/list", list)     // GET
-	mux.HandleFunc("/status", status) // GET
-	mux.HandleFunc("/log", _log)      // GET
+	mux.HandleFunc("/start", start)                     // POST
+	mux.HandleFunc("/stop", stop)                       // POST
+	mux.HandleFunc("/remove", remove)                   // POST
+	mux.HandleFunc("/list", list)                       // GET
+	mux.HandleFunc("/status", status)                   // GET
+	mux.HandleFunc("/log", _log)                        // GET
+	mux.HandleFunc("/admin/reload", reloadRegistry)     // POST
+	mux.HandleFunc("/admin/revoke", revoke)             // POST
+	mux.HandleFunc("/admin/unrevoke", unrevoke)         // POST
+	mux.HandleFunc("/admin/revocations", revocations)   // GET
+	mux.HandleFunc("/enroll", enroll)                   // POST
+	mux.HandleFunc("/health", health)                   // GET
+	mux.HandleFunc("/quota", quota)                     // GET
+	mux.HandleFunc("/schedules", schedules)             // GET
+	mux.HandleFunc("/schedules/create", createSchedule) // POST
+	mux.HandleFunc("/schedules/delete", deleteSchedule) // POST
+	mux.HandleFunc("/schedules/pause", pauseSchedule)   // POST
+	mux.HandleFunc("/schedules/resume", resumeSchedule) // POST
+	mux.HandleFunc("/workflows", workflows)             // GET
+	mux.HandleFunc("/workflows/create", createWorkflow) // POST
+	mux.HandleFunc("/workflows/cancel", cancelWorkflow) // POST
 
-	// Setup port
-	PORT, err := strconv.ParseUint(os.Getenv("PORT"), 10, 64)
-	if err != nil || PORT > 65535 {
-		//default port
-		PORT = 8443
+	// Load the client registry to authenticate clients
+	flagCredentials, err = parseCredentials(*runAs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registryPath = *clients
+	clientCAPath = *clientCA
+	err = reloadClients(registryPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the schedules run with the credentials and the quotas of the registry
+	_manager.StartSchedules()
+
+	// Load the revoked client certificates
+	revokedPath = *revoked
+	if revokedPath == "" {
+		revokedPath = filepath.Join(*dataDir, "revoked.json")
+	}
+	err = loadRevocations(revokedPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	crlPath = *crl
+	err = reloadCRL(crlPath)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Setup certificate pool to authenticate clients
-	caCertPool := x509.NewCertPool()
-	caCertPool.AddCert(setupCertAndManager("certs/client_cert.pem", 1))
-	caCertPool.AddCert(setupCertAndManager("certs/client_cert2.pem", 2))
+	// Enroll the clients with the CA if there is one
+	tokensPath = filepath.Join(*dataDir, tokensName)
+	caPath = *caDir
+	enrollValidity = *enrollTTL
 
 	// Setup TLS config
+	serverCertPath = *serverCert
+	serverKeyPath = *serverKey
+	expiryWarning = *certWarn
+	err = reloadServerCertificate()
+	if err != nil {
+		log.Fatal(err)
+	}
 	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
+		// the keypair changes when it is rotated
+		GetCertificate: getCertificate,
+		// a client without certificate can only call /enroll
+		// every other handler refuses it in getClient
+		ClientAuth: tls.VerifyClientCertIfGiven,
 		CipherSuites: []uint16{
 			tls.TLS_AES_256_GCM_SHA384,
 		}, // the cipher suites are not editable in go 1.16 using TLS 1.3
@@ -130,16 +329,131 @@ func main() {
 		MaxVersion:               tls.VersionTLS13,
 		PreferServerCipherSuites: true,
 	}
+	// the revoked certificates are refused during the handshake
+	tlsConfig.VerifyPeerCertificate = verifyPeerCertificate
+	// the client CAs change when the client registry is reloaded
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config := tlsConfig.Clone()
+		config.ClientCAs = clientCAs()
+		return config, nil
+	}
 
 	// Setup server
 	server := &http.Server{
-		Addr:      fmt.Sprintf(":%d", PORT),
+		Addr:      fmt.Sprintf(":%d", *PORT),
 		TLSConfig: tlsConfig,
 		Handler:   mux,
 	}
 	server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 
+	// Stop every process on termination
+	shutdown := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Println("Stopping every process")
+		_manager.Shutdown(*stopTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		close(shutdown)
+	}()
+
+	// Reload the server keypair when its files change
+	go watchServerCertificate(*certPoll)
+
+	// Reload the client registry, the CRL and the server keypair on SIGHUP
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		for range signals {
+			if err := reloadClients(registryPath); err != nil {
+				log.Printf("Cannot reload the client registry: %v", err)
+			}
+			if err := reloadCRL(crlPath); err != nil {
+				log.Printf("Cannot reload the CRL: %v", err)
+			}
+			if err := reloadServerCertificate(); err != nil {
+				log.Printf("Cannot reload the server certificate: %v", err)
+			}
+		}
+	}()
+
 	// Run the server
 	fmt.Println("Start Server")
-	log.Fatal(server.ListenAndServeTLS("certs/cert.pem", "certs/key.pem"))
+	// the keypair is given by GetCertificate
+	err = server.ListenAndServeTLS("", "")
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
+}
+
+// run the ca subcommand
+func runCA(command string) error {
+	switch command {
+	case caInit.FullCommand():
+		ca, err := initCA(*caDir, *caInitName, *caInitValidity)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created the CA %s, the clients trust it as their server certificate\n", ca.certPath)
+		return nil
+	case caToken.FullCommand():
+		if err := os.MkdirAll(*dataDir, 0700); err != nil {
+			return err
+		}
+		token, err := createToken(filepath.Join(*dataDir, tokensName), *caTokenName, *caTokenID, *caTokenRole, *caTokenTTL)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	}
+
+	ca, err := loadCA(*caDir)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case caIssueServer.FullCommand():
+		template, err := serverTemplate(*caIssueServerDNS, *caIssueServerIP)
+		if err != nil {
+			return err
+		}
+		cert, err := ca.issueKeyPair(*caIssueServerOut, template, *caIssueServerValidity)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Issued the server certificate %s valid until %v\n", certificateSerial(cert), cert.NotAfter)
+	case caIssueClient.FullCommand():
+		template, err := clientTemplate(*caIssueClientName, *caIssueClientURI)
+		if err != nil {
+			return err
+		}
+		identity := *caIssueClientName
+		if *caIssueClientURI != "" {
+			identity = *caIssueClientURI
+		}
+		entry, err := registerClient(*clients, clientEntry{
+			ID:         *caIssueClientID,
+			Name:       *caIssueClientName,
+			Identity:   identity,
+			CA:         ca.certPath,
+			Role:       *caIssueClientRole,
+			Namespaces: *caIssueClientNamespaces,
+		})
+		if err != nil {
+			return err
+		}
+		cert, err := ca.issueKeyPair(*caIssueClientOut, template, *caIssueClientValidity)
+		if err != nil {
+			return err
+		}
+		// a running server accepts it after reloading the registry
+		fmt.Printf("Registered client %d with the certificate %s valid until %v\n", entry.ID, certificateSerial(cert), cert.NotAfter)
+	}
+	return nil
 }
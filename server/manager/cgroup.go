@@ -0,0 +1,193 @@
+package manager
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
+)
+
+// controllers needed to enforce the limits
+var cgroupControllers = []string{"cpu", "memory", "io", "pids"}
+
+// period of the cpu quota in microseconds
+const cpuPeriod = 100000
+
+// smallest cpu quota accepted by the kernel in microseconds
+const cpuQuotaMin = 1000
+
+// cgroup v2 directory under which every process gets its own leaf
+type cgroups struct {
+	root string
+}
+
+// create the root directory and enable the controllers for its children
+func newCgroups(root string) (*cgroups, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 directory", root)
+	}
+
+	// the controllers must be available in the root to be enabled for its children
+	available, err := readControllers(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, controller := range cgroupControllers {
+		if !available[controller] {
+			missing = append(missing, "+"+controller)
+		}
+	}
+	if len(missing) > 0 {
+		parent := filepath.Join(filepath.Dir(root), "cgroup.subtree_control")
+		err = ioutil.WriteFile(parent, []byte(strings.Join(missing, " ")), 0)
+		if err != nil {
+			return nil, fmt.Errorf("cannot enable the controllers %v in %s: %v", missing, parent, err)
+		}
+	}
+
+	enable := []string{}
+	for _, controller := range cgroupControllers {
+		enable = append(enable, "+"+controller)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot enable the controllers in %s: %v", root, err)
+	}
+	return &cgroups{root: root}, nil
+}
+
+// return the set of controllers listed in the file
+func readControllers(file string) (map[string]bool, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	controllers := make(map[string]bool)
+	for _, controller := range strings.Fields(string(content)) {
+		controllers[controller] = true
+	}
+	return controllers, nil
+}
+
+// create the leaf of the process having the given id and apply the limits
+// return the leaf directory
+func (cgroups *cgroups) create(id string, limits apiobj.Limits) (string, error) {
+	dir := filepath.Join(cgroups.root, id)
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	files := map[string]string{}
+	if limits.CPUWeight > 0 {
+		files["cpu.weight"] = strconv.FormatUint(limits.CPUWeight, 10)
+	}
+	if limits.CPUQuota > 0 {
+		files["cpu.max"] = fmt.Sprintf("%d %d", cpuQuotaMicros(limits.CPUQuota), cpuPeriod)
+	}
+	if limits.MemoryMax > 0 {
+		files["memory.max"] = strconv.FormatInt(limits.MemoryMax, 10)
+	}
+	if limits.IOWeight > 0 {
+		files["io.weight"] = "default " + strconv.FormatUint(limits.IOWeight, 10)
+	}
+	if limits.PidsMax > 0 {
+		files["pids.max"] = strconv.FormatInt(limits.PidsMax, 10)
+	}
+	for file, value := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0)
+		if err != nil {
+			_ = os.Remove(dir)
+			return "", fmt.Errorf("cannot set %s: %v", file, err)
+		}
+	}
+	if limits.MemoryMax > 0 {
+		// without swap the memory limit triggers the oom killer
+		// the file exists only if swap is enabled
+		_ = ioutil.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0)
+	}
+	return dir, nil
+}
+
+// kill every process left in the leaf, even the ones that left the process group
+// supported only by recent kernels
+func killCgroup(dir string) {
+	_ = ioutil.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0)
+}
+
+// report if the oom killer has killed a process of the leaf
+func oomKilled(dir string) bool {
+	file, err := os.Open(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return fields[1] != "0"
+		}
+	}
+	return false
+}
+
+// remove the leaf once every process has left it
+func removeCgroup(dir string) error {
+	var err error
+	// the killed processes leave the leaf asynchronously
+	for i := 0; i < 50; i++ {
+		err = os.Remove(dir)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return err
+}
+
+// check the limits values, 0 means no limit
+func validateLimits(limits apiobj.Limits) error {
+	if limits.CPUWeight > 10000 {
+		return errors.New("cpu weight must be between 1 and 10000")
+	}
+	if limits.IOWeight > 10000 {
+		return errors.New("io weight must be between 1 and 10000")
+	}
+	if limits.CPUQuota < 0 || limits.MemoryMax < 0 || limits.PidsMax < 0 {
+		return errors.New("negative resource limit")
+	}
+	if limits.CPUQuota > 0 && cpuQuotaMicros(limits.CPUQuota) < cpuQuotaMin {
+		return fmt.Errorf("cpu quota must be at least %g", float64(cpuQuotaMin)/cpuPeriod)
+	}
+	return nil
+}
+
+// microseconds of cpu time per period
+func cpuQuotaMicros(quota float64) int64 {
+	return int64(quota * cpuPeriod)
+}
+
+// check the limits can be enforced with rlimits
+func validateRlimits(limits apiobj.Limits) error {
+	if limits.CPUQuota > 0 {
+		return errors.New("cpu quota cannot be enforced without cgroups")
+	}
+	if limits.IOWeight > 0 {
+		return errors.New("io weight cannot be enforced without cgroups")
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package manager
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Credential is the Unix user running the processes of a client
+type Credential struct {
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+	// supplementary groups, none if empty
+	Groups []uint32 `json:"groups,omitempty"`
+}
+
+// credential applied by exec before the command starts
+func (credential Credential) sysProcCredential() *syscall.Credential {
+	return &syscall.Credential{
+		Uid:    credential.Uid,
+		Gid:    credential.Gid,
+		Groups: credential.Groups,
+	}
+}
+
+// called by the job init once the setup requiring privileges is done
+// the groups are set first since they cannot be changed afterwards
+func (credential Credential) drop() error {
+	groups := make([]int, len(credential.Groups))
+	for i, group := range credential.Groups {
+		groups[i] = int(group)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("cannot set the groups: %v", err)
+	}
+	if err := syscall.Setgid(int(credential.Gid)); err != nil {
+		return fmt.Errorf("cannot set the gid: %v", err)
+	}
+	if err := syscall.Setuid(int(credential.Uid)); err != nil {
+		return fmt.Errorf("cannot set the uid: %v", err)
+	}
+	return nil
+}
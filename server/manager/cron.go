@@ -0,0 +1,171 @@
+package manager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron expression with the minutes, hours, days, months and weekdays
+// matching it as bitsets
+type cronSpec struct {
+	minute   uint64
+	hour     uint64
+	monthDay uint64
+	month    uint64
+	weekDay  uint64
+	// like in cron the day matches either field when both are restricted
+	anyMonthDay bool
+	anyWeekDay  bool
+}
+
+// shorthands of the common expressions
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames   = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	weekDayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// how far next looks for a matching time
+// an expression like 0 0 30 2 * never matches
+const cronHorizon = 5
+
+// parse a cron expression of 5 fields separated by spaces
+// minute hour day-of-month month day-of-week
+// every field is * or a list of values and ranges like 1,3-5 with an optional step like */15
+// months and weekdays can be named like jan or mon, sunday is 0 or 7
+func parseCron(expression string) (*cronSpec, error) {
+	if macro, exists := cronMacros[strings.TrimSpace(expression)]; exists {
+		expression = macro
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expression)
+	}
+	spec := &cronSpec{
+		anyMonthDay: strings.HasPrefix(fields[2], "*"),
+		anyWeekDay:  strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59, nil, 0); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23, nil, 0); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if spec.monthDay, err = parseCronField(fields[2], 1, 31, nil, 0); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12, monthNames, 1); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if spec.weekDay, err = parseCronField(fields[4], 0, 7, weekDayNames, 0); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	// 7 is another sunday
+	if spec.weekDay&(1<<7) != 0 {
+		spec.weekDay |= 1
+	}
+	return spec, nil
+}
+
+// bitset of the values of a field between min and max
+// the names are the values starting from first
+func parseCronField(field string, min int, max int, names []string, first int) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		low, high := min, max
+		switch {
+		case part == "*":
+		case strings.IndexByte(part, '-') > 0:
+			i := strings.IndexByte(part, '-')
+			var err error
+			if low, err = parseCronValue(part[:i], min, max, names, first); err != nil {
+				return 0, err
+			}
+			if high, err = parseCronValue(part[i+1:], min, max, names, first); err != nil {
+				return 0, err
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			var err error
+			if low, err = parseCronValue(part, min, max, names, first); err != nil {
+				return 0, err
+			}
+			// a single value with a step like 5/10 goes up to max
+			if step == 1 {
+				high = low
+			}
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, min int, max int, names []string, first int) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(value, name) {
+			return first + i, nil
+		}
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min || number > max {
+		return 0, fmt.Errorf("%q is not between %d and %d", value, min, max)
+	}
+	return number, nil
+}
+
+func (spec *cronSpec) matchesDay(t time.Time) bool {
+	monthDay := spec.monthDay&(1<<uint(t.Day())) != 0
+	weekDay := spec.weekDay&(1<<uint(t.Weekday())) != 0
+	if !spec.anyMonthDay && !spec.anyWeekDay {
+		return monthDay || weekDay
+	}
+	return monthDay && weekDay
+}
+
+// first minute after t matching the expression in the time zone of t
+// the zero time if there is none within cronHorizon years
+func (spec *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronHorizon, 0, 0)
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		switch {
+		case spec.month&(1<<uint(month)) == 0:
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, t.Location())
+		case !spec.matchesDay(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+		case spec.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, t.Location())
+		case spec.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
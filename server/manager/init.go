@@ -0,0 +1,147 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/anterpin/interview/server/apiobj"
+)
+
+// argument zero making the binary act as job init
+const initName = "job-init"
+
+// environment variable carrying the job init configuration
+const initEnv = "_JOB_INIT_CONFIG"
+
+// file descriptor used by the job init to report a setup error
+// it is closed on exec when the setup succeeds
+const initSyncFd = 3
+
+// not defined by the syscall package
+const rlimitNproc = 6
+
+// prepared by the manager and applied by the job init before executing the command
+type initConfig struct {
+	// program resolved with the PATH of the server
+	// or its name if it was not found
+	Path string `json:"path"`
+	// cgroup v2 directory to join
+	Cgroup string `json:"cgroup,omitempty"`
+	// resource limits enforced with rlimits when cgroups are not available
+	Rlimits *apiobj.Limits `json:"rlimits,omitempty"`
+	// set when the job init runs in new namespaces
+	Isolated bool   `json:"isolated,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	// bring up the loopback interface of the new network namespace
+	Loopback bool `json:"loopback,omitempty"`
+	// user the job init becomes before executing the command
+	Credential *Credential `json:"credential,omitempty"`
+}
+
+// Init must be called at the very beginning of main
+// by every binary using the manager, tests included
+// when the binary has been started by the manager as job init
+// it sets up the job environment and executes the command without returning
+// otherwise it returns immediately
+func Init() {
+	if len(os.Args) < 2 || os.Args[0] != initName {
+		return
+	}
+	err := runInit(os.Args[1:])
+	// report the error to the manager waiting for the exec
+	syncFile := os.NewFile(initSyncFd, "sync")
+	fmt.Fprint(syncFile, err.Error())
+	os.Exit(127)
+}
+
+// apply the configuration and execute the command
+// it returns only on error
+func runInit(args []string) error {
+	config := initConfig{}
+	err := json.Unmarshal([]byte(os.Getenv(initEnv)), &config)
+	if err != nil {
+		return fmt.Errorf("invalid job init configuration: %v", err)
+	}
+	os.Unsetenv(initEnv)
+
+	// resolved before the limits are applied to the job init itself
+	path, err := exec.LookPath(config.Path)
+	if err != nil {
+		return err
+	}
+
+	if config.Cgroup != "" {
+		// 0 moves the writing process
+		err = ioutil.WriteFile(filepath.Join(config.Cgroup, "cgroup.procs"), []byte("0"), 0)
+		if err != nil {
+			return fmt.Errorf("cannot join the cgroup: %v", err)
+		}
+	}
+	if config.Isolated {
+		err = setupNamespaces(config)
+		if err != nil {
+			return err
+		}
+	}
+	if config.Rlimits != nil {
+		err = setRlimits(*config.Rlimits)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Credential != nil {
+		err = config.Credential.drop()
+		if err != nil {
+			return err
+		}
+	}
+
+	syscall.CloseOnExec(initSyncFd)
+	return syscall.Exec(path, args, os.Environ())
+}
+
+// the limits without an rlimit equivalent must be rejected by the manager
+func setRlimits(limits apiobj.Limits) error {
+	if limits.MemoryMax > 0 {
+		limit := uint64(limits.MemoryMax)
+		err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limit, Max: limit})
+		if err != nil {
+			return fmt.Errorf("cannot limit the memory: %v", err)
+		}
+	}
+	if limits.PidsMax > 0 {
+		// it counts every process of the user, not only the ones of the job
+		limit := uint64(limits.PidsMax)
+		err := syscall.Setrlimit(rlimitNproc, &syscall.Rlimit{Cur: limit, Max: limit})
+		if err != nil {
+			return fmt.Errorf("cannot limit the processes: %v", err)
+		}
+	}
+	if limits.CPUWeight > 0 {
+		err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, weightToNice(limits.CPUWeight))
+		if err != nil {
+			return fmt.Errorf("cannot set the cpu weight: %v", err)
+		}
+	}
+	return nil
+}
+
+// convert a cgroup cpu weight into a nice value
+// the default weight 100 is nice 0 and every nice step is about 1.25 times the weight
+func weightToNice(weight uint64) int {
+	nice := int(math.Round(-math.Log(float64(weight)/100) / math.Log(1.25)))
+	if nice < -20 {
+		return -20
+	}
+	if nice > 19 {
+		return 19
+	}
+	return nice
+}
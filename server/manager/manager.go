@@ -1,63 +1,337 @@
 package manager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/anterpin/interview/server/apiobj"
 	uuid "github.com/satori/go.uuid"
 )
 
+// Config of the manager
+type Config struct {
+	// directory where the output and the snapshots of every process
+	// the schedules and the workflows are stored so they survive a restart
+	// they are kept in RAM when empty
+	DataDir string
+	// maximum number of bytes stored for the output of each process
+	// entry headers and truncation notice included, 0 means no limit
+	MaxOutputSize int64
+	// grace period given to a process before killing it
+	// when the stop request does not specify it, DefaultStopTimeout if 0
+	StopTimeout time.Duration
+	// cgroup v2 directory under which every process with resource limits
+	// gets its own leaf, cgroups are not used when empty
+	CgroupRoot string
+	// enforce the resource limits with rlimits when cgroups are not available
+	// instead of failing
+	RlimitFallback bool
+	// policy of the users without their own
+	DefaultPolicy Policy
+	// quota of the users without their own
+	DefaultQuota apiobj.Quota
+	// processes running at the same time for all the users and for each of them
+	// the others wait in a queue and start as the running ones terminate
+	// sharing the slots among the users, 0 means no limit
+	MaxConcurrent        int
+	MaxConcurrentPerUser int
+	// let the processes run as root
+	// when the server runs as root and the user has no credential
+	AllowRoot bool
+}
+
+// Policy enforced by the server on the processes of a user
+type Policy struct {
+	// run every process in its own namespaces even if not requested
+	RequireIsolation bool `json:"require_isolation,omitempty"`
+	// let isolated processes keep the host network
+	AllowNetwork bool `json:"allow_network,omitempty"`
+}
+
+// resolve the isolation of a new process according to the policy
+// nil means the process is not isolated
+func (policy Policy) isolation(requested *apiobj.Isolation) (*apiobj.Isolation, error) {
+	if requested == nil || !requested.Enabled {
+		if policy.RequireIsolation {
+			return &apiobj.Isolation{Enabled: true}, nil
+		}
+		return nil, nil
+	}
+	if requested.Network && !policy.AllowNetwork {
+		return nil, errors.New("host network is not allowed")
+	}
+	return requested, nil
+}
+
+const DefaultStopTimeout = 10 * time.Second
+
 type Manager struct {
 	// map[userid] user process hashmap
 	userProcesses map[int]*UserProcesses
-	// used only to resize the userProcesse hashmap
-	mutex sync.Mutex
+	// guards the userProcesses hashmap and closed
+	mutex sync.RWMutex
+	// set by Shutdown, no more processes can be started
+	closed bool
+	// processes being started
+	starting sync.WaitGroup
+
+	store OutputStore
+	// nil if the processes are not persistent
+	registry *registry
+	// processes whose final snapshot is being recorded
+	recording     sync.WaitGroup
+	maxOutputSize int64
+	stopTimeout   time.Duration
+	// nil if the resource limits are enforced with rlimits or not at all
+	cgroups        *cgroups
+	rlimitFallback bool
+	defaultPolicy  Policy
+	defaultQuota   apiobj.Quota
+	allowRoot      bool
+
+	// running and pending processes while a concurrency limit is set
+	scheduler *scheduler
+	// pending processes in the scheduler
+	queued map[*Process]*queuedJob
+	// guards scheduler and queued
+	queueMutex sync.Mutex
+
+	// schedules by id
+	schedules      map[string]*schedule
+	schedulesMutex sync.Mutex
+	// loaded from the data directory and not started yet
+	restoredSchedules []*schedule
+	// empty if the schedules are not persistent
+	schedulesPath   string
+	savingSchedules sync.Mutex
+
+	// workflows by id
+	workflows      map[string]*workflow
+	workflowsMutex sync.Mutex
+	// empty if the workflows are not persistent
+	workflowsPath   string
+	savingWorkflows sync.Mutex
+
+	// closed by Shutdown to stop the schedules and the workflows
+	unscheduled chan struct{}
+	// goroutines of the schedules and of the workflows
+	scheduling sync.WaitGroup
+}
+
+func NewManager(config Config) (*Manager, error) {
+	if config.MaxOutputSize < 0 {
+		return nil, errors.New("negative max output size")
+	}
+	if config.StopTimeout < 0 {
+		return nil, errors.New("negative stop timeout")
+	}
+	if err := ValidateQuota(config.DefaultQuota); err != nil {
+		return nil, err
+	}
+	if config.MaxConcurrent < 0 || config.MaxConcurrentPerUser < 0 {
+		return nil, errors.New("negative concurrency limit")
+	}
+	if config.StopTimeout == 0 {
+		config.StopTimeout = DefaultStopTimeout
+	}
+
+	var cgroupsPtr *cgroups
+	if config.CgroupRoot != "" {
+		var err error
+		cgroupsPtr, err = newCgroups(config.CgroupRoot)
+		if err != nil && !config.RlimitFallback {
+			return nil, fmt.Errorf("cannot setup the cgroups: %v", err)
+		}
+		if err != nil {
+			log.Printf("Cannot setup the cgroups, falling back to rlimits: %v", err)
+		}
+	}
+
+	manager := &Manager{
+		userProcesses:  make(map[int]*UserProcesses),
+		store:          MemoryStore{},
+		maxOutputSize:  config.MaxOutputSize,
+		stopTimeout:    config.StopTimeout,
+		cgroups:        cgroupsPtr,
+		rlimitFallback: config.RlimitFallback,
+		defaultPolicy:  config.DefaultPolicy,
+		defaultQuota:   config.DefaultQuota,
+		allowRoot:      config.AllowRoot,
+		scheduler:      newScheduler(config.MaxConcurrent, config.MaxConcurrentPerUser),
+		queued:         make(map[*Process]*queuedJob),
+		schedules:      make(map[string]*schedule),
+		workflows:      make(map[string]*workflow),
+		unscheduled:    make(chan struct{}),
+	}
+	if config.DataDir != "" {
+		err := manager.restore(config.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		err = manager.restoreSchedules(config.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		err = manager.restoreWorkflows(config.DataDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manager, nil
+}
+
+// load the processes started before a restart from the registry in dir
+// their output remains readable
+func (manager *Manager) restore(dir string) error {
+	fileStore, err := NewFileStore(dir)
+	if err != nil {
+		return err
+	}
+	registry, statuses, err := openRegistry(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open the registry: %v", err)
+	}
+	manager.store = fileStore
+	manager.registry = registry
+
+	for _, status := range statuses {
+		id, err := uuid.FromString(status.ID)
+		if err != nil {
+			log.Printf("Invalid process id %q in the registry", status.ID)
+			continue
+		}
+		storage, size, err := fileStore.Open(status.ID)
+		if err != nil {
+			log.Printf("Cannot open the output of the process %s: %v", status.ID, err)
+			storage, size = new(memoryStorage), 0
+		}
+		userProcesses, exists := manager.userProcesses[status.Owner]
+		if !exists {
+			userProcesses = &UserProcesses{processes: make(map[uuid.UUID]*Process)}
+			manager.userProcesses[status.Owner] = userProcesses
+		}
+		userProcesses.processes[id] = restoreProcess(status, restoreOutput(storage, size))
+	}
+	return nil
 }
 
-func NewManager() Manager {
-	return Manager{
-		userProcesses: make(map[int]*UserProcesses),
+// record the snapshot of a process when started and when terminated
+func (manager *Manager) record(status apiobj.ProcessStatus) {
+	if err := manager.registry.record(status); err != nil {
+		log.Printf("Cannot record the process %s: %v", status.ID, err)
+	}
+	if status.State != apiobj.StateRunning && status.State != apiobj.StatePending {
+		manager.recording.Done()
 	}
 }
 
 func (manager *Manager) AddUser(userid int) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
 	_, exists := manager.userProcesses[userid]
 	if exists {
 		log.Printf("User id %d already exist", userid)
 		return
 	}
 
-	manager.mutex.Lock()
-	defer manager.mutex.Unlock()
-
 	userProcessesPtr := new(UserProcesses)
-	userProcessesPtr.processes = make(map[uuid.UUID]Process)
+	userProcessesPtr.processes = make(map[uuid.UUID]*Process)
 	manager.userProcesses[userid] = userProcessesPtr
 }
 
 type UserProcesses struct {
-	processes map[uuid.UUID]Process
-	mutex     sync.Mutex
+	processes map[uuid.UUID]*Process
+	// nil means the default policy
+	policy *Policy
+	// nil means the user running the server
+	credential *Credential
+	// nil means the default quota
+	quota *apiobj.Quota
+	mutex sync.Mutex
+	// held while a process is started so the quota is checked
+	// and the process added at once
+	starting sync.Mutex
+}
+
+// set the policy enforced on the processes started by the user
+// nil means the default policy
+func (manager *Manager) SetPolicy(userid int, policy *Policy) {
+	userProcesses, _ := manager.getUserProcesses(userid)
+
+	userProcesses.mutex.Lock()
+	defer userProcesses.mutex.Unlock()
+	userProcesses.policy = policy
+}
+
+// set the Unix user running the processes started by the user
+// nil means the user running the server
+func (manager *Manager) SetCredential(userid int, credential *Credential) {
+	userProcesses, _ := manager.getUserProcesses(userid)
+
+	userProcesses.mutex.Lock()
+	defer userProcesses.mutex.Unlock()
+	userProcesses.credential = credential
+}
+
+// return the credential of the processes started by the user
+// refusing root unless it is allowed
+func (manager *Manager) getCredential(userid int) (*Credential, error) {
+	userProcesses, _ := manager.getUserProcesses(userid)
+
+	userProcesses.mutex.Lock()
+	credential := userProcesses.credential
+	userProcesses.mutex.Unlock()
+
+	uid := uint32(os.Geteuid())
+	if credential != nil {
+		uid = credential.Uid
+	}
+	if uid == 0 && !manager.allowRoot {
+		return nil, errors.New("running processes as root is not allowed")
+	}
+	return credential, nil
+}
+
+func (manager *Manager) getPolicy(userid int) Policy {
+	userProcesses, _ := manager.getUserProcesses(userid)
+
+	userProcesses.mutex.Lock()
+	defer userProcesses.mutex.Unlock()
+	if userProcesses.policy == nil {
+		return manager.defaultPolicy
+	}
+	return *userProcesses.policy
 }
 
 func (manager *Manager) getUserProcesses(userid int) (*UserProcesses, bool) {
+	manager.mutex.RLock()
 	userProcesses, exists := manager.userProcesses[userid]
+	manager.mutex.RUnlock()
 	if !exists {
 		// if should not exist
 		// it prints to warn the server
 		// but in any case it will return the create a new user process hashmap
 		log.Printf("Unknown user id %d in process hashmap", userid)
 		manager.AddUser(userid)
+		manager.mutex.RLock()
 		userProcesses = manager.userProcesses[userid]
+		manager.mutex.RUnlock()
 	}
 	return userProcesses, exists
 }
 
-func (manager *Manager) getUserProcess(processId string, userid int, callback func(Process) (interface{}, error)) (interface{}, error) {
+// retrieve the process having that id and owned by the user
+func (manager *Manager) getProcess(processId string, userid int) (*Process, error) {
 	id, err := uuid.FromString(processId)
 	if err != nil {
 		// not a valid v4 id, in this case it accepts every type of id
@@ -73,90 +347,386 @@ func (manager *Manager) getUserProcess(processId string, userid int, callback fu
 	if !exists {
 		return nil, fmt.Errorf("do not exist process id %s", processId)
 	}
+	return process, nil
+}
+
+func (manager *Manager) getUserProcess(processId string, userid int, callback func(*Process) (interface{}, error)) (interface{}, error) {
+	process, err := manager.getProcess(processId, userid)
+	if err != nil {
+		return nil, err
+	}
 	return callback(process)
 }
 
-func (manager *Manager) Start(command string, userid int) (string, error) {
-	args := strings.Fields(command)
-	// empty command
-	if len(args) == 0 {
-		return "", errors.New("empty Command")
+func (manager *Manager) Start(command apiobj.Command, userid int) (string, error) {
+	args, err := commandArgs(command)
+	if err != nil {
+		return "", err
+	}
+	if command.Limits != nil {
+		if err := manager.checkLimits(*command.Limits); err != nil {
+			return "", err
+		}
+	}
+	env, err := commandEnv(command)
+	if err != nil {
+		return "", err
+	}
+	if command.Cwd != "" && !filepath.IsAbs(command.Cwd) {
+		return "", errors.New("the working directory must be an absolute path")
+	}
+	isolation, err := manager.getPolicy(userid).isolation(command.Isolation)
+	if err != nil {
+		return "", err
+	}
+	credential, err := manager.getCredential(userid)
+	if err != nil {
+		return "", err
+	}
+	deadline, err := commandDeadline(command, time.Now())
+	if err != nil {
+		return "", err
+	}
+	priority, err := parsePriority(command.Priority)
+	if err != nil {
+		return "", err
+	}
+
+	manager.mutex.Lock()
+	if manager.closed {
+		manager.mutex.Unlock()
+		return "", errors.New("the manager is shutting down")
+	}
+	manager.starting.Add(1)
+	manager.mutex.Unlock()
+	defer manager.starting.Done()
+
+	userProcesses, _ := manager.getUserProcesses(userid)
+	userProcesses.starting.Lock()
+	defer userProcesses.starting.Unlock()
+	outputLimit, err := manager.checkQuota(userid)
+	if err != nil {
+		return "", err
 	}
 
 	// generate the uuid
 	processid := uuid.NewV1()
-	process, err := Create(args[0], args[1:]...)
+	storage, err := manager.store.Create(processid.String())
 	if err != nil {
 		return "", err
 	}
+	options := Options{
+		Storage:     storage,
+		OutputLimit: outputLimit,
+		Isolation:   isolation,
+		Hostname:    processid.String()[:8],
+		Credential:  credential,
+		Env:         env,
+		Dir:         command.Cwd,
+		Stdin:       command.Stdin,
+		ID:          processid.String(),
+		Owner:       userid,
+		Namespace:   command.Namespace,
+		Priority:    priority,
+		Deadline:    deadline,
+		StopTimeout: manager.stopTimeout,
+	}
+	if manager.registry != nil {
+		// done by the record of the final snapshot
+		manager.recording.Add(1)
+		options.Record = manager.record
+	}
+	if command.Limits != nil && manager.cgroups != nil {
+		options.Cgroup, err = manager.cgroups.create(processid.String(), *command.Limits)
+	} else if command.Limits != nil {
+		options.Rlimits = command.Limits
+	}
 
-	userProcesses, _ := manager.getUserProcesses(userid)
+	var process *Process
+	if err == nil {
+		process, err = manager.create(options, args)
+	}
+	if err != nil {
+		_ = storage.Close()
+		_ = manager.store.Remove(processid.String())
+		if options.Cgroup != "" {
+			_ = removeCgroup(options.Cgroup)
+		}
+		if options.Record != nil {
+			manager.recording.Done()
+		}
+		return "", err
+	}
 
 	userProcesses.mutex.Lock()
-	defer userProcesses.mutex.Unlock()
-
 	userProcesses.processes[processid] = process
+	userProcesses.mutex.Unlock()
 
 	return processid.String(), nil
 }
 
-func (manager *Manager) Status(processId string, userid int) (*os.ProcessState, error) {
-	result, err := manager.getUserProcess(processId, userid, func(process Process) (interface{}, error) {
-		return process.Status(), nil
+func (manager *Manager) Status(processId string, userid int) (apiobj.ProcessStatus, error) {
+	result, err := manager.getUserProcess(processId, userid, func(process *Process) (interface{}, error) {
+		return manager.snapshot(process), nil
 	})
 	if err != nil {
-		return nil, err
+		return apiobj.ProcessStatus{}, err
 	}
+	return result.(apiobj.ProcessStatus), nil
+}
 
-	if result == nil {
-		return nil, nil
+// path of the shell running the commands in shell mode
+const shellPath = "/bin/sh"
+
+// the argv of the process running the command
+// the argv array is used as is while the command string is split on spaces
+// in shell mode the first one is the script run by the shell
+// and the rest are its positional parameters starting from $1
+func commandArgs(command apiobj.Command) ([]string, error) {
+	if len(command.Argv) > 0 && command.Command != "" {
+		return nil, errors.New("command and argv cannot be both set")
+	}
+	var args []string
+	switch {
+	case command.Shell && len(command.Argv) > 0:
+		args = append([]string{shellPath, "-c", command.Argv[0], "sh"}, command.Argv[1:]...)
+	case command.Shell && command.Command != "":
+		args = []string{shellPath, "-c", command.Command}
+	case len(command.Argv) > 0:
+		args = command.Argv
+	default:
+		args = strings.Fields(command.Command)
+	}
+	// empty command
+	if len(args) == 0 || args[0] == "" || (command.Shell && args[2] == "") {
+		return nil, errors.New("empty Command")
 	}
-	return result.(*os.ProcessState), nil
+	return args, nil
 }
 
-func (manager *Manager) Stop(processId string, userid int) error {
-	_, err := manager.getUserProcess(processId, userid, func(process Process) (interface{}, error) {
-		err := process.Kill()
-		if err != nil {
-			return nil, err
+// the environment of the process running the command
+// nil means the server one
+func commandEnv(command apiobj.Command) ([]string, error) {
+	for _, variable := range command.Env {
+		if strings.IndexByte(variable, '=') <= 0 || strings.IndexByte(variable, 0) >= 0 {
+			return nil, fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", variable)
 		}
+	}
+	if command.CleanEnv {
+		return append([]string{}, command.Env...), nil
+	}
+	if len(command.Env) == 0 {
 		return nil, nil
-	})
+	}
+	// the last value of a variable wins
+	return append(os.Environ(), command.Env...), nil
+}
 
-	return err
+// the earliest of the timeout and the deadline of the command
+// the zero time if it has none
+func commandDeadline(command apiobj.Command, now time.Time) (time.Time, error) {
+	deadline := time.Time{}
+	if command.Timeout != "" {
+		timeout, err := time.ParseDuration(command.Timeout)
+		if err != nil || timeout <= 0 {
+			return deadline, errors.New("timeout must be a positive duration")
+		}
+		deadline = now.Add(timeout)
+	}
+	if command.Deadline != nil {
+		if !command.Deadline.After(now) {
+			return time.Time{}, errors.New("deadline already passed")
+		}
+		if deadline.IsZero() || command.Deadline.Before(deadline) {
+			deadline = *command.Deadline
+		}
+	}
+	return deadline, nil
 }
 
-func (manager *Manager) Log(processId string, userid int) (string, error) {
-	result, err := manager.getUserProcess(processId, userid, func(process Process) (interface{}, error) {
-		return process.Log(), nil
-	})
+// check the limits can be enforced
+func (manager *Manager) checkLimits(limits apiobj.Limits) error {
+	if err := validateLimits(limits); err != nil {
+		return err
+	}
+	if manager.cgroups != nil {
+		return nil
+	}
+	if !manager.rlimitFallback {
+		return errors.New("resource limits are not enabled")
+	}
+	return validateRlimits(limits)
+}
 
+// stop the process sending signal and escalate to SIGKILL
+// if it has not terminated after the grace period
+// a grace period of 0 means the configured stop timeout
+// a pending process is cancelled and never runs
+func (manager *Manager) Stop(processId string, userid int, signal syscall.Signal, grace time.Duration) error {
+	process, err := manager.getProcess(processId, userid)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if grace == 0 {
+		grace = manager.stopTimeout
+	}
+	return process.Stop(signal, grace)
+}
+
+// delete the terminated process and its output
+// so they do not count anymore in the quota of the user
+func (manager *Manager) Remove(processId string, userid int) error {
+	process, err := manager.getProcess(processId, userid)
+	if err != nil {
+		return err
+	}
+	if !process.isDone() {
+		return fmt.Errorf("the process %s has not terminated", processId)
+	}
+	if manager.registry != nil {
+		if err := manager.registry.remove(processId); err != nil {
+			return fmt.Errorf("cannot remove the process %s: %v", processId, err)
+		}
+	}
+
+	// valid once the process is found
+	id, _ := uuid.FromString(processId)
+	userProcesses, _ := manager.getUserProcesses(userid)
+	userProcesses.mutex.Lock()
+	delete(userProcesses.processes, id)
+	userProcesses.mutex.Unlock()
+
+	if err := manager.store.Remove(processId); err != nil && !os.IsNotExist(err) {
+		log.Printf("Cannot remove the output of the process %s: %v", processId, err)
+	}
+	return nil
+}
+
+// pass the output entries of the process selected by the filter to callback
+// one chunk at a time
+// an unknown process id is reported before callback is called
+func (manager *Manager) Log(processId string, userid int, filter Filter, callback func([]Entry) error) error {
+	process, err := manager.getProcess(processId, userid)
+	if err != nil {
+		return err
+	}
+	return process.Log(filter, callback)
+}
+
+// pass the output entries of the process selected by the filter to callback
+// as soon as they are produced
+// it blocks until the process terminates or the context is cancelled
+// an unknown process id is reported before callback is called
+func (manager *Manager) Follow(ctx context.Context, processId string, userid int, filter Filter, callback func([]Entry) error) error {
+	process, err := manager.getProcess(processId, userid)
+	if err != nil {
+		return err
 	}
-	// cast to the type return value of process.Log
-	return result.(string), nil
+	return process.Follow(ctx, filter, callback)
 }
 
-func (manager *Manager) List(userid int) []string {
+// return the snapshots of the processes owned by the user
+// from the oldest to the newest
+func (manager *Manager) List(userid int) []apiobj.ProcessStatus {
 	userProcesses, _ := manager.getUserProcesses(userid)
 
 	userProcesses.mutex.Lock()
-	defer userProcesses.mutex.Unlock()
+	arr := make([]apiobj.ProcessStatus, 0, len(userProcesses.processes))
+	for _, process := range userProcesses.processes {
+		arr = append(arr, manager.snapshot(process))
+	}
+	userProcesses.mutex.Unlock()
 
-	arr := make([]string, len(userProcesses.processes))
-	i := 0
-	for id, process := range userProcesses.processes {
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i].StartTime.Before(arr[j].StartTime)
+	})
+	return arr
+}
 
-		state := process.Status()
-		// list fast status preview
-		str := "ACTIVE"
-		if state != nil {
-			str = "TERMINATED"
-		}
+// return the snapshots of the processes of every user selected by match
+// or all of them if match is nil, from the oldest to the newest
+func (manager *Manager) ListMatching(match func(apiobj.ProcessStatus) bool) []apiobj.ProcessStatus {
+	manager.mutex.RLock()
+	users := make([]*UserProcesses, 0, len(manager.userProcesses))
+	for _, userProcesses := range manager.userProcesses {
+		users = append(users, userProcesses)
+	}
+	manager.mutex.RUnlock()
 
-		arr[i] = fmt.Sprintf("%s %s %s", id.String(), process.name, str)
-		i++
+	arr := []apiobj.ProcessStatus{}
+	for _, userProcesses := range users {
+		userProcesses.mutex.Lock()
+		for _, process := range userProcesses.processes {
+			status := manager.snapshot(process)
+			if match == nil || match(status) {
+				arr = append(arr, status)
+			}
+		}
+		userProcesses.mutex.Unlock()
 	}
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i].StartTime.Before(arr[j].StartTime)
+	})
 	return arr
 }
+
+// return the snapshot of the process having that id whoever owns it
+// used to check the access to the process
+func (manager *Manager) Lookup(processId string) (apiobj.ProcessStatus, error) {
+	id, err := uuid.FromString(processId)
+	if err != nil {
+		return apiobj.ProcessStatus{}, err
+	}
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	for _, userProcesses := range manager.userProcesses {
+		userProcesses.mutex.Lock()
+		process, exists := userProcesses.processes[id]
+		userProcesses.mutex.Unlock()
+		if exists {
+			return manager.snapshot(process), nil
+		}
+	}
+	return apiobj.ProcessStatus{}, fmt.Errorf("do not exist process id %s", processId)
+}
+
+// stop every running process of every user sending SIGTERM to its process group
+// and SIGKILL after the grace period
+// it returns when all of them have terminated
+// no process can be started afterwards, the schedules and the workflows stop
+func (manager *Manager) Shutdown(grace time.Duration) {
+	manager.mutex.Lock()
+	if !manager.closed {
+		close(manager.unscheduled)
+	}
+	manager.closed = true
+	manager.mutex.Unlock()
+	manager.scheduling.Wait()
+	// the processes being started are stopped too
+	manager.starting.Wait()
+
+	manager.mutex.RLock()
+	processes := []*Process{}
+	for _, userProcesses := range manager.userProcesses {
+		userProcesses.mutex.Lock()
+		for _, process := range userProcesses.processes {
+			processes = append(processes, process)
+		}
+		userProcesses.mutex.Unlock()
+	}
+	manager.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, process := range processes {
+		wg.Add(1)
+		go func(process *Process) {
+			defer wg.Done()
+			// the terminated processes return an error
+			_ = process.Stop(syscall.SIGTERM, grace)
+			<-process.done
+		}(process)
+	}
+	wg.Wait()
+	// the final snapshots must be on disk before the server exits
+	manager.recording.Wait()
+}
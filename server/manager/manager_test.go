@@ -1,10 +1,58 @@
 package manager
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
 )
 
+func TestMain(m *testing.M) {
+	// the test binary acts as job init for the processes with limits
+	Init()
+	os.Exit(m.Run())
+}
+
+func newTestManager(t *testing.T, config Config) *Manager {
+	// the tests may run as root
+	config.AllowRoot = true
+	manager, err := NewManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+// concatenate the data of the entries
+func entriesData(entries []Entry) string {
+	buffer := bytes.Buffer{}
+	for _, entry := range entries {
+		buffer.Write(entry.Data)
+	}
+	return buffer.String()
+}
+
+// collect the output entries of the process selected by the filter
+func logEntries(manager *Manager, processId string, userid int, filter Filter) ([]Entry, error) {
+	result := []Entry{}
+	err := manager.Log(processId, userid, filter, func(entries []Entry) error {
+		result = append(result, entries...)
+		return nil
+	})
+	return result, err
+}
+
 func TestSequential(t *testing.T) {
 	tt := []struct {
 		name         string
@@ -17,13 +65,13 @@ func TestSequential(t *testing.T) {
 		{"no existing program", "jadfadf", 1},
 	}
 
-	manager := NewManager()
+	manager := newTestManager(t, Config{})
 	manager.AddUser(1)
 
 	const userid = 1
 	for _, tc := range tt {
 		// start test
-		processId, err := manager.Start(tc.command, userid)
+		processId, err := manager.Start(apiobj.Command{Command: tc.command}, userid)
 		if err != nil {
 			if tc.failingStage != 1 {
 				t.Errorf("test %s shouldn't fail at stage 0", tc.name)
@@ -37,7 +85,7 @@ func TestSequential(t *testing.T) {
 		_ = manager.List(userid)
 
 		// log test
-		_, err = manager.Log(processId, userid)
+		_, err = logEntries(manager, processId, userid, Filter{})
 		if err != nil {
 			t.Errorf("test %s shouldn't fail at logging", tc.name)
 			continue
@@ -49,17 +97,18 @@ func TestSequential(t *testing.T) {
 			t.Errorf("test %s shouldn't fail at status", tc.name)
 			continue
 		}
-		if state == nil && tc.failingStage != 0 {
+		active := state.State == apiobj.StateRunning
+		if active && tc.failingStage != 0 {
 			t.Errorf("test %s shouldn't be active", tc.name)
 			continue
 		}
-		if state != nil && tc.failingStage == 0 {
+		if !active && tc.failingStage == 0 {
 			t.Errorf("test %s shouldn't be terminated", tc.name)
 			continue
 		}
 
 		// stop test
-		err = manager.Stop(processId, userid)
+		err = manager.Stop(processId, userid, syscall.SIGTERM, 0)
 		if err != nil && tc.failingStage == 0 {
 			t.Errorf("test %s should be killed", tc.name)
 			continue
@@ -74,7 +123,7 @@ func TestSequential(t *testing.T) {
 }
 
 func TestEdgeCases(t *testing.T) {
-	manager := NewManager()
+	manager := newTestManager(t, Config{})
 	const userid = 1
 	manager.AddUser(userid)
 	t.Run("unvalid program id", func(t *testing.T) {
@@ -92,10 +141,1976 @@ func TestEdgeCases(t *testing.T) {
 	})
 
 	t.Run("handling new userid", func(t *testing.T) {
-		_, err := manager.Start("echo hello", 2)
+		_, err := manager.Start(apiobj.Command{Command: "echo hello"}, 2)
+		if err != nil {
+			t.Fatalf("%s failed", t.Name())
+		}
+	})
+
+}
+
+func discardEntries([]Entry) error {
+	return nil
+}
+
+func TestFollow(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	const userid = 1
+	manager.AddUser(userid)
+
+	t.Run("terminated process", func(t *testing.T) {
+		processId, err := manager.Start(apiobj.Command{Command: "echo hello"}, userid)
 		if err != nil {
+			t.Fatal(err)
+		}
+		str := ""
+		err = manager.Follow(context.Background(), processId, userid, Filter{}, func(entries []Entry) error {
+			str += entriesData(entries)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s failed %v", t.Name(), err)
+		}
+		if str != "hello\n" {
+			t.Fatalf("%s unexpected output %q", t.Name(), str)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		processId, err := manager.Start(apiobj.Command{Command: "watch date"}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer manager.Stop(processId, userid, syscall.SIGKILL, 0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		err = manager.Follow(ctx, processId, userid, Filter{}, discardEntries)
+		if err != context.DeadlineExceeded {
+			t.Fatalf("%s should stop on the context deadline %v", t.Name(), err)
+		}
+	})
+
+	t.Run("unknown program id", func(t *testing.T) {
+		err := manager.Follow(context.Background(), "95bf5b81-74bc-47e7-8622-e2aace3e866f", userid, Filter{}, discardEntries)
+		if err == nil {
+			t.Fatalf("%s failed", t.Name())
+		}
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	// room for 8 bytes of output beside the entry headers and the notice
+	const limit = 81
+	manager := newTestManager(t, Config{DataDir: dir, MaxOutputSize: limit})
+	const userid = 1
+	manager.AddUser(userid)
+
+	processId, err := manager.Start(apiobj.Command{Command: "echo hello world"}, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Follow(context.Background(), processId, userid, Filter{}, discardEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := logEntries(manager, processId, userid, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := entriesData(entries)
+	if !strings.HasPrefix(str, "hello wo\n[output truncated") {
+		t.Fatalf("output not truncated %q", str)
+	}
+	info, err := os.Stat(filepath.Join(dir, processId+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != limit {
+		t.Fatalf("%d bytes stored in the file instead of %d", info.Size(), limit)
+	}
+
+	t.Run("no existing program", func(t *testing.T) {
+		_, err := manager.Start(apiobj.Command{Command: "jadfadf"}, userid)
+		if err == nil {
 			t.Fatalf("%s failed", t.Name())
 		}
+		files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("%s should not leave an output file", t.Name())
+		}
+	})
+}
+
+// write a shell script in a temporary directory
+// return the command running it
+func shellScript(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "script.sh")
+	err := ioutil.WriteFile(path, []byte(script), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "sh " + path
+}
+
+func TestStreams(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	const userid = 1
+	manager.AddUser(userid)
+
+	before := time.Now()
+	processId, err := manager.Start(apiobj.Command{Command: shellScript(t, "echo out\necho err >&2\nprintf partial\n")}, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Follow(context.Background(), processId, userid, Filter{}, discardEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name    string
+		filter  Filter
+		entries int
+		// checked only for a single stream, the order between streams is not guaranteed
+		output string
+	}{
+		{"both streams", Filter{}, 3, ""},
+		{"stdout", Filter{Streams: Stdout}, 2, "out\npartial"},
+		{"stderr", Filter{Streams: Stderr}, 1, "err\n"},
+		{"since the start", Filter{Since: before}, 3, ""},
+		{"since the future", Filter{Since: time.Now().Add(time.Hour)}, 0, ""},
+		{"until the past", Filter{Until: before}, 0, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := logEntries(manager, processId, userid, tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tc.entries {
+				t.Fatalf("%s unexpected entries %d", tc.name, len(entries))
+			}
+			for _, entry := range entries {
+				if entry.Time.Before(before) {
+					t.Fatalf("%s entry %q with a wrong timestamp", tc.name, entry.Data)
+				}
+			}
+			if str := entriesData(entries); tc.output != "" && str != tc.output {
+				t.Fatalf("%s unexpected output %q", tc.name, str)
+			}
+		})
+	}
+}
+
+// wait for the termination of the process
+func waitProcess(t *testing.T, manager *Manager, processId string, userid int) apiobj.ProcessStatus {
+	err := manager.Follow(context.Background(), processId, userid, Filter{}, discardEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := manager.Status(processId, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestStatus(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	const userid = 1
+	manager.AddUser(userid)
+
+	t.Run("exited", func(t *testing.T) {
+		processId, err := manager.Start(apiobj.Command{Command: "true"}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := waitProcess(t, manager, processId, userid)
+		if status.State != apiobj.StateExited || *status.ExitCode != 0 || status.EndTime == nil {
+			t.Fatalf("%s unexpected status %+v", t.Name(), status)
+		}
+		if status.ID != processId || status.Owner != userid || status.Command != "true" || status.PID == 0 {
+			t.Fatalf("%s unexpected status %+v", t.Name(), status)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		processId, err := manager.Start(apiobj.Command{Command: shellScript(t, "exit 3")}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := waitProcess(t, manager, processId, userid)
+		if status.State != apiobj.StateFailed || *status.ExitCode != 3 {
+			t.Fatalf("%s unexpected status %+v", t.Name(), status)
+		}
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		processId, err := manager.Start(apiobj.Command{Command: "sleep 10"}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := manager.Status(processId, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != apiobj.StateRunning || status.ExitCode != nil || status.EndTime != nil {
+			t.Fatalf("%s unexpected status %+v", t.Name(), status)
+		}
+		if len(status.Args) != 1 || status.Args[0] != "10" {
+			t.Fatalf("%s unexpected args %v", t.Name(), status.Args)
+		}
+		err = manager.Stop(processId, userid, syscall.SIGKILL, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status = waitProcess(t, manager, processId, userid)
+		if status.State != apiobj.StateKilled || status.Signal != "SIGKILL" {
+			t.Fatalf("%s unexpected status %+v", t.Name(), status)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		list := manager.List(userid)
+		if len(list) != 3 {
+			t.Fatalf("%s unexpected list %+v", t.Name(), list)
+		}
+		for i := 1; i < len(list); i++ {
+			if list[i].StartTime.Before(list[i-1].StartTime) {
+				t.Fatalf("%s list not sorted", t.Name())
+			}
+		}
+	})
+}
+
+func TestStop(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	const userid = 1
+	manager.AddUser(userid)
+
+	tt := []struct {
+		name      string
+		command   string
+		signal    syscall.Signal
+		state     string
+		stoppedBy string
+	}{
+		{"graceful", "sleep 10", syscall.SIGTERM, apiobj.StateKilled, "SIGTERM"},
+		{"chosen signal", "sleep 10", syscall.SIGINT, apiobj.StateKilled, "SIGINT"},
+		{"trapped signal", shellScript(t, "trap 'exit 0' TERM\nwhile sleep 0.05; do :; done\n"), syscall.SIGTERM, apiobj.StateExited, "SIGTERM"},
+		{"escalation", shellScript(t, "trap '' TERM\nwhile sleep 0.05; do :; done\n"), syscall.SIGTERM, apiobj.StateKilled, "SIGKILL"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			processId, err := manager.Start(apiobj.Command{Command: tc.command}, userid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// let the shell install its trap
+			time.Sleep(time.Millisecond * 100)
+
+			err = manager.Stop(processId, userid, tc.signal, time.Millisecond*300)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := waitProcess(t, manager, processId, userid)
+			if status.State != tc.state || status.StoppedBy != tc.stoppedBy {
+				t.Fatalf("%s unexpected status %+v", tc.name, status)
+			}
+			if tc.state == apiobj.StateKilled && status.Signal != tc.stoppedBy {
+				t.Fatalf("%s unexpected signal %s", tc.name, status.Signal)
+			}
+
+			err = manager.Stop(processId, userid, tc.signal, 0)
+			if err == nil {
+				t.Fatalf("%s a terminated process cannot be stopped", tc.name)
+			}
+		})
+	}
+}
+
+// check that the process with the given pid has terminated
+// a zombie is terminated as well, it is only waiting for its new parent
+func processTerminated(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// the state follows the command name between parenthesis
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestProcessGroup(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	const userid = 1
+	manager.AddUser(userid)
+
+	tt := []struct {
+		name   string
+		script string
+		stop   bool
+	}{
+		{"stopped parent", "sleep 30 >/dev/null 2>&1 &\necho $!\nwait\n", true},
+		{"exited parent", "sleep 30 >/dev/null 2>&1 &\necho $!\n", false},
+		{"exited parent sharing the output", "sleep 30 &\necho $!\n", false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			processId, err := manager.Start(apiobj.Command{Command: shellScript(t, tc.script)}, userid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the first line is the pid of the grandchild
+			pid := 0
+			deadline := time.Now().Add(time.Second)
+			for pid == 0 && time.Now().Before(deadline) {
+				entries, err := logEntries(manager, processId, userid, Filter{Streams: Stdout})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) > 0 {
+					pid, _ = strconv.Atoi(strings.TrimSpace(string(entries[0].Data)))
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			if pid == 0 {
+				t.Fatalf("%s cannot read the grandchild pid", tc.name)
+			}
+
+			if tc.stop {
+				err = manager.Stop(processId, userid, syscall.SIGTERM, time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err = manager.Follow(ctx, processId, userid, Filter{}, discardEntries)
+			if err != nil {
+				t.Fatalf("%s the process has not terminated %v", tc.name, err)
+			}
+
+			deadline = time.Now().Add(time.Second)
+			for !processTerminated(pid) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond * 10)
+			}
+			if !processTerminated(pid) {
+				t.Fatalf("%s the grandchild %d survived", tc.name, pid)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	const userid = 1
+	manager.AddUser(userid)
+
+	running, err := manager.Start(apiobj.Command{Command: "sleep 30"}, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trapping, err := manager.Start(apiobj.Command{Command: shellScript(t, "trap '' TERM\nwhile sleep 0.05; do :; done\n")}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terminated, err := manager.Start(apiobj.Command{Command: "true"}, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitProcess(t, manager, terminated, userid)
+	// let the shell install its trap
+	time.Sleep(time.Millisecond * 100)
+
+	manager.Shutdown(time.Millisecond * 300)
+
+	status, err := manager.Status(running, userid)
+	if err != nil || status.State != apiobj.StateKilled || status.StoppedBy != "SIGTERM" {
+		t.Fatalf("unexpected status %+v %v", status, err)
+	}
+	status, err = manager.Status(trapping, 2)
+	if err != nil || status.State != apiobj.StateKilled || status.StoppedBy != "SIGKILL" {
+		t.Fatalf("unexpected status %+v %v", status, err)
+	}
+	_, err = manager.Start(apiobj.Command{Command: "true"}, userid)
+	if err == nil {
+		t.Fatal("no process can be started after the shutdown")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		manager := newTestManager(t, Config{})
+		_, err := manager.Start(apiobj.Command{Command: "true", Limits: &apiobj.Limits{MemoryMax: 1 << 20}}, 1)
+		if err == nil {
+			t.Fatalf("%s limits should be refused", t.Name())
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		manager := newTestManager(t, Config{RlimitFallback: true})
+		_, err := manager.Start(apiobj.Command{Command: "true", Limits: &apiobj.Limits{CPUWeight: 20000}}, 1)
+		if err == nil {
+			t.Fatalf("%s limits should be refused", t.Name())
+		}
+		// the kernel refuses a quota below 1000us
+		if err := validateLimits(apiobj.Limits{CPUQuota: 0.00999}); err == nil {
+			t.Fatal("a cpu quota below 1000us should be refused")
+		}
+		if err := validateLimits(apiobj.Limits{CPUQuota: 0.01}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("cgroups not available", func(t *testing.T) {
+		config := Config{CgroupRoot: filepath.Join(t.TempDir(), "cgroup")}
+		_, err := NewManager(config)
+		if err == nil {
+			t.Fatalf("%s should fail without fallback", t.Name())
+		}
+		config.RlimitFallback = true
+		_, err = NewManager(config)
+		if err != nil {
+			t.Fatalf("%s should fall back to rlimits %v", t.Name(), err)
+		}
+	})
+
+	t.Run("rlimits", func(t *testing.T) {
+		manager := newTestManager(t, Config{RlimitFallback: true})
+		const userid = 1
+		limits := &apiobj.Limits{MemoryMax: 64 << 20, CPUWeight: 50}
+		processId, err := manager.Start(apiobj.Command{Command: shellScript(t, "ulimit -v\nnice\n"), Limits: limits}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := waitProcess(t, manager, processId, userid)
+		if status.State != apiobj.StateExited {
+			t.Fatalf("%s unexpected status %+v", t.Name(), status)
+		}
+		entries, err := logEntries(manager, processId, userid, Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ulimit shows kilobytes
+		if str := entriesData(entries); str != "65536\n3\n" {
+			t.Fatalf("%s unexpected output %q", t.Name(), str)
+		}
+
+		_, err = manager.Start(apiobj.Command{Command: "true", Limits: &apiobj.Limits{CPUQuota: 0.5}}, userid)
+		if err == nil {
+			t.Fatalf("%s cpu quota cannot be enforced with rlimits", t.Name())
+		}
+		_, err = manager.Start(apiobj.Command{Command: "jadfadf", Limits: limits}, userid)
+		if err == nil {
+			t.Fatalf("%s should fail starting a no existing program", t.Name())
+		}
+	})
+
+	t.Run("job init failure", func(t *testing.T) {
+		_, err := Create(Options{Storage: new(memoryStorage), Cgroup: filepath.Join(t.TempDir(), "cgroup")}, "true")
+		if err == nil || !strings.Contains(err.Error(), "cgroup") {
+			t.Fatalf("%s should report the job init error %v", t.Name(), err)
+		}
+	})
+
+	t.Run("cgroups", func(t *testing.T) {
+		if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+			t.Skip("cgroup v2 is not mounted on /sys/fs/cgroup")
+		}
+		root := filepath.Join("/sys/fs/cgroup", fmt.Sprintf("interview-test-%d", os.Getpid()))
+		manager, err := NewManager(Config{CgroupRoot: root, AllowRoot: true})
+		if err != nil {
+			t.Skipf("cgroups are not writable %v", err)
+		}
+		defer os.Remove(root)
+
+		const userid = 1
+		limits := &apiobj.Limits{MemoryMax: 16 << 20, PidsMax: 8, CPUQuota: 0.5, CPUWeight: 50}
+		processId, err := manager.Start(apiobj.Command{Command: shellScript(t, "cat /proc/self/cgroup\nx=$(head -c 67108864 /dev/zero | tr '\\0' a)\n"), Limits: limits}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := waitProcess(t, manager, processId, userid)
+		if !status.OOMKilled {
+			t.Fatalf("%s the process should be killed by the oom killer %+v", t.Name(), status)
+		}
+		entries, err := logEntries(manager, processId, userid, Filter{Streams: Stdout})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str := entriesData(entries); !strings.Contains(str, processId) {
+			t.Fatalf("%s the process is not in its own cgroup %q", t.Name(), str)
+		}
+		if _, err := os.Stat(filepath.Join(root, processId)); err == nil {
+			t.Fatalf("%s the leaf has not been removed", t.Name())
+		}
+	})
+}
+
+func TestIsolation(t *testing.T) {
+	// pid 1, only its own tree in /proc, its own hostname and only loopback
+	script := "echo $$\n" +
+		"test $(ls -d /proc/[0-9]* | wc -l) -lt 10 && echo private\n" +
+		"cat /proc/sys/kernel/hostname\n" +
+		"tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '\n"
+	manager := newTestManager(t, Config{})
+	const userid = 1
+	processId, err := manager.Start(apiobj.Command{Command: shellScript(t, script), Isolation: &apiobj.Isolation{Enabled: true}}, userid)
+	if err != nil {
+		t.Skipf("namespaces are not available %v", err)
+	}
+	status := waitProcess(t, manager, processId, userid)
+	entries, err := logEntries(manager, processId, userid, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != apiobj.StateExited || !status.Isolated {
+		t.Fatalf("%s unexpected status %+v %q", t.Name(), status, entriesData(entries))
+	}
+	expected := fmt.Sprintf("1\nprivate\n%s\nlo\n", processId[:8])
+	if str := entriesData(entries); str != expected {
+		t.Fatalf("%s unexpected output %q instead of %q", t.Name(), str, expected)
+	}
+
+	t.Run("policy", func(t *testing.T) {
+		manager := newTestManager(t, Config{DefaultPolicy: Policy{RequireIsolation: true}})
+		processId, err := manager.Start(apiobj.Command{Command: "true"}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := waitProcess(t, manager, processId, userid); !status.Isolated {
+			t.Fatalf("%s the isolation is required by the policy %+v", t.Name(), status)
+		}
+		_, err = manager.Start(apiobj.Command{Command: "true", Isolation: &apiobj.Isolation{Enabled: true, Network: true}}, userid)
+		if err == nil {
+			t.Fatalf("%s the host network should be refused", t.Name())
+		}
+
+		manager.SetPolicy(userid, &Policy{AllowNetwork: true})
+		processId, err = manager.Start(apiobj.Command{Command: "true"}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := waitProcess(t, manager, processId, userid); status.Isolated {
+			t.Fatalf("%s the isolation is not required by the user policy %+v", t.Name(), status)
+		}
+		_, err = manager.Start(apiobj.Command{Command: "true", Isolation: &apiobj.Isolation{Enabled: true, Network: true}}, userid)
+		if err != nil {
+			t.Fatalf("%s the host network should be allowed %v", t.Name(), err)
+		}
+	})
+
+	t.Run("user namespace", func(t *testing.T) {
+		isolation := &apiobj.Isolation{Enabled: true, UserNamespace: true}
+		processId, err := manager.Start(apiobj.Command{Command: "id -u", Isolation: isolation}, userid)
+		if err != nil {
+			t.Skipf("user namespaces are not available %v", err)
+		}
+		waitProcess(t, manager, processId, userid)
+		entries, err := logEntries(manager, processId, userid, Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str := entriesData(entries); str != "0\n" {
+			t.Fatalf("%s unexpected output %q", t.Name(), str)
+		}
 	})
+}
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	manager := newTestManager(t, Config{DataDir: dir})
+	const userid = 1
+	manager.AddUser(userid)
+
+	exitedId, err := manager.Start(apiobj.Command{Command: "echo hello"}, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitProcess(t, manager, exitedId, userid)
+	runningId, err := manager.Start(apiobj.Command{Command: "sleep 100"}, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop(runningId, userid, syscall.SIGKILL, 0)
+
+	// a new manager on the same directory acts as the restarted server
+	// while the process of the crashed one is still running
+	restarted := newTestManager(t, Config{DataDir: dir})
+	if list := restarted.List(userid); len(list) != 2 {
+		t.Fatalf("the processes are not restored %+v", list)
+	}
+	status, err := restarted.Status(exitedId, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != apiobj.StateExited || status.ExitCode == nil || *status.ExitCode != 0 || status.EndTime == nil {
+		t.Fatalf("unexpected restored status %+v", status)
+	}
+	entries, err := logEntries(restarted, exitedId, userid, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := entriesData(entries); str != "hello\n" {
+		t.Fatalf("unexpected restored output %q", str)
+	}
+	err = restarted.Follow(context.Background(), exitedId, userid, Filter{}, discardEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = restarted.Status(runningId, userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != apiobj.StateLost || status.ExitCode != nil {
+		t.Fatalf("the running process should be lost %+v", status)
+	}
+	if err := restarted.Stop(runningId, userid, syscall.SIGTERM, 0); err == nil {
+		t.Fatal("a lost process cannot be stopped")
+	}
 
+	t.Run("partial line", func(t *testing.T) {
+		file, err := os.OpenFile(filepath.Join(dir, registryName), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteString(`{"id":"`)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		restarted := newTestManager(t, Config{DataDir: dir})
+		if list := restarted.List(userid); len(list) != 2 {
+			t.Fatalf("%s the processes are not restored %+v", t.Name(), list)
+		}
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	manager := newTestManager(t, Config{StopTimeout: time.Millisecond * 300})
+	const userid = 1
+	manager.AddUser(userid)
+
+	tt := []struct {
+		name    string
+		command string
+		timeout string
+		// deadline after the start, none if 0
+		deadline  time.Duration
+		stoppedBy string
+	}{
+		{"timeout", "sleep 10", "200ms", 0, "SIGTERM"},
+		{"deadline", "sleep 10", "", time.Millisecond * 200, "SIGTERM"},
+		{"earliest", "sleep 10", "1h", time.Millisecond * 200, "SIGTERM"},
+		{"escalation", shellScript(t, "trap '' TERM\nwhile sleep 0.05; do :; done\n"), "200ms", 0, "SIGKILL"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			command := apiobj.Command{Command: tc.command, Timeout: tc.timeout}
+			if tc.deadline != 0 {
+				deadline := time.Now().Add(tc.deadline)
+				command.Deadline = &deadline
+			}
+			processId, err := manager.Start(command, userid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := waitProcess(t, manager, processId, userid)
+			if status.State != apiobj.StateTimedOut || status.StoppedBy != tc.stoppedBy || status.Deadline == nil {
+				t.Fatalf("%s unexpected status %+v", tc.name, status)
+			}
+		})
+	}
+
+	t.Run("terminated before", func(t *testing.T) {
+		processId, err := manager.Start(apiobj.Command{Command: "true", Timeout: "1s"}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := waitProcess(t, manager, processId, userid); status.State != apiobj.StateExited {
+			t.Fatalf("%s unexpected status %+v", t.Name(), status)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		past := time.Now().Add(-time.Second)
+		for _, command := range []apiobj.Command{
+			{Command: "true", Timeout: "ten seconds"},
+			{Command: "true", Timeout: "-1s"},
+			{Command: "true", Deadline: &past},
+		} {
+			if _, err := manager.Start(command, userid); err == nil {
+				t.Fatalf("%s %+v should be refused", t.Name(), command)
+			}
+		}
+	})
+}
+
+func TestArgv(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	const userid = 1
+	manager.AddUser(userid)
+
+	tt := []struct {
+		name    string
+		command apiobj.Command
+		output  string
+	}{
+		{"string", apiobj.Command{Command: "echo a  b"}, "a b\n"},
+		{"argv", apiobj.Command{Argv: []string{"echo", "a  b", "'c'"}}, "a  b 'c'\n"},
+		{"shell string", apiobj.Command{Command: "echo a | tr a b > /dev/stderr", Shell: true}, "b\n"},
+		{"shell argv", apiobj.Command{Argv: []string{`echo "$1" $#`, "a  b"}, Shell: true}, "a  b 1\n"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			processId, err := manager.Start(tc.command, userid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := waitProcess(t, manager, processId, userid)
+			entries, err := logEntries(manager, processId, userid, Filter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if str := entriesData(entries); status.State != apiobj.StateExited || str != tc.output {
+				t.Fatalf("%s unexpected output %q %+v", tc.name, str, status)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, command := range []apiobj.Command{
+			{},
+			{Argv: []string{""}},
+			{Argv: []string{"", "a"}, Shell: true},
+			{Command: "echo", Argv: []string{"echo"}},
+		} {
+			if _, err := manager.Start(command, userid); err == nil {
+				t.Fatalf("%s %+v should be refused", t.Name(), command)
+			}
+		}
+	})
+}
+
+func TestEnvironment(t *testing.T) {
+	manager := newTestManager(t, Config{RlimitFallback: true})
+	const userid = 1
+	manager.AddUser(userid)
+
+	dir := t.TempDir()
+	tt := []struct {
+		name    string
+		command apiobj.Command
+		output  string
+	}{
+		{"env", apiobj.Command{Argv: []string{"sh", "-c", "echo $FOO"}, Env: []string{"FOO=bar"}}, "bar\n"},
+		{"clean env", apiobj.Command{Argv: []string{"env"}, Env: []string{"FOO=bar"}, CleanEnv: true}, "FOO=bar\n"},
+		{"clean env job init", apiobj.Command{Argv: []string{"env"}, CleanEnv: true, Limits: &apiobj.Limits{PidsMax: 8}}, ""},
+		{"cwd", apiobj.Command{Argv: []string{"pwd"}, Cwd: dir}, dir + "\n"},
+		{"cwd job init", apiobj.Command{Argv: []string{"pwd"}, Cwd: dir, Limits: &apiobj.Limits{PidsMax: 8}}, dir + "\n"},
+		{"stdin", apiobj.Command{Argv: []string{"tr", "a", "b"}, Stdin: []byte("aaa\n")}, "bbb\n"},
+		{"stdin job init", apiobj.Command{Argv: []string{"tr", "a", "b"}, Stdin: []byte("aaa\n"), Limits: &apiobj.Limits{PidsMax: 8}}, "bbb\n"},
+		{"stdin not read", apiobj.Command{Argv: []string{"true"}, Stdin: make([]byte, 1<<20)}, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			processId, err := manager.Start(tc.command, userid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := waitProcess(t, manager, processId, userid)
+			entries, err := logEntries(manager, processId, userid, Filter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if str := entriesData(entries); status.State != apiobj.StateExited || str != tc.output {
+				t.Fatalf("%s unexpected output %q %+v", tc.name, str, status)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, command := range []apiobj.Command{
+			{Argv: []string{"true"}, Env: []string{"FOO"}},
+			{Argv: []string{"true"}, Env: []string{"=bar"}},
+			{Argv: []string{"true"}, Cwd: "relative"},
+			{Argv: []string{"true"}, Cwd: filepath.Join(dir, "missing")},
+		} {
+			if _, err := manager.Start(command, userid); err == nil {
+				t.Fatalf("%s %+v should be refused", t.Name(), command)
+			}
+		}
+	})
+}
+
+func TestCredential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the user requires root")
+	}
+	const userid = 1
+	const nobody = 65534
+
+	t.Run("root refused", func(t *testing.T) {
+		manager, err := NewManager(Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = manager.Start(apiobj.Command{Argv: []string{"true"}}, userid)
+		if err == nil {
+			t.Fatalf("%s root should be refused", t.Name())
+		}
+		manager.SetCredential(userid, &Credential{Uid: nobody, Gid: nobody})
+		_, err = manager.Start(apiobj.Command{Argv: []string{"true"}}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the credential removed from the registry
+		manager.SetCredential(userid, nil)
+		_, err = manager.Start(apiobj.Command{Argv: []string{"true"}}, userid)
+		if err == nil {
+			t.Fatalf("%s root should be refused once the credential is cleared", t.Name())
+		}
+	})
+
+	manager := newTestManager(t, Config{RlimitFallback: true})
+	manager.SetCredential(userid, &Credential{Uid: nobody, Gid: nobody, Groups: []uint32{nobody - 1}})
+	script := []string{"sh", "-c", "id -u; id -g; id -G"}
+	tt := []struct {
+		name    string
+		command apiobj.Command
+		output  string
+	}{
+		{"exec", apiobj.Command{Argv: script}, "65534\n65534\n65534 65533\n"},
+		{"job init", apiobj.Command{Argv: script, Limits: &apiobj.Limits{CPUWeight: 50}}, "65534\n65534\n65534 65533\n"},
+		{"isolated", apiobj.Command{Argv: script, Isolation: &apiobj.Isolation{Enabled: true}}, "65534\n65534\n65534 65533\n"},
+		{"user namespace", apiobj.Command{Argv: []string{"sh", "-c", "id -G; cat /proc/self/uid_map"}, Isolation: &apiobj.Isolation{Enabled: true, UserNamespace: true}}, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			processId, err := manager.Start(tc.command, userid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := waitProcess(t, manager, processId, userid)
+			entries, err := logEntries(manager, processId, userid, Filter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			str := entriesData(entries)
+			if tc.output == "" {
+				// root inside mapped to the credential outside without the server groups
+				fields := strings.Fields(str)
+				if len(fields) != 4 || fields[0] != "0" || fields[1] != "0" || fields[2] != "65534" {
+					t.Fatalf("%s unexpected output %q %+v", tc.name, str, status)
+				}
+				return
+			}
+			if status.State != apiobj.StateExited || str != tc.output {
+				t.Fatalf("%s unexpected output %q %+v", tc.name, str, status)
+			}
+		})
+	}
+}
+
+// the registry is reloaded while the server runs
+// adding users concurrently with the requests of the others
+func TestAddUser(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	manager.AddUser(1)
+	id, err := manager.Start(apiobj.Command{Argv: []string{"true"}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for userid := 2; userid < 50; userid++ {
+				manager.AddUser(userid)
+				manager.AddUser(1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				manager.getPolicy(1)
+				if len(manager.List(1)) != 1 {
+					t.Error("the process of the user is lost")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// adding an existing user keeps its processes
+	if _, err := manager.Status(id, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	manager.AddUser(1)
+	manager.AddUser(2)
+	manager.AddUser(3)
+
+	ids := []string{}
+	for _, userid := range []int{1, 2, 3} {
+		command := apiobj.Command{Argv: []string{"true"}}
+		if userid == 2 {
+			command.Namespace = "team"
+		}
+		id, err := manager.Start(command, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	for i, id := range ids {
+		status, err := manager.Lookup(id)
+		if err != nil || status.Owner != i+1 {
+			t.Fatalf("unexpected owner %d of %s %v", status.Owner, id, err)
+		}
+	}
+	if _, err := manager.Lookup("95bf5b81-74bc-47e7-8622-e2aace3e866f"); err == nil {
+		t.Fatal("unknown process found")
+	}
+
+	tt := []struct {
+		name  string
+		match func(apiobj.ProcessStatus) bool
+		ids   []string
+	}{
+		{"every process", nil, ids},
+		{"some users", func(status apiobj.ProcessStatus) bool { return status.Owner != 2 }, []string{ids[0], ids[2]}},
+		{"namespace", func(status apiobj.ProcessStatus) bool { return status.Namespace == "team" }, []string{ids[1]}},
+		{"none", func(apiobj.ProcessStatus) bool { return false }, []string{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			listed := []string{}
+			for _, status := range manager.ListMatching(tc.match) {
+				listed = append(listed, status.ID)
+			}
+			if strings.Join(listed, ",") != strings.Join(tc.ids, ",") {
+				t.Fatalf("listed %v instead of %v", listed, tc.ids)
+			}
+		})
+	}
+}
+
+func TestQuota(t *testing.T) {
+	startQuota := func(t *testing.T, manager *Manager, command apiobj.Command, userid int) string {
+		t.Helper()
+		id, err := manager.Start(command, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	refused := func(t *testing.T, manager *Manager, userid int) {
+		t.Helper()
+		_, err := manager.Start(apiobj.Command{Argv: []string{"true"}}, userid)
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("the quota is not enforced %v", err)
+		}
+	}
+
+	t.Run("negative", func(t *testing.T) {
+		_, err := NewManager(Config{DefaultQuota: apiobj.Quota{MaxRunning: -1}})
+		if err == nil {
+			t.Fatal("negative quota accepted")
+		}
+	})
+
+	t.Run("running", func(t *testing.T) {
+		manager := newTestManager(t, Config{DefaultQuota: apiobj.Quota{MaxRunning: 2}})
+		manager.AddUser(1)
+		manager.AddUser(2)
+		ids := []string{}
+		for i := 0; i < 2; i++ {
+			ids = append(ids, startQuota(t, manager, apiobj.Command{Command: "sleep 100"}, 1))
+		}
+		refused(t, manager, 1)
+		// the quota is per user
+		waitProcess(t, manager, startQuota(t, manager, apiobj.Command{Command: "true"}, 2), 2)
+
+		if usage := manager.Usage(1); usage.Running != 2 || usage.Processes != 2 || usage.Quota.MaxRunning != 2 {
+			t.Fatalf("unexpected usage %+v", usage)
+		}
+		if err := manager.Stop(ids[0], 1, syscall.SIGKILL, 0); err != nil {
+			t.Fatal(err)
+		}
+		waitProcess(t, manager, ids[0], 1)
+		id := startQuota(t, manager, apiobj.Command{Command: "sleep 100"}, 1)
+		for _, id := range []string{ids[1], id} {
+			_ = manager.Stop(id, 1, syscall.SIGKILL, 0)
+		}
+	})
+
+	t.Run("processes", func(t *testing.T) {
+		manager := newTestManager(t, Config{})
+		manager.AddUser(1)
+		manager.SetQuota(1, &apiobj.Quota{MaxProcesses: 2})
+		for i := 0; i < 2; i++ {
+			waitProcess(t, manager, startQuota(t, manager, apiobj.Command{Command: "true"}, 1), 1)
+		}
+		refused(t, manager, 1)
+		// back to the default quota without limits
+		manager.SetQuota(1, nil)
+		startQuota(t, manager, apiobj.Command{Command: "true"}, 1)
+	})
+
+	t.Run("output", func(t *testing.T) {
+		manager := newTestManager(t, Config{MaxOutputSize: 1000, DefaultQuota: apiobj.Quota{MaxOutputBytes: 100}})
+		manager.AddUser(1)
+		id := startQuota(t, manager, apiobj.Command{Command: "head -c 1000 /dev/zero"}, 1)
+		waitProcess(t, manager, id, 1)
+		entries, err := logEntries(manager, id, 1, Filter{Streams: Stdout})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entriesData(entries)) == 0 {
+			t.Fatal("no output stored")
+		}
+		// the output limit of the process is what is left of the quota
+		if usage := manager.Usage(1); usage.OutputBytes != 100 {
+			t.Fatalf("unexpected usage %+v", usage)
+		}
+		refused(t, manager, 1)
+	})
+
+	t.Run("output headers", func(t *testing.T) {
+		dir := t.TempDir()
+		manager := newTestManager(t, Config{DataDir: dir, DefaultQuota: apiobj.Quota{MaxOutputBytes: 200}})
+		manager.AddUser(1)
+		// the headers of short lines are bigger than their data
+		id := startQuota(t, manager, apiobj.Command{Command: "seq 1000"}, 1)
+		waitProcess(t, manager, id, 1)
+		info, err := os.Stat(filepath.Join(dir, id+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage := manager.Usage(1); info.Size() > 200 || usage.OutputBytes != info.Size() {
+			t.Fatalf("%d bytes stored for a quota of 200 %+v", info.Size(), usage)
+		}
+		refused(t, manager, 1)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		dir := t.TempDir()
+		manager := newTestManager(t, Config{DataDir: dir})
+		manager.AddUser(1)
+		manager.SetQuota(1, &apiobj.Quota{MaxProcesses: 1, MaxOutputBytes: 100})
+		id := startQuota(t, manager, apiobj.Command{Command: "head -c 1000 /dev/zero"}, 1)
+		waitProcess(t, manager, id, 1)
+		if usage := manager.Usage(1); usage.Processes != 1 || usage.OutputBytes < 100 {
+			t.Fatalf("unexpected usage %+v", usage)
+		}
+		refused(t, manager, 1)
+
+		if err := manager.Remove(id, 1); err != nil {
+			t.Fatal(err)
+		}
+		if usage := manager.Usage(1); usage.Processes != 0 || usage.OutputBytes != 0 {
+			t.Fatalf("the removed process is still counted %+v", usage)
+		}
+		if _, err := manager.Status(id, 1); err == nil {
+			t.Fatal("the removed process still exists")
+		}
+		if _, err := os.Stat(filepath.Join(dir, id+".log")); !os.IsNotExist(err) {
+			t.Fatalf("the output of the removed process is still stored %v", err)
+		}
+		if err := manager.Remove(id, 1); err == nil {
+			t.Fatal("the process is removed twice")
+		}
+
+		running := startQuota(t, manager, apiobj.Command{Command: "sleep 100"}, 1)
+		if err := manager.Remove(running, 1); err == nil {
+			t.Fatal("a running process is removed")
+		}
+		if err := manager.Stop(running, 1, syscall.SIGKILL, 0); err != nil {
+			t.Fatal(err)
+		}
+		waitProcess(t, manager, running, 1)
+
+		// the removed process is not restored
+		restarted := newTestManager(t, Config{DataDir: dir})
+		if list := restarted.List(1); len(list) != 1 || list[0].ID != running {
+			t.Fatalf("unexpected processes after a restart %+v", list)
+		}
+	})
+
+	t.Run("cpu", func(t *testing.T) {
+		dir := t.TempDir()
+		manager := newTestManager(t, Config{DataDir: dir})
+		manager.AddUser(1)
+		id := startQuota(t, manager, apiobj.Command{Command: "while :; do :; done", Shell: true, Timeout: "300ms"}, 1)
+		time.Sleep(100 * time.Millisecond)
+		if usage := manager.Usage(1); usage.CPUSeconds <= 0 {
+			t.Fatalf("the cpu time of the running process is not counted %+v", usage)
+		}
+		status := waitProcess(t, manager, id, 1)
+		if status.CPUSeconds < 0.1 {
+			t.Fatalf("unexpected cpu time %+v", status)
+		}
+		manager.SetQuota(1, &apiobj.Quota{CPUSecondsPerDay: status.CPUSeconds / 2})
+		refused(t, manager, 1)
+
+		// the cpu time survives a restart
+		restarted := newTestManager(t, Config{DataDir: dir, DefaultQuota: apiobj.Quota{CPUSecondsPerDay: status.CPUSeconds / 2}})
+		if usage := restarted.Usage(1); usage.CPUSeconds != status.CPUSeconds {
+			t.Fatalf("unexpected usage after a restart %+v", usage)
+		}
+		refused(t, restarted, 1)
+	})
+}
+
+func TestQueue(t *testing.T) {
+	// wait until the process reaches the state
+	waitState := func(t *testing.T, manager *Manager, id string, userid int, state string) apiobj.ProcessStatus {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			status, err := manager.Status(id, userid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.State == state {
+				return status
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("the process %s is not %s", id, state)
+		return apiobj.ProcessStatus{}
+	}
+	sleep := apiobj.Command{Command: "sleep 100"}
+
+	t.Run("server limit", func(t *testing.T) {
+		manager := newTestManager(t, Config{MaxConcurrent: 2})
+		manager.AddUser(1)
+		manager.AddUser(2)
+		defer manager.Shutdown(time.Second)
+		ids := []string{}
+		for i := 0; i < 4; i++ {
+			id, err := manager.Start(sleep, 1+i%2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		// the user 2 started its running process later, it used less slot time and goes first
+		positions := []int{0, 0, 2, 1}
+		for i, id := range ids {
+			status, err := manager.Status(id, 1+i%2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i < 2 && (status.State != apiobj.StateRunning || status.QueuePosition != 0) {
+				t.Fatalf("the process %d should be running %+v", i, status)
+			}
+			if i >= 2 && (status.State != apiobj.StatePending || status.QueuePosition != positions[i] || status.PID != 0) {
+				t.Fatalf("the process %d should be pending %+v", i, status)
+			}
+		}
+
+		// a cancelled process never runs and leaves the queue
+		if err := manager.Stop(ids[2], 1, syscall.SIGTERM, 0); err != nil {
+			t.Fatal(err)
+		}
+		status := waitProcess(t, manager, ids[2], 1)
+		if status.State != apiobj.StateCancelled || status.ExitCode != nil || status.EndTime == nil {
+			t.Fatalf("unexpected cancelled process %+v", status)
+		}
+		if status := waitState(t, manager, ids[3], 2, apiobj.StatePending); status.QueuePosition != 1 {
+			t.Fatalf("unexpected queue position %+v", status)
+		}
+
+		// the first in the queue starts when a slot frees up
+		if err := manager.Stop(ids[0], 1, syscall.SIGKILL, 0); err != nil {
+			t.Fatal(err)
+		}
+		status = waitState(t, manager, ids[3], 2, apiobj.StateRunning)
+		if status.PID == 0 || status.QueuePosition != 0 {
+			t.Fatalf("unexpected started process %+v", status)
+		}
+	})
+
+	t.Run("user limit", func(t *testing.T) {
+		manager := newTestManager(t, Config{MaxConcurrentPerUser: 1})
+		manager.AddUser(1)
+		manager.AddUser(2)
+		defer manager.Shutdown(time.Second)
+		first, err := manager.Start(apiobj.Command{Command: "echo first"}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := manager.Start(apiobj.Command{Command: "echo second"}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the queue of a user does not hold back the others
+		other, err := manager.Start(sleep, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitState(t, manager, other, 2, apiobj.StateRunning)
+
+		waitProcess(t, manager, first, 1)
+		// following a pending process waits for it to run
+		status := waitProcess(t, manager, second, 1)
+		if status.State != apiobj.StateExited {
+			t.Fatalf("the queued process did not run %+v", status)
+		}
+		entries, err := logEntries(manager, second, 1, Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str := entriesData(entries); str != "second\n" {
+			t.Fatalf("unexpected output %q", str)
+		}
+	})
+
+	t.Run("deadline and shutdown", func(t *testing.T) {
+		manager := newTestManager(t, Config{MaxConcurrent: 1})
+		manager.AddUser(1)
+		running, err := manager.Start(apiobj.Command{Command: "sleep 0.3"}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expiring, err := manager.Start(apiobj.Command{Command: "true", Timeout: "100ms"}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := manager.Start(apiobj.Command{Command: "nonexistent-command"}, 1); err == nil {
+			t.Fatal("a missing command is queued")
+		}
+		waitProcess(t, manager, running, 1)
+		if status := waitProcess(t, manager, expiring, 1); status.State != apiobj.StateTimedOut || status.PID != 0 {
+			t.Fatalf("the deadline passed while pending %+v", status)
+		}
+
+		blocking, err := manager.Start(sleep, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending, err := manager.Start(sleep, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.Shutdown(time.Second)
+		for _, id := range []string{blocking, pending} {
+			status, err := manager.Status(id, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id == pending && status.State != apiobj.StateCancelled {
+				t.Fatalf("the pending process is not cancelled on shutdown %+v", status)
+			}
+			if id == blocking && status.State != apiobj.StateKilled {
+				t.Fatalf("the running process is not stopped on shutdown %+v", status)
+			}
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		if _, err := NewManager(Config{MaxConcurrent: -1}); err == nil {
+			t.Fatal("negative concurrency limit accepted")
+		}
+	})
+}
+
+// user of the scheduler simulation
+type simUser struct {
+	share int
+	// jobs submitted at the tick submit each running for duration ticks
+	jobs     int
+	duration int
+	submit   int
+	// priority of each job, normal if nil
+	priorities []string
+}
+
+// outcome of the scheduler simulation for each user
+type simResult struct {
+	// running ticks of the jobs, the share of the slots they got
+	usage []int
+	// tick the first job started, -1 if none did
+	firstStart []int
+	// most jobs running at the same time
+	maxRunning []int
+	// priorities of the jobs in the order they started
+	started [][]string
+}
+
+// run the users jobs through a scheduler for the ticks
+// on every tick the terminated jobs release their slots
+// and the scheduler starts the pending ones
+// it checks on every tick that the limits hold, that no slot stays free
+// while a job could use it and that the first queue position starts next
+func simulate(t *testing.T, slots int, perUser int, users []simUser, ticks int) simResult {
+	t.Helper()
+	scheduler := newScheduler(slots, perUser)
+	result := simResult{
+		usage:      make([]int, len(users)),
+		firstStart: make([]int, len(users)),
+		maxRunning: make([]int, len(users)),
+		started:    make([][]string, len(users)),
+	}
+	priority := make(map[*queuedJob]string)
+	for i, user := range users {
+		scheduler.setShare(i, user.share)
+		result.firstStart[i] = -1
+	}
+	// tick each running job terminates
+	type runningJob struct {
+		owner int
+		end   int
+	}
+	running := []runningJob{}
+
+	for tick := 0; tick < ticks; tick++ {
+		scheduler.advance(time.Unix(int64(tick), 0))
+		for i, user := range users {
+			if user.submit != tick {
+				continue
+			}
+			for j := 0; j < user.jobs; j++ {
+				jobPriority := apiobj.PriorityNormal
+				if user.priorities != nil {
+					jobPriority = user.priorities[j]
+				}
+				priority[scheduler.push(nil, i, jobPriority)] = jobPriority
+			}
+		}
+		stillRunning := running[:0]
+		for _, job := range running {
+			if job.end == tick {
+				scheduler.release(job.owner)
+			} else {
+				stillRunning = append(stillRunning, job)
+			}
+		}
+		running = stillRunning
+
+		for {
+			// only the head of a queue can be the first
+			// computing the positions is slow, they are checked every few ticks
+			first := (*queuedJob)(nil)
+			for _, queue := range scheduler.queues {
+				if tick%10 == 0 && scheduler.position(queue[0]) == 1 {
+					first = queue[0]
+				}
+			}
+			job := scheduler.next()
+			if job == nil {
+				break
+			}
+			if tick%10 == 0 && perUser == 0 && job != first {
+				t.Fatalf("tick %d: the job %d of user %d started instead of the first in the queue", tick, job.seq, job.owner)
+			}
+			running = append(running, runningJob{owner: job.owner, end: tick + users[job.owner].duration})
+			result.started[job.owner] = append(result.started[job.owner], priority[job])
+			if result.firstStart[job.owner] == -1 {
+				result.firstStart[job.owner] = tick
+			}
+		}
+
+		if slots > 0 && scheduler.running > slots {
+			t.Fatalf("tick %d: %d jobs running over %d slots", tick, scheduler.running, slots)
+		}
+		for owner, queue := range scheduler.queues {
+			if perUser > 0 && scheduler.userRunning[owner] > perUser {
+				t.Fatalf("tick %d: user %d runs %d jobs over its limit", tick, owner, scheduler.userRunning[owner])
+			}
+			if len(queue) > 0 && scheduler.hasSlot(owner) {
+				t.Fatalf("tick %d: a slot is free while user %d has pending jobs", tick, owner)
+			}
+		}
+		for owner := range users {
+			result.usage[owner] += scheduler.userRunning[owner]
+			if scheduler.userRunning[owner] > result.maxRunning[owner] {
+				result.maxRunning[owner] = scheduler.userRunning[owner]
+			}
+		}
+	}
+	return result
+}
+
+// check the usage of each user is proportional to its share within tolerance
+func checkShares(t *testing.T, users []simUser, usage []int, tolerance float64) {
+	t.Helper()
+	total, shares := 0, 0
+	for i, user := range users {
+		total += usage[i]
+		shares += user.share
+	}
+	for i, user := range users {
+		expected := float64(total) * float64(user.share) / float64(shares)
+		if diff := float64(usage[i]) - expected; diff > expected*tolerance || -diff > expected*tolerance {
+			t.Fatalf("user %d used %d slot ticks instead of about %.0f %v", i, usage[i], expected, usage)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	t.Run("equal shares", func(t *testing.T) {
+		users := []simUser{}
+		for i := 0; i < 10; i++ {
+			// the first users submit first and the jobs last differently
+			users = append(users, simUser{share: 1, jobs: 500, duration: 1 + i%4, submit: i})
+		}
+		result := simulate(t, 8, 0, users, 500)
+		checkShares(t, users, result.usage, 0.05)
+	})
+
+	t.Run("weighted shares", func(t *testing.T) {
+		users := []simUser{
+			{share: 1, jobs: 1000, duration: 2},
+			{share: 2, jobs: 1000, duration: 3},
+			{share: 5, jobs: 5000, duration: 1},
+		}
+		result := simulate(t, 16, 0, users, 400)
+		checkShares(t, users, result.usage, 0.05)
+	})
+
+	t.Run("light user", func(t *testing.T) {
+		users := []simUser{
+			{share: 1, jobs: 5000, duration: 5},
+			{share: 1, jobs: 5000, duration: 5},
+			{share: 1, jobs: 1, duration: 5, submit: 50},
+		}
+		result := simulate(t, 4, 0, users, 100)
+		// the next free slot goes to the user without running jobs
+		if wait := result.firstStart[2] - 50; wait < 0 || wait > 5 {
+			t.Fatalf("the light user waited %d ticks behind the heavy ones", wait)
+		}
+	})
+
+	t.Run("idle user", func(t *testing.T) {
+		// the slots of a user without jobs go to the others
+		users := []simUser{
+			{share: 1, jobs: 1000, duration: 1},
+			{share: 100, jobs: 0, duration: 1},
+		}
+		result := simulate(t, 4, 0, users, 100)
+		if result.usage[0] != 400 {
+			t.Fatalf("the only busy user got %d slot ticks instead of 400", result.usage[0])
+		}
+	})
+
+	t.Run("user limit", func(t *testing.T) {
+		users := []simUser{
+			{share: 10, jobs: 100, duration: 3},
+			{share: 1, jobs: 100, duration: 3},
+			{share: 1, jobs: 100, duration: 3},
+		}
+		result := simulate(t, 10, 2, users, 100)
+		for i, running := range result.maxRunning {
+			if running != 2 {
+				t.Fatalf("user %d ran up to %d jobs instead of 2", i, running)
+			}
+		}
+	})
+
+	t.Run("priorities", func(t *testing.T) {
+		order := []string{
+			apiobj.PriorityLow, apiobj.PriorityNormal, apiobj.PriorityHigh,
+			apiobj.PriorityNormal, apiobj.PriorityHigh, apiobj.PriorityLow,
+		}
+		users := []simUser{
+			{share: 1, jobs: len(order), duration: 1, priorities: order},
+			// a user with high priority jobs does not take the slots of the other
+			{share: 1, jobs: 100, duration: 1, submit: 0, priorities: repeatPriority(apiobj.PriorityHigh, 100)},
+		}
+		result := simulate(t, 2, 0, users, 20)
+		started := strings.Join(result.started[0], ",")
+		if started != "high,high,normal,normal,low,low" {
+			t.Fatalf("unexpected start order %s", started)
+		}
+		// a slot each while both have jobs, then both to the high priority user
+		if result.usage[1] != 6+14*2 {
+			t.Fatalf("the high priority user got %d slot ticks instead of 34", result.usage[1])
+		}
+	})
+}
+
+func repeatPriority(priority string, n int) []string {
+	priorities := make([]string, n)
+	for i := range priorities {
+		priorities[i] = priority
+	}
+	return priorities
+}
+
+func TestCron(t *testing.T) {
+	from := time.Date(2026, 1, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expression string
+		from       time.Time
+		next       time.Time
+	}{
+		{"*/15 * * * *", from, time.Date(2026, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 0 * * *", from, time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", from, time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", from, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", from, time.Date(2026, 1, 1, 10, 25, 0, 0, time.UTC)},
+		{"7 10 * * *", from, time.Date(2026, 1, 2, 10, 7, 0, 0, time.UTC)},
+		// the 1st of january 2026 is a thursday
+		{"30 9 * * mon-fri", time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 5, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", from, time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		// either the day of the month or the day of the week
+		{"0 12 1 * sun", time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC), time.Date(2026, 1, 4, 12, 0, 0, 0, time.UTC)},
+		{"0 0 * jan,JUL *", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", from, time.Time{}},
+	}
+	for _, test := range tests {
+		spec, err := parseCron(test.expression)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expression, err)
+		}
+		if next := spec.next(test.from); !next.Equal(test.next) {
+			t.Fatalf("%s: next run at %s instead of %s", test.expression, next, test.next)
+		}
+	}
+
+	for _, expression := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "* * * foo *", "@often"} {
+		if _, err := parseCron(expression); err == nil {
+			t.Fatalf("invalid expression %q accepted", expression)
+		}
+	}
+}
+
+// wait until the schedule has recorded n runs
+func waitRuns(t *testing.T, manager *Manager, id string, n int) apiobj.Schedule {
+	for i := 0; i < 250; i++ {
+		schedule, err := manager.LookupSchedule(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(schedule.Runs) >= n {
+			return schedule
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("the schedule %s has not run %d times", id, n)
+	return apiobj.Schedule{}
+}
+
+func TestSchedule(t *testing.T) {
+	const userid = 1
+	sleep := apiobj.Command{Command: "sleep 100"}
+	yearly := func(overlap string) apiobj.Schedule {
+		return apiobj.Schedule{Cron: "@yearly", Overlap: overlap, Command: sleep}
+	}
+
+	t.Run("run at", func(t *testing.T) {
+		manager := newTestManager(t, Config{})
+		manager.AddUser(userid)
+		defer manager.Shutdown(time.Second)
+		at := time.Now().Add(100 * time.Millisecond)
+		schedule, err := manager.CreateSchedule(apiobj.Schedule{RunAt: &at, Command: apiobj.Command{Command: "echo hello"}}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if schedule.ID == "" || schedule.Owner != userid || schedule.Overlap != apiobj.OverlapSkip || schedule.NextRun == nil || !schedule.NextRun.Equal(at) {
+			t.Fatalf("unexpected schedule %+v", schedule)
+		}
+		schedule = waitRuns(t, manager, schedule.ID, 1)
+		run := schedule.Runs[0]
+		if run.Outcome != apiobj.RunStarted || !run.Time.Equal(at) || schedule.NextRun != nil {
+			t.Fatalf("unexpected run %+v of %+v", run, schedule)
+		}
+		status := waitProcess(t, manager, run.ProcessID, userid)
+		if status.State != apiobj.StateExited {
+			t.Fatalf("unexpected process of the run %+v", status)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		manager := newTestManager(t, Config{})
+		manager.AddUser(userid)
+		defer manager.Shutdown(time.Second)
+		past := time.Now().Add(-time.Minute)
+		future := time.Now().Add(time.Hour)
+		for _, schedule := range []apiobj.Schedule{
+			{Command: sleep},
+			{Cron: "@daily", RunAt: &future, Command: sleep},
+			{RunAt: &past, Command: sleep},
+			{Cron: "* * *", Command: sleep},
+			{Cron: "0 0 30 2 *", Command: sleep},
+			{Cron: "@daily", Overlap: "wait", Command: sleep},
+			{Cron: "@daily", Command: apiobj.Command{Command: "sleep 1", Deadline: &future}},
+			{Cron: "@daily", Command: apiobj.Command{Command: "sleep 1", Priority: "urgent"}},
+			{Cron: "@daily", Command: apiobj.Command{Command: " "}},
+			{Cron: "@daily", Command: apiobj.Command{Command: "pwd", Cwd: "tmp"}},
+		} {
+			if _, err := manager.CreateSchedule(schedule, userid); err == nil {
+				t.Fatalf("invalid schedule %+v accepted", schedule)
+			}
+		}
+		if list := manager.ListSchedules(nil); len(list) != 0 {
+			t.Fatalf("invalid schedules created %+v", list)
+		}
+	})
+
+	t.Run("overlap", func(t *testing.T) {
+		manager := newTestManager(t, Config{StopTimeout: 300 * time.Millisecond})
+		manager.AddUser(userid)
+		defer manager.Shutdown(time.Second)
+		fire := func(t *testing.T, id string) {
+			s, err := manager.getSchedule(id, userid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manager.fire(s, time.Now())
+		}
+
+		schedule, err := manager.CreateSchedule(yearly(apiobj.OverlapSkip), userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fire(t, schedule.ID)
+		fire(t, schedule.ID)
+		schedule = waitRuns(t, manager, schedule.ID, 2)
+		first := schedule.Runs[0]
+		if first.Outcome != apiobj.RunStarted || schedule.Runs[1].Outcome != apiobj.RunSkipped || !strings.Contains(schedule.Runs[1].Error, first.ProcessID) {
+			t.Fatalf("the run is not skipped %+v", schedule.Runs)
+		}
+		if err := manager.Stop(first.ProcessID, userid, syscall.SIGKILL, 0); err != nil {
+			t.Fatal(err)
+		}
+		waitProcess(t, manager, first.ProcessID, userid)
+		fire(t, schedule.ID)
+		if schedule = waitRuns(t, manager, schedule.ID, 3); schedule.Runs[2].Outcome != apiobj.RunStarted {
+			t.Fatalf("the run after the previous terminated is not started %+v", schedule.Runs)
+		}
+
+		schedule, err = manager.CreateSchedule(yearly(apiobj.OverlapQueue), userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fire(t, schedule.ID)
+		fire(t, schedule.ID)
+		// a single run waits, the next ones are skipped
+		fire(t, schedule.ID)
+		schedule = waitRuns(t, manager, schedule.ID, 2)
+		first = schedule.Runs[0]
+		if len(schedule.Runs) != 2 || schedule.Runs[1].Outcome != apiobj.RunSkipped {
+			t.Fatalf("a second run is waiting %+v", schedule.Runs)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if status, _ := manager.Status(first.ProcessID, userid); status.State != apiobj.StateRunning {
+			t.Fatalf("the queued run stopped the previous process %+v", status)
+		}
+		if err := manager.Stop(first.ProcessID, userid, syscall.SIGKILL, 0); err != nil {
+			t.Fatal(err)
+		}
+		schedule = waitRuns(t, manager, schedule.ID, 3)
+		if run := schedule.Runs[2]; run.Outcome != apiobj.RunQueued || run.ProcessID == "" || run.ProcessID == first.ProcessID {
+			t.Fatalf("the queued run is not started %+v", schedule.Runs)
+		}
+
+		schedule, err = manager.CreateSchedule(yearly(apiobj.OverlapReplace), userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fire(t, schedule.ID)
+		fire(t, schedule.ID)
+		schedule = waitRuns(t, manager, schedule.ID, 2)
+		first, second := schedule.Runs[0], schedule.Runs[1]
+		if second.Outcome != apiobj.RunReplaced || second.ProcessID == "" {
+			t.Fatalf("the run does not replace the previous one %+v", schedule.Runs)
+		}
+		if status, _ := manager.Status(first.ProcessID, userid); status.State != apiobj.StateKilled || status.StoppedBy != "SIGTERM" {
+			t.Fatalf("the replaced process is not stopped %+v", status)
+		}
+		if status, _ := manager.Status(second.ProcessID, userid); status.State != apiobj.StateRunning {
+			t.Fatalf("the replacing process is not running %+v", status)
+		}
+	})
+
+	t.Run("pause and delete", func(t *testing.T) {
+		manager := newTestManager(t, Config{})
+		manager.AddUser(userid)
+		manager.AddUser(2)
+		defer manager.Shutdown(time.Second)
+		schedule, err := manager.CreateSchedule(apiobj.Schedule{Cron: "*/5 * * * *", Command: sleep}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := manager.PauseSchedule(schedule.ID, 2, true); err == nil {
+			t.Fatal("another user paused the schedule")
+		}
+		if err := manager.PauseSchedule(schedule.ID, userid, true); err != nil {
+			t.Fatal(err)
+		}
+		if schedule, _ := manager.LookupSchedule(schedule.ID); !schedule.Paused || schedule.NextRun != nil {
+			t.Fatalf("the schedule is not paused %+v", schedule)
+		}
+		if err := manager.PauseSchedule(schedule.ID, userid, false); err != nil {
+			t.Fatal(err)
+		}
+		resumed, _ := manager.LookupSchedule(schedule.ID)
+		if resumed.Paused || resumed.NextRun == nil || resumed.NextRun.Minute()%5 != 0 || time.Until(*resumed.NextRun) > 5*time.Minute {
+			t.Fatalf("the schedule is not resumed %+v", resumed)
+		}
+
+		if err := manager.DeleteSchedule(schedule.ID, 2); err == nil {
+			t.Fatal("another user deleted the schedule")
+		}
+		if err := manager.DeleteSchedule(schedule.ID, userid); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := manager.LookupSchedule(schedule.ID); err == nil {
+			t.Fatal("the schedule is not deleted")
+		}
+		if list := manager.ListSchedules(nil); len(list) != 0 {
+			t.Fatalf("unexpected schedules %+v", list)
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		dir := t.TempDir()
+		manager := newTestManager(t, Config{DataDir: dir})
+		manager.AddUser(userid)
+		schedule, err := manager.CreateSchedule(apiobj.Schedule{Cron: "@yearly", Command: apiobj.Command{Command: "echo hello"}}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := manager.getSchedule(schedule.ID, userid)
+		manager.fire(s, time.Now())
+		manager.saveSchedules()
+		at := time.Now().Add(time.Hour)
+		paused, err := manager.CreateSchedule(apiobj.Schedule{RunAt: &at, Command: sleep, Paused: true}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.Shutdown(time.Second)
+
+		restarted := newTestManager(t, Config{DataDir: dir})
+		restarted.StartSchedules()
+		defer restarted.Shutdown(time.Second)
+		list := restarted.ListSchedules(nil)
+		if len(list) != 2 || list[0].ID != schedule.ID || list[1].ID != paused.ID {
+			t.Fatalf("the schedules are not restored %+v", list)
+		}
+		if len(list[0].Runs) != 1 || list[0].Runs[0].Outcome != apiobj.RunStarted || list[0].NextRun == nil {
+			t.Fatalf("unexpected restored schedule %+v", list[0])
+		}
+		if !list[1].Paused || list[1].NextRun != nil || !list[1].RunAt.Equal(at) {
+			t.Fatalf("unexpected restored schedule %+v", list[1])
+		}
+	})
+}
+
+// wait until every step of the workflow has succeeded, failed or been skipped
+func waitWorkflow(t *testing.T, manager *Manager, id string) apiobj.Workflow {
+	for i := 0; i < 250; i++ {
+		workflow, err := manager.LookupWorkflow(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if workflow.EndTime != nil {
+			return workflow
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("the workflow %s has not terminated", id)
+	return apiobj.Workflow{}
+}
+
+func TestWorkflow(t *testing.T) {
+	const userid = 1
+	step := func(name string, command string, dependsOn ...string) apiobj.WorkflowStep {
+		return apiobj.WorkflowStep{Name: name, Command: apiobj.Command{Command: command}, DependsOn: dependsOn}
+	}
+	steps := func(workflow apiobj.Workflow) map[string]apiobj.WorkflowStep {
+		byName := make(map[string]apiobj.WorkflowStep)
+		for _, step := range workflow.Steps {
+			byName[step.Name] = step
+		}
+		return byName
+	}
+
+	t.Run("dependencies", func(t *testing.T) {
+		manager := newTestManager(t, Config{})
+		manager.AddUser(userid)
+		defer manager.Shutdown(time.Second)
+		workflow, err := manager.CreateWorkflow(apiobj.Workflow{Steps: []apiobj.WorkflowStep{
+			step("package", "echo package", "test", "lint"),
+			step("test", "sleep 0.2", "build"),
+			step("lint", "true", "build"),
+			step("build", "echo build"),
+		}}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if workflow.ID == "" || workflow.Owner != userid || workflow.State != apiobj.WorkflowRunning || workflow.EndTime != nil {
+			t.Fatalf("unexpected workflow %+v", workflow)
+		}
+		if byName := steps(workflow); byName["build"].State != apiobj.WorkflowRunning || byName["build"].ProcessID == "" || byName["package"].State != apiobj.WorkflowWaiting {
+			t.Fatalf("unexpected first steps %+v", workflow.Steps)
+		}
+
+		workflow = waitWorkflow(t, manager, workflow.ID)
+		if workflow.State != apiobj.WorkflowSucceeded {
+			t.Fatalf("the workflow did not succeed %+v", workflow)
+		}
+		statuses := make(map[string]apiobj.ProcessStatus)
+		for name, step := range steps(workflow) {
+			if step.State != apiobj.WorkflowSucceeded || step.Error != "" {
+				t.Fatalf("unexpected step %+v", step)
+			}
+			statuses[name] = waitProcess(t, manager, step.ProcessID, userid)
+		}
+		for _, edge := range [][2]string{{"build", "test"}, {"build", "lint"}, {"test", "package"}, {"lint", "package"}} {
+			if statuses[edge[1]].StartTime.Before(*statuses[edge[0]].EndTime) {
+				t.Fatalf("the step %s started before %s terminated", edge[1], edge[0])
+			}
+		}
+		entries, err := logEntries(manager, steps(workflow)["package"].ProcessID, userid, Filter{})
+		if err != nil || entriesData(entries) != "package\n" {
+			t.Fatalf("unexpected output of the last step %q %v", entriesData(entries), err)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		manager := newTestManager(t, Config{})
+		manager.AddUser(userid)
+		defer manager.Shutdown(time.Second)
+		workflow, err := manager.CreateWorkflow(apiobj.Workflow{Steps: []apiobj.WorkflowStep{
+			step("build", "false"),
+			step("test", "true", "build"),
+			step("package", "true", "test"),
+			step("docs", "true"),
+			step("missing", "/does/not/exist"),
+			step("publish", "true", "docs", "missing"),
+		}}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		workflow = waitWorkflow(t, manager, workflow.ID)
+		if workflow.State != apiobj.WorkflowFailed {
+			t.Fatalf("the workflow did not fail %+v", workflow)
+		}
+		byName := steps(workflow)
+		if step := byName["build"]; step.State != apiobj.WorkflowFailed || step.ProcessID == "" || step.Error != "the process exited with code 1" {
+			t.Fatalf("unexpected failed step %+v", step)
+		}
+		if step := byName["test"]; step.State != apiobj.WorkflowSkipped || step.ProcessID != "" || !strings.Contains(step.Error, `"build"`) {
+			t.Fatalf("unexpected skipped step %+v", step)
+		}
+		if step := byName["package"]; step.State != apiobj.WorkflowSkipped || !strings.Contains(step.Error, `"test"`) {
+			t.Fatalf("the skip does not propagate %+v", step)
+		}
+		if step := byName["docs"]; step.State != apiobj.WorkflowSucceeded {
+			t.Fatalf("an independent step did not run %+v", step)
+		}
+		if step := byName["missing"]; step.State != apiobj.WorkflowFailed || step.ProcessID != "" || step.Error == "" {
+			t.Fatalf("unexpected step not started %+v", step)
+		}
+		if step := byName["publish"]; step.State != apiobj.WorkflowSkipped {
+			t.Fatalf("unexpected step depending on a step not started %+v", step)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		manager := newTestManager(t, Config{})
+		manager.AddUser(userid)
+		defer manager.Shutdown(time.Second)
+		for _, workflow := range []apiobj.Workflow{
+			{},
+			{Steps: []apiobj.WorkflowStep{step("", "true")}},
+			{Steps: []apiobj.WorkflowStep{step("a", "true"), step("a", "true")}},
+			{Steps: []apiobj.WorkflowStep{step("a", "true", "b")}},
+			{Steps: []apiobj.WorkflowStep{step("a", "true", "a")}},
+			{Steps: []apiobj.WorkflowStep{step("a", "true", "c"), step("b", "true", "a"), step("c", "true", "b")}},
+			{Steps: []apiobj.WorkflowStep{step("a", "true"), step("b", " ", "a")}},
+			{Steps: []apiobj.WorkflowStep{{Name: "a", Command: apiobj.Command{Command: "true", Namespace: "team"}}}},
+		} {
+			if _, err := manager.CreateWorkflow(workflow, userid); err == nil {
+				t.Fatalf("invalid workflow %+v accepted", workflow)
+			}
+		}
+		if list := manager.ListWorkflows(nil); len(list) != 0 {
+			t.Fatalf("invalid workflows created %+v", list)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		manager := newTestManager(t, Config{StopTimeout: 300 * time.Millisecond})
+		manager.AddUser(userid)
+		manager.AddUser(2)
+		defer manager.Shutdown(time.Second)
+		workflow, err := manager.CreateWorkflow(apiobj.Workflow{Steps: []apiobj.WorkflowStep{
+			step("build", "sleep 100"),
+			step("test", "true", "build"),
+		}}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := manager.CancelWorkflow(workflow.ID, 2); err == nil {
+			t.Fatal("another user cancelled the workflow")
+		}
+		if err := manager.CancelWorkflow(workflow.ID, userid); err != nil {
+			t.Fatal(err)
+		}
+		workflow = waitWorkflow(t, manager, workflow.ID)
+		byName := steps(workflow)
+		if workflow.State != apiobj.WorkflowCancelled || byName["build"].State != apiobj.WorkflowFailed || byName["test"].State != apiobj.WorkflowSkipped {
+			t.Fatalf("unexpected cancelled workflow %+v", workflow)
+		}
+		if status, _ := manager.Status(byName["build"].ProcessID, userid); status.State != apiobj.StateKilled {
+			t.Fatalf("the running step is not stopped %+v", status)
+		}
+		if err := manager.CancelWorkflow(workflow.ID, userid); err == nil {
+			t.Fatal("a terminated workflow cancelled")
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		dir := t.TempDir()
+		manager := newTestManager(t, Config{DataDir: dir})
+		manager.AddUser(userid)
+		done, err := manager.CreateWorkflow(apiobj.Workflow{Steps: []apiobj.WorkflowStep{step("build", "true")}}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitWorkflow(t, manager, done.ID)
+		running, err := manager.CreateWorkflow(apiobj.Workflow{Steps: []apiobj.WorkflowStep{
+			step("build", "sleep 100"),
+			step("test", "true", "build"),
+		}}, userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.Shutdown(time.Second)
+
+		restarted := newTestManager(t, Config{DataDir: dir})
+		defer restarted.Shutdown(time.Second)
+		list := restarted.ListWorkflows(nil)
+		if len(list) != 2 || list[0].ID != done.ID || list[1].ID != running.ID {
+			t.Fatalf("the workflows are not restored %+v", list)
+		}
+		if list[0].State != apiobj.WorkflowSucceeded {
+			t.Fatalf("unexpected restored workflow %+v", list[0])
+		}
+		byName := steps(list[1])
+		if list[1].State != apiobj.WorkflowFailed || list[1].EndTime == nil || byName["build"].State != apiobj.WorkflowFailed || byName["test"].State != apiobj.WorkflowSkipped {
+			t.Fatalf("the interrupted workflow is not failed %+v", list[1])
+		}
+	})
 }
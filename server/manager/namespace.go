@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/anterpin/interview/server/apiobj"
+)
+
+// size of the struct ifreq used by the network ioctls
+const ifreqSize = 40
+
+// namespaces created for an isolated process
+// the network namespace is not created if the host network is kept
+// the command is pid 1 of its namespace so the kernel drops the signals
+// it does not handle and a stop usually ends with SIGKILL
+func cloneFlags(isolation apiobj.Isolation) uintptr {
+	flags := uintptr(syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS)
+	if !isolation.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	if isolation.UserNamespace {
+		flags |= syscall.CLONE_NEWUSER
+	}
+	return flags
+}
+
+// map root of the new user namespace to the user running the process
+// the one running the server if credential is nil
+func setUserNamespace(attr *syscall.SysProcAttr, credential *Credential) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if credential != nil {
+		uid, gid = int(credential.Uid), int(credential.Gid)
+		// the process becomes root inside to take the mapped user outside
+		// and drops the groups of the server, the credential groups cannot be mapped
+		attr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+	}
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+	// only a privileged server can let it set the groups
+	attr.GidMappingsEnableSetgroups = credential != nil
+}
+
+// called by the job init inside the new namespaces
+// it gives the process a private /proc showing only its own tree
+// its own hostname and a loopback interface if it has a network namespace
+func setupNamespaces(config initConfig) error {
+	// the mounts below must not propagate to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("cannot make the mounts private: %v", err)
+	}
+	err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("cannot mount /proc: %v", err)
+	}
+	err = syscall.Sethostname([]byte(config.Hostname))
+	if err != nil {
+		return fmt.Errorf("cannot set the hostname: %v", err)
+	}
+	if config.Loopback {
+		err = loopbackUp()
+		if err != nil {
+			return fmt.Errorf("cannot bring up the loopback interface: %v", err)
+		}
+	}
+	return nil
+}
+
+// a new network namespace has only the loopback interface and it is down
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// the interface name followed by the flags
+	var ifreq [ifreqSize]byte
+	copy(ifreq[:syscall.IFNAMSIZ-1], "lo")
+	flags := (*uint16)(unsafe.Pointer(&ifreq[syscall.IFNAMSIZ]))
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifreq[0])))
+	if errno != 0 {
+		return errno
+	}
+	*flags |= syscall.IFF_UP
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifreq[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
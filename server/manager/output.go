@@ -0,0 +1,366 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// size of the chunks read from the storage
+const readChunkSize = 32 * 1024
+
+// size of the header preceding every entry in the storage
+// 1 byte stream, 8 bytes unix nano timestamp, 4 bytes data length
+const entryHeaderSize = 1 + 8 + 4
+
+// output stream of a process, they can be combined as a mask
+type Stream byte
+
+const (
+	Stdout Stream = 1 << iota
+	Stderr
+	Both = Stdout | Stderr
+)
+
+// parse stdout, stderr or both
+func ParseStream(str string) (Stream, error) {
+	switch str {
+	case "stdout":
+		return Stdout, nil
+	case "stderr":
+		return Stderr, nil
+	case "both":
+		return Both, nil
+	}
+	return 0, fmt.Errorf("unknown stream %s", str)
+}
+
+func (stream Stream) String() string {
+	switch stream {
+	case Stdout:
+		return "stdout"
+	case Stderr:
+		return "stderr"
+	case Both:
+		return "both"
+	}
+	return "unknown"
+}
+
+// a line, or part of it, written by a process on one of its streams
+type Entry struct {
+	Stream Stream
+	Time   time.Time
+	Data   []byte
+}
+
+// select the entries of the output
+// the zero value selects all of them
+type Filter struct {
+	// streams to include, 0 means both
+	Streams Stream
+	// include only the entries written at or after Since, if not zero
+	Since time.Time
+	// include only the entries written at or before Until, if not zero
+	Until time.Time
+}
+
+func (filter Filter) match(entry Entry) bool {
+	if filter.Streams != 0 && filter.Streams&entry.Stream == 0 {
+		return false
+	}
+	if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && entry.Time.After(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// return the entries matching the filter
+func (filter Filter) selected(entries []Entry) []Entry {
+	selected := []Entry{}
+	for _, entry := range entries {
+		if filter.match(entry) {
+			selected = append(selected, entry)
+		}
+	}
+	return selected
+}
+
+// output collects the stdout and stderr of a process into a storage
+// as a sequence of timestamped entries, one for each line written
+// and wakes up every reader following it on each write
+type output struct {
+	storage Storage
+	// bytes written into the storage, headers included
+	size int64
+	// maximum number of bytes written into the storage, headers included
+	// 0 means no limit
+	limit int64
+	// appended once the limit is reached, room is kept for its entry
+	notice    []byte
+	truncated bool
+	// set when the process has terminated, no more writes will happen
+	closed bool
+	// closed and replaced on every write or close to wake up the followers
+	notify chan struct{}
+	mutex  sync.Mutex
+}
+
+func newOutput(storage Storage, limit int64) *output {
+	out := &output{
+		storage: storage,
+		limit:   limit,
+		notify:  make(chan struct{}),
+	}
+	if limit > 0 {
+		out.notice = []byte(fmt.Sprintf("\n[output truncated: limit of %d bytes reached]\n", limit))
+	}
+	return out
+}
+
+// output of a process started before a restart
+// stored in storage holding size bytes
+func restoreOutput(storage Storage, size int64) *output {
+	return &output{
+		storage: storage,
+		size:    size,
+		closed:  true,
+		notify:  make(chan struct{}),
+	}
+}
+
+// return a writer appending to the given stream
+func (out *output) writer(stream Stream) io.Writer {
+	return &streamWriter{out: out, stream: stream}
+}
+
+type streamWriter struct {
+	out    *output
+	stream Stream
+}
+
+func (writer *streamWriter) Write(p []byte) (int, error) {
+	writer.out.write(writer.stream, time.Now(), p)
+	return len(p), nil
+}
+
+// append p to the output as one entry per line and wake up the followers
+// the bytes that would make the storage exceed the limit are discarded
+// without failing so the process is not affected by a full output
+func (out *output) write(stream Stream, now time.Time, p []byte) {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+
+	if out.truncated {
+		return
+	}
+
+	noticeSize := int64(entryHeaderSize + len(out.notice))
+	var buffer bytes.Buffer
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		if out.limit > 0 {
+			// bytes of the line still fitting before the notice
+			room := out.limit - noticeSize - out.size - int64(buffer.Len()) - entryHeaderSize
+			if int64(len(line)) > room {
+				if room > 0 {
+					encodeEntry(&buffer, Entry{Stream: stream, Time: now, Data: line[:room]})
+				}
+				out.truncated = true
+				break
+			}
+		}
+		encodeEntry(&buffer, Entry{Stream: stream, Time: now, Data: line})
+		p = p[len(line):]
+	}
+	// the notice is dropped if the limit is too small to hold it
+	if out.truncated && out.size+int64(buffer.Len())+noticeSize <= out.limit {
+		encodeEntry(&buffer, Entry{Stream: Stderr, Time: now, Data: out.notice})
+	}
+
+	// a single write so the storage never holds half an entry
+	n, err := out.storage.Write(buffer.Bytes())
+	out.size += int64(n)
+	out.wakeUp()
+	if err != nil {
+		// the storage is broken, stop writing to it
+		log.Printf("Cannot store the process output: %v", err)
+		out.truncated = true
+	}
+}
+
+// bytes written into the storage, headers included
+func (out *output) stored() int64 {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	return out.size
+}
+
+// mark the output as complete and wake up the followers
+func (out *output) Close() {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+
+	if err := out.storage.Close(); err != nil {
+		log.Printf("Cannot close the process output: %v", err)
+	}
+	out.closed = true
+	out.wakeUp()
+}
+
+// must be called holding the mutex
+func (out *output) wakeUp() {
+	close(out.notify)
+	out.notify = make(chan struct{})
+}
+
+func encodeEntry(buffer *bytes.Buffer, entry Entry) {
+	var header [entryHeaderSize]byte
+	header[0] = byte(entry.Stream)
+	binary.BigEndian.PutUint64(header[1:9], uint64(entry.Time.UnixNano()))
+	binary.BigEndian.PutUint32(header[9:], uint32(len(entry.Data)))
+	buffer.Write(header[:])
+	buffer.Write(entry.Data)
+}
+
+// decode the entries completely contained in chunk
+// return the entries and the number of bytes decoded
+func decodeEntries(chunk []byte) ([]Entry, int) {
+	entries := []Entry{}
+	decoded := 0
+	for len(chunk)-decoded >= entryHeaderSize {
+		header := chunk[decoded : decoded+entryHeaderSize]
+		length := int(binary.BigEndian.Uint32(header[9:]))
+		if len(chunk)-decoded-entryHeaderSize < length {
+			break
+		}
+		data := chunk[decoded+entryHeaderSize : decoded+entryHeaderSize+length]
+		entries = append(entries, Entry{
+			Stream: Stream(header[0]),
+			Time:   time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9]))),
+			Data:   data,
+		})
+		decoded += entryHeaderSize + length
+	}
+	return entries, decoded
+}
+
+// read the entries starting at offset
+// return also the offset of the next entry,
+// if the output is complete and the channel notifying the next write
+// the storage is read outside the mutex so the writes are not blocked
+func (out *output) read(offset int64) ([]Entry, int64, bool, chan struct{}, error) {
+	out.mutex.Lock()
+	stored, closed, notify := out.size, out.closed, out.notify
+	out.mutex.Unlock()
+
+	size := stored - offset
+	if size > readChunkSize {
+		size = readChunkSize
+	}
+	chunk, err := readAt(out.storage, offset, size)
+	if err != nil {
+		return nil, offset, false, nil, err
+	}
+	entries, decoded := decodeEntries(chunk)
+	if len(entries) == 0 && len(chunk) >= entryHeaderSize {
+		// the first entry is bigger than a chunk, read it whole
+		length := int64(binary.BigEndian.Uint32(chunk[9:entryHeaderSize]))
+		chunk, err = readAt(out.storage, offset, entryHeaderSize+length)
+		if err != nil {
+			return nil, offset, false, nil, err
+		}
+		entries, decoded = decodeEntries(chunk)
+	}
+	offset += int64(decoded)
+	// the output is complete only if the whole of it has been read
+	return entries, offset, closed && offset == stored, notify, nil
+}
+
+func readAt(storage Storage, offset int64, size int64) ([]byte, error) {
+	chunk := make([]byte, size)
+	n, err := storage.ReadAt(chunk, offset)
+	if err == io.EOF && int64(n) == size {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// pass to callback the entries collected so far selected by the filter
+// one chunk at a time so the whole output is never held in memory
+func (out *output) Entries(filter Filter, callback func([]Entry) error) error {
+	offset := int64(0)
+	for {
+		entries, next, _, _, err := out.read(offset)
+		if err != nil {
+			return err
+		}
+		if next == offset {
+			return nil
+		}
+		if selected := filter.selected(entries); len(selected) > 0 {
+			if err := callback(selected); err != nil {
+				return err
+			}
+		}
+		offset = next
+	}
+}
+
+// pass to callback the entries selected by the filter from the beginning
+// and keep passing the new ones as soon as they arrive
+// return nil when the output is closed or the filter Until is reached
+// or the context error when the context is cancelled first
+func (out *output) Follow(ctx context.Context, filter Filter, callback func([]Entry) error) error {
+	if !filter.Until.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, filter.Until)
+		defer cancel()
+	}
+
+	offset := int64(0)
+	for {
+		entries, next, closed, notify, err := out.read(offset)
+		if err != nil {
+			return err
+		}
+
+		if selected := filter.selected(entries); len(selected) > 0 {
+			if err := callback(selected); err != nil {
+				return err
+			}
+		}
+		if closed {
+			return nil
+		}
+		if next != offset {
+			// more may be already available
+			offset = next
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && !filter.Until.IsZero() && !time.Now().Before(filter.Until) {
+				return nil
+			}
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
@@ -2,51 +2,669 @@ package manager
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
 )
 
+var errProcessTerminated = errors.New("process already terminated")
+
 type Process struct {
 	cmd    *exec.Cmd
-	buffer *bytes.Buffer
+	output *output
 	name   string
+	args   []string
+	id     string
+	owner  int
+	// shared with the members of the namespace, personal if empty
+	namespace string
+	priority  string
+
+	// cgroup v2 leaf of the process if any
+	cgroup   string
+	isolated bool
+
+	pid       int
+	startTime time.Time
+	// read ends of the stdout and stderr pipes
+	pipes []*os.File
+	// write end of the stdin pipe if the process has a stdin payload
+	stdin   *os.File
+	copying sync.WaitGroup
+
+	// set while the process waits to be started, guarded by the mutex
+	// the pid and the start time are written under the mutex when it starts
+	pending *Options
+	// called once the started process has terminated
+	exited func()
+
+	// closed when the process has terminated
+	// the fields below are written only before closing it
+	done      chan struct{}
+	endTime   time.Time
+	state     string
+	exitCode  int
+	signal    string
+	oomKilled bool
+	// user and system cpu time of the process and its waited children
+	cpuTime time.Duration
+
+	// last signal sent by Stop
+	stoppedBy string
+	// time after which the process is stopped, zero if none
+	deadline time.Time
+	record   func(apiobj.ProcessStatus)
+	// set when the process is stopped for reaching its deadline
+	timedOut bool
+	mutex    sync.Mutex
+}
+
+// time given to the output pipes to be closed after the process group is killed
+// before they are closed by force
+const outputDrainTimeout = 2 * time.Second
+
+// Options of a new process
+type Options struct {
+	// storage receiving the output
+	Storage Storage
+	// maximum number of output bytes stored, 0 means no limit
+	OutputLimit int64
+	// cgroup v2 leaf the process joins before executing the command
+	Cgroup string
+	// resource limits enforced with rlimits
+	Rlimits *apiobj.Limits
+	// namespaces the process is isolated with, nil if not isolated
+	Isolation *apiobj.Isolation
+	// hostname of the isolated process
+	Hostname string
+	// user running the process, the one running the server if nil
+	Credential *Credential
+	// environment of the process, the server one if nil
+	Env []string
+	// working directory of the process, the server one if empty
+	Dir string
+	// written to the standard input of the process, /dev/null if nil
+	Stdin []byte
+	// id, owner, namespace and priority reported in the snapshots
+	ID        string
+	Owner     int
+	Namespace string
+	Priority  string
+	// time after which the process is stopped with SIGTERM, zero if none
+	Deadline time.Time
+	// grace period before SIGKILL when the deadline is reached
+	StopTimeout time.Duration
+	// called with the snapshot of the process when started and when terminated
+	// the followers of the output return only after the last call
+	Record func(apiobj.ProcessStatus)
+	// called once the process has terminated, not if it never started
+	Exited func()
 }
 
 // try to create a process given args[0] as command
 // and []args as second parameter
-func Create(command string, args ...string) (Process, error) {
-	process := Process{
-		cmd:    exec.Command(command, args...),
-		buffer: new(bytes.Buffer),
-		name:   command,
-	}
-	// redirect stdin and stderr
-	process.cmd.Stdout = process.buffer
-	process.cmd.Stderr = process.buffer
-	err := process.cmd.Start()
+func Create(options Options, command string, args ...string) (*Process, error) {
+	process := newProcess(options, command, args)
+	if err := process.start(options); err != nil {
+		return nil, err
+	}
+	return process, nil
+}
+
+// create a process waiting to be started by startPending
+// or cancelled by Stop
+func createPending(options Options, command string, args ...string) *Process {
+	process := newProcess(options, command, args)
+	process.pending = &options
+	// replaced by the time it starts
+	process.startTime = time.Now()
+	if process.record != nil {
+		process.record(process.status())
+	}
+	return process
+}
+
+func newProcess(options Options, command string, args []string) *Process {
+	return &Process{
+		cmd:       exec.Command(command, args...),
+		output:    newOutput(options.Storage, options.OutputLimit),
+		name:      command,
+		args:      args,
+		id:        options.ID,
+		owner:     options.Owner,
+		namespace: options.Namespace,
+		priority:  options.Priority,
+		cgroup:    options.Cgroup,
+		isolated:  options.Isolation != nil,
+		deadline:  options.Deadline,
+		record:    options.Record,
+		exited:    options.Exited,
+		done:      make(chan struct{}),
+	}
+}
+
+// start the pending process unless it was cancelled
+// a process that cannot start or whose deadline passed while pending
+// terminates without running
+// return whether the process is running
+func (process *Process) startPending() bool {
+	process.mutex.Lock()
+	options := process.pending
+	if options == nil {
+		process.mutex.Unlock()
+		return false
+	}
+	process.pending = nil
+	if !process.deadline.IsZero() && !time.Now().Before(process.deadline) {
+		process.mutex.Unlock()
+		process.abandon(apiobj.StateTimedOut, nil)
+		return false
+	}
+	// Status and Stop wait for the process to be started
+	err := process.start(*options)
+	process.mutex.Unlock()
+	if err != nil {
+		process.abandon(apiobj.StateFailed, err)
+		return false
+	}
+	return true
+}
+
+func (process *Process) isPending() bool {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	return process.pending != nil
+}
+
+// terminate the process that never ran
+// err is written to its output if it could not start
+func (process *Process) abandon(state string, err error) {
+	process.endTime = time.Now()
+	process.state = state
+	if err != nil {
+		notice := fmt.Sprintf("cannot start the process: %v\n", err)
+		process.output.write(Stderr, process.endTime, []byte(notice))
+	}
+	if process.cgroup != "" {
+		if err := removeCgroup(process.cgroup); err != nil {
+			log.Printf("Cannot remove the cgroup %s: %v", process.cgroup, err)
+		}
+	}
+	close(process.done)
+	if process.record != nil {
+		process.record(process.Status())
+	}
+	process.output.Close()
+}
+
+// execute the command of the process
+// a pending process is started holding the mutex
+func (process *Process) start(options Options) error {
+	// run the process in its own process group
+	// so it can be signaled together with every process it forks
+	process.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if options.Isolation != nil {
+		process.cmd.SysProcAttr.Cloneflags = cloneFlags(*options.Isolation)
+		if options.Isolation.UserNamespace {
+			setUserNamespace(process.cmd.SysProcAttr, options.Credential)
+		}
+	}
+
+	// the output pipes are created here instead of letting exec copy them
+	// so Wait returns as soon as the process exits
+	// even if some of its children keep them open
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutWriter.Close()
+		return err
+	}
+	process.cmd.Stdout = stdoutWriter
+	process.cmd.Stderr = stderrWriter
+	process.cmd.Env = options.Env
+	process.cmd.Dir = options.Dir
+	var stdin *os.File
+	if options.Stdin != nil {
+		// written by the server so a process not reading it cannot block Wait
+		stdin, process.stdin, err = os.Pipe()
+		if err != nil {
+			stdout.Close()
+			stdoutWriter.Close()
+			stderr.Close()
+			stderrWriter.Close()
+			return err
+		}
+		process.cmd.Stdin = stdin
+	}
+
+	var initSync *os.File
+	if options.Cgroup != "" || options.Rlimits != nil || options.Isolation != nil {
+		config := initConfig{Path: process.cmd.Path, Cgroup: options.Cgroup, Rlimits: options.Rlimits}
+		if options.Isolation != nil {
+			config.Isolated = true
+			config.Hostname = options.Hostname
+			config.Loopback = !options.Isolation.Network
+		}
+		// the setup needs the privileges of the server so they are dropped after it
+		// in a user namespace root is already mapped to the credential
+		if options.Isolation == nil || !options.Isolation.UserNamespace {
+			config.Credential = options.Credential
+		}
+		initSync, err = process.useInit(config)
+	} else if options.Credential != nil {
+		process.cmd.SysProcAttr.Credential = options.Credential.sysProcCredential()
+	}
 	if err == nil {
-		go func() {
-			_ = process.cmd.Wait()
-		}()
+		err = process.cmd.Start()
+	}
+	// the process has its own copy of the write ends and of the stdin read end
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if stdin != nil {
+		stdin.Close()
+	}
+	if initSync != nil {
+		process.cmd.ExtraFiles[0].Close()
+		if err == nil {
+			err = waitInit(process.cmd, initSync)
+		}
+		initSync.Close()
+	}
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		if process.stdin != nil {
+			process.stdin.Close()
+		}
+		return err
+	}
+	process.pid = process.cmd.Process.Pid
+	process.startTime = time.Now()
+	if process.record != nil {
+		process.record(process.status())
+	}
+
+	process.pipes = []*os.File{stdout, stderr}
+	process.copying.Add(2)
+	go process.copyOutput(stdout, Stdout)
+	go process.copyOutput(stderr, Stderr)
+	if process.stdin != nil {
+		go process.writeStdin(options.Stdin)
+	}
+	go process.wait()
+	if !process.deadline.IsZero() {
+		go process.enforceDeadline(syscall.SIGTERM, options.StopTimeout)
+	}
+	return nil
+}
+
+// start the command through the job init of this binary
+// that applies the configuration before executing it
+// return the read end of the pipe the job init reports its errors to
+func (process *Process) useInit(config initConfig) (*os.File, error) {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	initSync, initSyncWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	env := process.cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	// the command is resolved by the job init
+	process.cmd = &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: append([]string{initName, process.name}, process.args...),
+		Env:  append(env[:len(env):len(env)], initEnv+"="+string(encoded)),
+		Dir:  process.cmd.Dir,
+		// it becomes the descriptor initSyncFd of the job init
+		ExtraFiles:  []*os.File{initSyncWriter},
+		Stdin:       process.cmd.Stdin,
+		Stdout:      process.cmd.Stdout,
+		Stderr:      process.cmd.Stderr,
+		SysProcAttr: process.cmd.SysProcAttr,
+	}
+	return initSync, nil
+}
+
+// wait for the job init to execute the command
+// the pipe is closed on exec, otherwise it carries the setup error
+func waitInit(cmd *exec.Cmd, initSync *os.File) error {
+	message, err := ioutil.ReadAll(initSync)
+	if err == nil && len(message) == 0 {
+		return nil
+	}
+	_ = cmd.Wait()
+	if err != nil {
+		return err
+	}
+	return errors.New(string(message))
+}
+
+// copy the pipe into the output stream until every writer has closed it
+func (process *Process) copyOutput(pipe *os.File, stream Stream) {
+	defer process.copying.Done()
+	_, _ = io.Copy(process.output.writer(stream), pipe)
+	pipe.Close()
+}
+
+// write the stdin payload and close the pipe so the process reads EOF
+// a process exiting without reading it makes the write fail
+func (process *Process) writeStdin(payload []byte) {
+	_, _ = process.stdin.Write(payload)
+	process.stdin.Close()
+}
+
+// wait the termination of the process and record its final state
+func (process *Process) wait() {
+	_ = process.cmd.Wait()
+	process.endTime = time.Now()
+
+	// kill the children left behind so they do not survive as orphans
+	// the negative pid signals the whole process group
+	_ = syscall.Kill(-process.cmd.Process.Pid, syscall.SIGKILL)
+	if process.cgroup != "" {
+		killCgroup(process.cgroup)
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		process.copying.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-time.After(outputDrainTimeout):
+		// a child escaped the process group and keeps the pipes open
+		for _, pipe := range process.pipes {
+			pipe.Close()
+		}
+		if process.stdin != nil {
+			// unblock the write of a stdin payload nobody reads
+			process.stdin.Close()
+		}
+		<-copied
+	}
+
+	if process.cgroup != "" {
+		process.oomKilled = oomKilled(process.cgroup)
+		if err := removeCgroup(process.cgroup); err != nil {
+			log.Printf("Cannot remove the cgroup %s: %v", process.cgroup, err)
+		}
+	}
+
+	process.cpuTime = process.cmd.ProcessState.UserTime() + process.cmd.ProcessState.SystemTime()
+	waitStatus, ok := process.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	switch {
+	case ok && waitStatus.Signaled():
+		process.state = apiobj.StateKilled
+		process.signal = signalName(waitStatus.Signal())
+		process.exitCode = -1
+	case process.cmd.ProcessState.ExitCode() == 0:
+		process.state = apiobj.StateExited
+	default:
+		process.state = apiobj.StateFailed
+		process.exitCode = process.cmd.ProcessState.ExitCode()
+	}
+	process.mutex.Lock()
+	if process.timedOut {
+		process.state = apiobj.StateTimedOut
+	}
+	process.mutex.Unlock()
+	close(process.done)
+	if process.record != nil {
+		process.record(process.Status())
+	}
+	// closed last so the followers see the final state once they return
+	process.output.Close()
+	if process.exited != nil {
+		process.exited()
+	}
+}
+
+// stop the process with signal once the deadline is reached
+// and kill it if it is still running after the grace period
+func (process *Process) enforceDeadline(signal syscall.Signal, grace time.Duration) {
+	timer := time.NewTimer(time.Until(process.deadline))
+	defer timer.Stop()
+	select {
+	case <-process.done:
+		return
+	case <-timer.C:
+	}
+
+	process.mutex.Lock()
+	process.timedOut = true
+	process.mutex.Unlock()
+	if err := process.Stop(signal, grace); err != nil && err != errProcessTerminated {
+		log.Printf("Cannot stop the process %s after its deadline: %v", process.id, err)
+	}
+}
+
+// terminated process started before a restart
+// rebuilt from its last snapshot and its stored output
+func restoreProcess(status apiobj.ProcessStatus, output *output) *Process {
+	process := &Process{
+		output:    output,
+		name:      status.Command,
+		args:      status.Args,
+		id:        status.ID,
+		owner:     status.Owner,
+		namespace: status.Namespace,
+		priority:  status.Priority,
+		isolated:  status.Isolated,
+		pid:       status.PID,
+		startTime: status.StartTime,
+		done:      make(chan struct{}),
+		state:     status.State,
+		signal:    status.Signal,
+		oomKilled: status.OOMKilled,
+		stoppedBy: status.StoppedBy,
+		cpuTime:   time.Duration(status.CPUSeconds * float64(time.Second)),
+	}
+	if status.Deadline != nil {
+		process.deadline = *status.Deadline
+	}
+	if status.EndTime != nil {
+		process.endTime = *status.EndTime
+	}
+	if status.ExitCode != nil {
+		process.exitCode = *status.ExitCode
+	}
+	close(process.done)
+	return process
+}
+
+func (process *Process) isDone() bool {
+	select {
+	case <-process.done:
+		return true
+	default:
+		return false
 	}
-	return process, err
 }
 
-// kill the given process
-// sending a sigkill signal
-func (process Process) Kill() error {
-	return process.cmd.Process.Kill()
+// stop the given process sending signal
+// if it is still running after the grace period it is killed with SIGKILL
+// it returns when the process has terminated or SIGKILL has been sent
+// a pending process is cancelled instead
+func (process *Process) Stop(signal syscall.Signal, grace time.Duration) error {
+	process.mutex.Lock()
+	pending := process.pending != nil
+	process.pending = nil
+	process.mutex.Unlock()
+	if pending {
+		process.abandon(apiobj.StateCancelled, nil)
+		return nil
+	}
+
+	err := process.sendSignal(signal)
+	if err != nil {
+		return err
+	}
+	if signal == syscall.SIGKILL {
+		return nil
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-process.done:
+		return nil
+	case <-timer.C:
+	}
+
+	err = process.sendSignal(syscall.SIGKILL)
+	if err == errProcessTerminated {
+		// terminated in the meantime
+		return nil
+	}
+	return err
+}
+
+// send the signal to the whole process group
+// and record it as the last one sent to stop the process
+func (process *Process) sendSignal(signal syscall.Signal) error {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+
+	select {
+	case <-process.done:
+		return errProcessTerminated
+	default:
+	}
+	if process.pid == 0 {
+		// it never started and is being cancelled
+		return errProcessTerminated
+	}
+	// the negative pid signals the whole process group
+	err := syscall.Kill(-process.cmd.Process.Pid, signal)
+	if err == syscall.ESRCH {
+		// every process of the group has exited but it has not been waited yet
+		return errProcessTerminated
+	}
+	if err != nil {
+		return err
+	}
+	process.stoppedBy = signalName(signal)
+	return nil
+}
+
+// retrieve a snapshot of the state of the given process
+func (process *Process) Status() apiobj.ProcessStatus {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+	return process.status()
+}
+
+// must be called holding the mutex
+func (process *Process) status() apiobj.ProcessStatus {
+	status := apiobj.ProcessStatus{
+		ID:        process.id,
+		State:     apiobj.StateRunning,
+		PID:       process.pid,
+		StartTime: process.startTime,
+		Command:   process.name,
+		Args:      process.args,
+		Owner:     process.owner,
+		Namespace: process.namespace,
+		Priority:  process.priority,
+		Isolated:  process.isolated,
+	}
+	if !process.deadline.IsZero() {
+		deadline := process.deadline
+		status.Deadline = &deadline
+	}
+	select {
+	case <-process.done:
+		status.State = process.state
+		if process.state != apiobj.StateLost {
+			endTime := process.endTime
+			status.EndTime = &endTime
+		}
+		// a process that never ran has no exit code
+		if process.state != apiobj.StateLost && process.pid != 0 {
+			exitCode := process.exitCode
+			status.ExitCode = &exitCode
+		}
+		status.Signal = process.signal
+		status.OOMKilled = process.oomKilled
+		status.CPUSeconds = process.cpuTime.Seconds()
+		status.StoppedBy = process.stoppedBy
+	default:
+		// the pid is set once started, before that it is pending or being cancelled
+		if process.pid == 0 {
+			status.State = apiobj.StatePending
+			break
+		}
+		if cpuTime, err := readCPUTime(process.pid); err == nil {
+			status.CPUSeconds = cpuTime.Seconds()
+		}
+	}
+	return status
+}
+
+// clock ticks per second of the times in /proc, fixed on linux
+const clockTicks = 100
+
+// cpu time used so far by the running process having pid
+// and by its children already waited
+func readCPUTime(pid int) (time.Duration, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the command name between parentheses may contain spaces
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("invalid stat of the process %d", pid)
+	}
+	// utime, stime, cutime and cstime follow the state in the fields 14 to 17
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 15 {
+		return 0, fmt.Errorf("invalid stat of the process %d", pid)
+	}
+	ticks := int64(0)
+	for _, field := range fields[11:15] {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid stat of the process %d", pid)
+		}
+		ticks += value
+	}
+	return time.Duration(ticks) * time.Second / clockTicks, nil
 }
 
-// retrieve the state of the gven process
-// nil if the process is still active
-func (process Process) Status() *os.ProcessState {
-	return process.cmd.ProcessState
+// pass to callback the stdout and stderr entries of the given process
+// selected by the filter, one chunk at a time
+func (process *Process) Log(filter Filter, callback func([]Entry) error) error {
+	return process.output.Entries(filter, callback)
 }
 
-// retrive the combined stdout and stderr of the given process
-// TODO cast output buffer into a file to avoid increasing RAM usage
-// TODO create a stream accepting the request context
-func (process Process) Log() string {
-	return process.buffer.String()
+// pass to callback the stdout and stderr entries of the given process
+// selected by the filter as soon as they are written
+// until the process terminates or the context is cancelled
+func (process *Process) Follow(ctx context.Context, filter Filter, callback func([]Entry) error) error {
+	return process.output.Follow(ctx, filter, callback)
 }
@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"os/exec"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
+)
+
+// set the weight of the user in the share of the slots among the users
+// with pending processes, 1 if not positive
+func (manager *Manager) SetShare(userid int, share int) {
+	manager.queueMutex.Lock()
+	defer manager.queueMutex.Unlock()
+	manager.scheduler.setShare(userid, share)
+}
+
+// free the slot of a terminated process of the user
+// and start the queued processes that can run now
+func (manager *Manager) release(userid int) {
+	manager.queueMutex.Lock()
+	manager.scheduler.advance(time.Now())
+	manager.scheduler.release(userid)
+	manager.queueMutex.Unlock()
+	manager.dispatch()
+}
+
+// start the process if a concurrency limit allows it
+// otherwise queue it in the scheduler
+func (manager *Manager) create(options Options, args []string) (*Process, error) {
+	if !manager.scheduler.limited() {
+		return Create(options, args[0], args[1:]...)
+	}
+	// a queued process starts later, a missing command is reported now
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, err
+	}
+	owner := options.Owner
+	options.Exited = func() { manager.release(owner) }
+
+	manager.queueMutex.Lock()
+	// no process in the queue can use a free slot
+	// they are started as soon as one frees up
+	if !manager.scheduler.hasSlot(owner) {
+		process := createPending(options, args[0], args[1:]...)
+		manager.queued[process] = manager.scheduler.push(process, owner, options.Priority)
+		manager.queueMutex.Unlock()
+		return process, nil
+	}
+	manager.scheduler.advance(time.Now())
+	manager.scheduler.acquire(owner)
+	manager.queueMutex.Unlock()
+
+	process, err := Create(options, args[0], args[1:]...)
+	if err != nil {
+		manager.release(owner)
+	}
+	return process, err
+}
+
+// drop the processes cancelled while pending
+// must be called holding the queue mutex
+func (manager *Manager) pruneQueue() {
+	manager.scheduler.prune(func(job *queuedJob) bool {
+		if job.process.isPending() {
+			return true
+		}
+		delete(manager.queued, job.process)
+		return false
+	})
+}
+
+// start the queued processes chosen by the scheduler while there are free slots
+func (manager *Manager) dispatch() {
+	manager.queueMutex.Lock()
+	manager.pruneQueue()
+	manager.scheduler.advance(time.Now())
+	ready := []*Process{}
+	for job := manager.scheduler.next(); job != nil; job = manager.scheduler.next() {
+		delete(manager.queued, job.process)
+		ready = append(ready, job.process)
+	}
+	manager.queueMutex.Unlock()
+
+	for _, process := range ready {
+		manager.mutex.Lock()
+		closed := manager.closed
+		if !closed {
+			manager.starting.Add(1)
+		}
+		manager.mutex.Unlock()
+		// on shutdown the pending processes are cancelled instead
+		if closed || !manager.startPending(process) {
+			manager.release(process.owner)
+		}
+	}
+}
+
+func (manager *Manager) startPending(process *Process) bool {
+	defer manager.starting.Done()
+	return process.startPending()
+}
+
+// position of the pending process in the order the queued processes start
+// 0 if it is not queued
+func (manager *Manager) queuePosition(process *Process) int {
+	manager.queueMutex.Lock()
+	defer manager.queueMutex.Unlock()
+	job, exists := manager.queued[process]
+	if !exists {
+		return 0
+	}
+	manager.pruneQueue()
+	manager.scheduler.advance(time.Now())
+	return manager.scheduler.position(job)
+}
+
+// snapshot of the process with its position in the queue if pending
+func (manager *Manager) snapshot(process *Process) apiobj.ProcessStatus {
+	status := process.Status()
+	if status.State == apiobj.StatePending {
+		status.QueuePosition = manager.queuePosition(process)
+	}
+	return status
+}
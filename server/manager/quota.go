@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
+)
+
+// ErrQuotaExceeded is wrapped by the errors of Start refused by the quota of the user
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// period of the cpu time budget, it rolls instead of resetting at midnight
+const quotaWindow = 24 * time.Hour
+
+// ValidateQuota checks the limits of the quota are not negative
+func ValidateQuota(quota apiobj.Quota) error {
+	switch {
+	case quota.MaxRunning < 0:
+		return errors.New("negative max running processes")
+	case quota.MaxProcesses < 0:
+		return errors.New("negative max processes")
+	case quota.MaxOutputBytes < 0:
+		return errors.New("negative max output bytes")
+	case quota.CPUSecondsPerDay < 0:
+		return errors.New("negative cpu seconds per day")
+	}
+	return nil
+}
+
+// set the quota enforced on the processes started by the user
+// nil means the default quota
+func (manager *Manager) SetQuota(userid int, quota *apiobj.Quota) {
+	userProcesses, _ := manager.getUserProcesses(userid)
+
+	userProcesses.mutex.Lock()
+	defer userProcesses.mutex.Unlock()
+	userProcesses.quota = quota
+}
+
+func (manager *Manager) getQuota(userid int) apiobj.Quota {
+	userProcesses, _ := manager.getUserProcesses(userid)
+
+	userProcesses.mutex.Lock()
+	defer userProcesses.mutex.Unlock()
+	if userProcesses.quota == nil {
+		return manager.defaultQuota
+	}
+	return *userProcesses.quota
+}
+
+// return the quota of the user and how much of it is used
+func (manager *Manager) Usage(userid int) apiobj.QuotaUsage {
+	userProcesses, _ := manager.getUserProcesses(userid)
+
+	userProcesses.mutex.Lock()
+	usage := userProcesses.usage(time.Now())
+	userProcesses.mutex.Unlock()
+
+	usage.Quota = manager.getQuota(userid)
+	return usage
+}
+
+// count the processes of the user, their output
+// and the cpu time of the ones running or terminated within the window
+// must be called holding the mutex
+func (userProcesses *UserProcesses) usage(now time.Time) apiobj.QuotaUsage {
+	usage := apiobj.QuotaUsage{}
+	for _, process := range userProcesses.processes {
+		status := process.Status()
+		usage.Processes++
+		usage.OutputBytes += process.output.stored()
+		switch {
+		case status.State == apiobj.StatePending:
+			usage.Pending++
+		case status.State == apiobj.StateRunning:
+			usage.Running++
+			usage.CPUSeconds += status.CPUSeconds
+		case status.EndTime != nil && now.Sub(*status.EndTime) < quotaWindow:
+			usage.CPUSeconds += status.CPUSeconds
+		}
+	}
+	return usage
+}
+
+// refuse a new process of the user if it exceeds its quota
+// return the output limit of the new process
+// so the bytes stored for all the processes stay within the quota
+func (manager *Manager) checkQuota(userid int) (int64, error) {
+	quota := manager.getQuota(userid)
+	usage := manager.Usage(userid)
+
+	switch {
+	case quota.MaxRunning > 0 && usage.Running+usage.Pending >= quota.MaxRunning:
+		return 0, fmt.Errorf("%w: %d of %d processes running or pending", ErrQuotaExceeded, usage.Running+usage.Pending, quota.MaxRunning)
+	case quota.MaxProcesses > 0 && usage.Processes >= quota.MaxProcesses:
+		return 0, fmt.Errorf("%w: %d of %d processes kept", ErrQuotaExceeded, usage.Processes, quota.MaxProcesses)
+	// what is left of the output cannot hold a single entry
+	case quota.MaxOutputBytes > 0 && usage.OutputBytes+entryHeaderSize >= quota.MaxOutputBytes:
+		return 0, fmt.Errorf("%w: %d of %d output bytes stored", ErrQuotaExceeded, usage.OutputBytes, quota.MaxOutputBytes)
+	case quota.CPUSecondsPerDay > 0 && usage.CPUSeconds >= quota.CPUSecondsPerDay:
+		return 0, fmt.Errorf("%w: %.1f of %.1f cpu seconds used in the last 24 hours", ErrQuotaExceeded, usage.CPUSeconds, quota.CPUSecondsPerDay)
+	}
+
+	limit := manager.maxOutputSize
+	if quota.MaxOutputBytes > 0 {
+		left := quota.MaxOutputBytes - usage.OutputBytes
+		if limit == 0 || left < limit {
+			limit = left
+		}
+	}
+	return limit, nil
+}
@@ -0,0 +1,153 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/anterpin/interview/server/apiobj"
+)
+
+// name of the registry file inside the data directory
+const registryName = "registry.jsonl"
+
+// registry keeps the snapshots of the processes on disk
+// so they survive a restart of the server
+// it is an append only log holding a snapshot per line
+// written when a process is started and when it terminates
+// the last snapshot of a process wins
+// a removed process is followed by a line marking it as removed
+type registry struct {
+	file *os.File
+	// the snapshots of these processes are not recorded anymore
+	removed map[string]bool
+	mutex   sync.Mutex
+}
+
+// line of the registry
+type registryEntry struct {
+	apiobj.ProcessStatus
+	Removed bool `json:"removed,omitempty"`
+}
+
+// read the registry in dir and compact it
+// return the last snapshot of every process
+// the processes running when the server stopped are marked as lost
+func openRegistry(dir string) (*registry, []apiobj.ProcessStatus, error) {
+	path := filepath.Join(dir, registryName)
+	statuses, err := readRegistry(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range statuses {
+		switch statuses[i].State {
+		case apiobj.StatePending, apiobj.StateRunning:
+			statuses[i].State = apiobj.StateLost
+		}
+	}
+
+	// rewrite the registry with only the last snapshots
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, status := range statuses {
+		if err := encoder.Encode(status); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := WriteFileAtomic(path, buffer.Bytes()); err != nil {
+		return nil, nil, fmt.Errorf("cannot compact the registry: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &registry{file: file, removed: make(map[string]bool)}, statuses, nil
+}
+
+// return the last snapshot of every process from the oldest to the newest
+func readRegistry(path string) ([]apiobj.ProcessStatus, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	last := make(map[string]apiobj.ProcessStatus)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		entry := registryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line may have been written partially by a crash
+			log.Printf("Skipping the line %d of the registry: %v", line, err)
+			continue
+		}
+		if entry.Removed {
+			delete(last, entry.ID)
+			continue
+		}
+		last[entry.ID] = entry.ProcessStatus
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]apiobj.ProcessStatus, 0, len(last))
+	for _, status := range last {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartTime.Before(statuses[j].StartTime)
+	})
+	return statuses, nil
+}
+
+// append the snapshot of a process
+func (registry *registry) record(status apiobj.ProcessStatus) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.removed[status.ID] {
+		return nil
+	}
+	return registry.append(registryEntry{ProcessStatus: status})
+}
+
+// mark the process as removed
+// its snapshots recorded afterwards are ignored
+func (registry *registry) remove(id string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	entry := registryEntry{Removed: true}
+	entry.ID = id
+	if err := registry.append(entry); err != nil {
+		return err
+	}
+	registry.removed[id] = true
+	return nil
+}
+
+// must be called holding the mutex
+func (registry *registry) append(entry registryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := registry.file.Write(line); err != nil {
+		return err
+	}
+	return registry.file.Sync()
+}
@@ -0,0 +1,462 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
+	uuid "github.com/satori/go.uuid"
+)
+
+// name of the file holding the schedules inside the data directory
+const schedulesName = "schedules.json"
+
+// runs kept in the history of a schedule
+const maxScheduleRuns = 100
+
+// command started by the manager at a time or on a cron expression
+type schedule struct {
+	// the fields set on creation never change
+	// the runs and Paused are guarded by the mutex
+	spec apiobj.Schedule
+	// nil for a single run
+	cron *cronSpec
+	// time of the next run, zero if none
+	next time.Time
+	// process started by the last run
+	last *Process
+	// set while a run waits for the previous process to terminate
+	waiting bool
+	mutex   sync.Mutex
+
+	// notified when paused or resumed
+	wake chan struct{}
+	// closed when deleted
+	deleted chan struct{}
+}
+
+// validate the timing and the overlap policy of the schedule
+// the command is checked by checkCommand
+func newSchedule(spec apiobj.Schedule, now time.Time) (*schedule, error) {
+	s := &schedule{
+		spec:    spec,
+		wake:    make(chan struct{}, 1),
+		deleted: make(chan struct{}),
+	}
+	switch {
+	case spec.Cron != "" && spec.RunAt != nil:
+		return nil, errors.New("cron and run_at cannot be both set")
+	case spec.Cron != "":
+		var err error
+		s.cron, err = parseCron(spec.Cron)
+		if err != nil {
+			return nil, err
+		}
+		s.next = s.cron.next(now)
+		if s.next.IsZero() {
+			return nil, fmt.Errorf("the cron expression %q never matches", spec.Cron)
+		}
+	case spec.RunAt != nil:
+		s.next = *spec.RunAt
+	default:
+		return nil, errors.New("either cron or run_at must be set")
+	}
+	switch spec.Overlap {
+	case "":
+		s.spec.Overlap = apiobj.OverlapSkip
+	case apiobj.OverlapSkip, apiobj.OverlapQueue, apiobj.OverlapReplace:
+	default:
+		return nil, fmt.Errorf("unknown overlap policy %q, expected skip, queue or replace", spec.Overlap)
+	}
+	if spec.Command.Deadline != nil {
+		return nil, errors.New("a scheduled command cannot have a deadline, use a timeout")
+	}
+	return s, nil
+}
+
+// snapshot of the schedule
+func (s *schedule) snapshot() apiobj.Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	spec := s.spec
+	spec.Runs = append([]apiobj.ScheduleRun{}, s.spec.Runs...)
+	if !s.spec.Paused && !s.next.IsZero() {
+		next := s.next
+		spec.NextRun = &next
+	}
+	return spec
+}
+
+// add the run to the history dropping the oldest ones
+// must be called holding the mutex
+func (s *schedule) record(run apiobj.ScheduleRun) {
+	if run.Error != "" {
+		log.Printf("Run of the schedule %s %s: %s", s.spec.ID, run.Outcome, run.Error)
+	}
+	s.spec.Runs = append(s.spec.Runs, run)
+	if len(s.spec.Runs) > maxScheduleRuns {
+		s.spec.Runs = append([]apiobj.ScheduleRun{}, s.spec.Runs[len(s.spec.Runs)-maxScheduleRuns:]...)
+	}
+}
+
+// check the command could be started now by the user
+// the quota and the existence of the program are checked at every run
+func (manager *Manager) checkCommand(command apiobj.Command, userid int) error {
+	if _, err := commandArgs(command); err != nil {
+		return err
+	}
+	if command.Limits != nil {
+		if err := manager.checkLimits(*command.Limits); err != nil {
+			return err
+		}
+	}
+	if _, err := commandEnv(command); err != nil {
+		return err
+	}
+	if command.Cwd != "" && !filepath.IsAbs(command.Cwd) {
+		return errors.New("the working directory must be an absolute path")
+	}
+	if _, err := manager.getPolicy(userid).isolation(command.Isolation); err != nil {
+		return err
+	}
+	if _, err := manager.getCredential(userid); err != nil {
+		return err
+	}
+	if _, err := commandDeadline(command, time.Now()); err != nil {
+		return err
+	}
+	_, err := parsePriority(command.Priority)
+	return err
+}
+
+// add a schedule owned by the user starting its command through Start
+// return the schedule with its id
+func (manager *Manager) CreateSchedule(spec apiobj.Schedule, userid int) (apiobj.Schedule, error) {
+	now := time.Now()
+	s, err := newSchedule(spec, now)
+	if err != nil {
+		return apiobj.Schedule{}, err
+	}
+	if spec.RunAt != nil && !spec.RunAt.After(now) {
+		return apiobj.Schedule{}, errors.New("run_at already passed")
+	}
+	if err := manager.checkCommand(spec.Command, userid); err != nil {
+		return apiobj.Schedule{}, err
+	}
+	s.spec.ID = uuid.NewV1().String()
+	s.spec.Owner = userid
+	s.spec.Created = now
+	s.spec.NextRun = nil
+	s.spec.Runs = nil
+
+	manager.mutex.Lock()
+	if manager.closed {
+		manager.mutex.Unlock()
+		return apiobj.Schedule{}, errors.New("the manager is shutting down")
+	}
+	manager.scheduling.Add(1)
+	manager.mutex.Unlock()
+
+	manager.schedulesMutex.Lock()
+	manager.schedules[s.spec.ID] = s
+	manager.schedulesMutex.Unlock()
+	go manager.runSchedule(s)
+
+	manager.saveSchedules()
+	return s.snapshot(), nil
+}
+
+// retrieve the schedule having that id and owned by the user
+func (manager *Manager) getSchedule(id string, userid int) (*schedule, error) {
+	manager.schedulesMutex.Lock()
+	defer manager.schedulesMutex.Unlock()
+	s, exists := manager.schedules[id]
+	if !exists || s.spec.Owner != userid {
+		return nil, fmt.Errorf("do not exist schedule id %s", id)
+	}
+	return s, nil
+}
+
+// remove the schedule, the processes it started are kept
+func (manager *Manager) DeleteSchedule(id string, userid int) error {
+	manager.schedulesMutex.Lock()
+	s, exists := manager.schedules[id]
+	if !exists || s.spec.Owner != userid {
+		manager.schedulesMutex.Unlock()
+		return fmt.Errorf("do not exist schedule id %s", id)
+	}
+	delete(manager.schedules, id)
+	manager.schedulesMutex.Unlock()
+	close(s.deleted)
+	manager.saveSchedules()
+	return nil
+}
+
+// pause or resume the schedule
+// a resumed cron schedule runs at the next match from now on
+// a single run whose time passed while paused runs at once
+func (manager *Manager) PauseSchedule(id string, userid int, paused bool) error {
+	s, err := manager.getSchedule(id, userid)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	if s.spec.Paused != paused {
+		s.spec.Paused = paused
+		if !paused && s.cron != nil {
+			s.next = s.cron.next(time.Now())
+		}
+	}
+	s.mutex.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	manager.saveSchedules()
+	return nil
+}
+
+// return the snapshots of the schedules of every user selected by match
+// or all of them if match is nil, from the oldest to the newest
+func (manager *Manager) ListSchedules(match func(apiobj.Schedule) bool) []apiobj.Schedule {
+	arr := []apiobj.Schedule{}
+	for _, s := range manager.scheduleList() {
+		spec := s.snapshot()
+		if match == nil || match(spec) {
+			arr = append(arr, spec)
+		}
+	}
+	return arr
+}
+
+// return the snapshot of the schedule having that id whoever owns it
+// used to check the access to the schedule
+func (manager *Manager) LookupSchedule(id string) (apiobj.Schedule, error) {
+	manager.schedulesMutex.Lock()
+	s, exists := manager.schedules[id]
+	manager.schedulesMutex.Unlock()
+	if !exists {
+		return apiobj.Schedule{}, fmt.Errorf("do not exist schedule id %s", id)
+	}
+	return s.snapshot(), nil
+}
+
+// the schedules from the oldest to the newest
+func (manager *Manager) scheduleList() []*schedule {
+	manager.schedulesMutex.Lock()
+	list := make([]*schedule, 0, len(manager.schedules))
+	for _, s := range manager.schedules {
+		list = append(list, s)
+	}
+	manager.schedulesMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].spec.Created.Before(list[j].spec.Created)
+	})
+	return list
+}
+
+// wait for the next run of the schedule until it is deleted
+// or the manager shuts down
+func (manager *Manager) runSchedule(s *schedule) {
+	defer manager.scheduling.Done()
+	for {
+		s.mutex.Lock()
+		next := s.next
+		if s.spec.Paused {
+			next = time.Time{}
+		}
+		s.mutex.Unlock()
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		select {
+		case <-due:
+			manager.fire(s, next)
+			manager.saveSchedules()
+		case <-s.wake:
+		case <-s.deleted:
+		case <-manager.unscheduled:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-s.deleted:
+			return
+		case <-manager.unscheduled:
+			return
+		default:
+		}
+	}
+}
+
+// run the schedule due at that time
+// following its overlap policy if the process of the previous run is still running
+func (manager *Manager) fire(s *schedule, due time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.next = time.Time{}
+	if s.cron != nil {
+		// the runs missed while the server was busy or stopped are not recovered
+		from := time.Now()
+		if due.After(from) {
+			from = due
+		}
+		s.next = s.cron.next(from)
+	}
+
+	switch {
+	case s.waiting:
+		s.record(apiobj.ScheduleRun{Time: due, Outcome: apiobj.RunSkipped, Error: "a run is already waiting for the previous process"})
+	case s.last == nil || s.last.isDone():
+		manager.startRun(s, due, apiobj.RunStarted)
+	case s.spec.Overlap == apiobj.OverlapSkip:
+		s.record(apiobj.ScheduleRun{
+			Time:    due,
+			Outcome: apiobj.RunSkipped,
+			Error:   fmt.Sprintf("the process %s of the previous run is still running", s.last.id),
+		})
+	default:
+		s.waiting = true
+		manager.scheduling.Add(1)
+		go manager.runAfter(s, s.last, due)
+	}
+}
+
+// start the run once the process of the previous one terminates
+// stopping it first with the replace policy
+func (manager *Manager) runAfter(s *schedule, previous *Process, due time.Time) {
+	defer manager.scheduling.Done()
+	outcome := apiobj.RunQueued
+	if s.spec.Overlap == apiobj.OverlapReplace {
+		outcome = apiobj.RunReplaced
+		go func() {
+			// the process may terminate meanwhile
+			_ = previous.Stop(syscall.SIGTERM, manager.stopTimeout)
+		}()
+	}
+	select {
+	case <-previous.done:
+	case <-s.deleted:
+		return
+	case <-manager.unscheduled:
+		return
+	}
+
+	s.mutex.Lock()
+	s.waiting = false
+	if s.spec.Paused {
+		s.record(apiobj.ScheduleRun{Time: due, Outcome: apiobj.RunSkipped, Error: "the schedule was paused"})
+	} else {
+		manager.startRun(s, due, outcome)
+	}
+	s.mutex.Unlock()
+	manager.saveSchedules()
+}
+
+// start the command of the schedule and record the run
+// must be called holding the mutex of the schedule
+func (manager *Manager) startRun(s *schedule, due time.Time, outcome string) {
+	run := apiobj.ScheduleRun{Time: due, Outcome: outcome}
+	id, err := manager.Start(s.spec.Command, s.spec.Owner)
+	if err == nil {
+		run.ProcessID = id
+		s.last, err = manager.getProcess(id, s.spec.Owner)
+	}
+	if err != nil {
+		run.Outcome = apiobj.RunFailed
+		run.Error = err.Error()
+	}
+	s.record(run)
+}
+
+// load the schedules saved in dir, they run once StartSchedules is called
+func (manager *Manager) restoreSchedules(dir string) error {
+	manager.schedulesPath = filepath.Join(dir, schedulesName)
+	data, err := ioutil.ReadFile(manager.schedulesPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := apiobj.Schedules{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("cannot read the schedules: %v", err)
+	}
+	now := time.Now()
+	for _, spec := range saved.Schedules {
+		s, err := newSchedule(spec, now)
+		if err != nil {
+			log.Printf("Invalid schedule %s: %v", spec.ID, err)
+			continue
+		}
+		s.spec.NextRun = nil
+		if s.cron == nil && len(spec.Runs) > 0 {
+			s.next = time.Time{}
+		}
+		manager.schedules[spec.ID] = s
+		manager.restoredSchedules = append(manager.restoredSchedules, s)
+	}
+	return nil
+}
+
+// start the schedules restored from the data directory
+// once the credentials and the quotas of their owners are set
+// the cron schedules run at their next match from now on
+// a single run missed while the server was stopped runs at once
+func (manager *Manager) StartSchedules() {
+	now := time.Now()
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.closed {
+		return
+	}
+	for _, s := range manager.restoredSchedules {
+		s.mutex.Lock()
+		if s.cron != nil {
+			s.next = s.cron.next(now)
+		}
+		s.mutex.Unlock()
+		manager.scheduling.Add(1)
+		go manager.runSchedule(s)
+	}
+	manager.restoredSchedules = nil
+}
+
+// write the schedules to disk if they are persistent
+func (manager *Manager) saveSchedules() {
+	if manager.schedulesPath == "" {
+		return
+	}
+	// the last save wins
+	manager.savingSchedules.Lock()
+	defer manager.savingSchedules.Unlock()
+
+	saved := apiobj.Schedules{Schedules: []apiobj.Schedule{}}
+	for _, s := range manager.scheduleList() {
+		spec := s.snapshot()
+		spec.NextRun = nil
+		saved.Schedules = append(saved.Schedules, spec)
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = WriteFileAtomic(manager.schedulesPath, data)
+	}
+	if err != nil {
+		log.Printf("Cannot save the schedules: %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
+)
+
+// order of the priorities of the processes of a user
+var priorities = map[string]int{
+	apiobj.PriorityLow:    -1,
+	apiobj.PriorityNormal: 0,
+	apiobj.PriorityHigh:   1,
+}
+
+// validate the priority of a command, normal if empty
+func parsePriority(priority string) (string, error) {
+	if priority == "" {
+		return apiobj.PriorityNormal, nil
+	}
+	if _, exists := priorities[priority]; !exists {
+		return "", fmt.Errorf("unknown priority %q, expected low, normal or high", priority)
+	}
+	return priority, nil
+}
+
+// time after which the past usage of a user counts half
+const usageHalfLife = time.Hour
+
+// process waiting in the scheduler
+type queuedJob struct {
+	process  *Process
+	owner    int
+	priority int
+	// order of submission
+	seq uint64
+}
+
+// scheduler decides which pending process starts when a slot frees up
+// the slots are shared among the users with pending processes
+// in proportion to their shares, the next one goes to the user
+// with the fewest running processes for its share
+// and among them to the one that used the least for its share
+// the slot time used in the past fades with usageHalfLife
+// the processes of a user start by priority and then in submission order
+type scheduler struct {
+	// processes running at the same time in total and for each user
+	// 0 means no limit
+	maxRunning     int
+	maxUserRunning int
+	running        int
+	userRunning    map[int]int
+	// weight of each user, 1 if not set
+	shares map[int]int
+	// pending processes of each user in the order they start
+	queues map[int][]*queuedJob
+	seq    uint64
+	// decayed seconds of slot time used by each user
+	usage map[int]float64
+	// time the usage was last updated
+	updated time.Time
+	// dispatch order of the pending processes, nil when it must be computed again
+	order map[*queuedJob]int
+}
+
+func newScheduler(maxRunning int, maxUserRunning int) *scheduler {
+	return &scheduler{
+		maxRunning:     maxRunning,
+		maxUserRunning: maxUserRunning,
+		userRunning:    make(map[int]int),
+		shares:         make(map[int]int),
+		queues:         make(map[int][]*queuedJob),
+		usage:          make(map[int]float64),
+	}
+}
+
+// whether a concurrency limit is set
+func (scheduler *scheduler) limited() bool {
+	return scheduler.maxRunning > 0 || scheduler.maxUserRunning > 0
+}
+
+func (scheduler *scheduler) share(userid int) int {
+	if share, exists := scheduler.shares[userid]; exists {
+		return share
+	}
+	return 1
+}
+
+// set the weight of the user, 1 if not positive
+func (scheduler *scheduler) setShare(userid int, share int) {
+	if share <= 0 {
+		delete(scheduler.shares, userid)
+	} else {
+		scheduler.shares[userid] = share
+	}
+	scheduler.order = nil
+}
+
+// account the slot time used by the running processes until now
+func (scheduler *scheduler) advance(now time.Time) {
+	elapsed := now.Sub(scheduler.updated).Seconds()
+	if scheduler.updated.IsZero() || elapsed < 0 {
+		elapsed = 0
+	}
+	scheduler.updated = now
+	decay := math.Pow(0.5, elapsed/usageHalfLife.Seconds())
+	for owner, usage := range scheduler.usage {
+		scheduler.usage[owner] = usage * decay
+	}
+	for owner, running := range scheduler.userRunning {
+		scheduler.usage[owner] += float64(running) * elapsed
+	}
+	scheduler.order = nil
+}
+
+// whether the user can start a process without exceeding a concurrency limit
+func (scheduler *scheduler) hasSlot(userid int) bool {
+	if scheduler.maxRunning > 0 && scheduler.running >= scheduler.maxRunning {
+		return false
+	}
+	return scheduler.maxUserRunning == 0 || scheduler.userRunning[userid] < scheduler.maxUserRunning
+}
+
+func (scheduler *scheduler) acquire(userid int) {
+	scheduler.running++
+	scheduler.userRunning[userid]++
+	scheduler.order = nil
+}
+
+func (scheduler *scheduler) release(userid int) {
+	scheduler.running--
+	scheduler.userRunning[userid]--
+	if scheduler.userRunning[userid] == 0 {
+		delete(scheduler.userRunning, userid)
+	}
+	scheduler.order = nil
+}
+
+// queue a process of the owner after the ones with the same or higher priority
+func (scheduler *scheduler) push(process *Process, owner int, priority string) *queuedJob {
+	scheduler.seq++
+	job := &queuedJob{process: process, owner: owner, priority: priorities[priority], seq: scheduler.seq}
+	queue := scheduler.queues[owner]
+	i := sort.Search(len(queue), func(i int) bool { return queue[i].priority < job.priority })
+	queue = append(queue, nil)
+	copy(queue[i+1:], queue[i:])
+	queue[i] = job
+	scheduler.queues[owner] = queue
+	scheduler.order = nil
+	return job
+}
+
+// drop the pending processes not kept
+func (scheduler *scheduler) prune(keep func(*queuedJob) bool) {
+	for owner, queue := range scheduler.queues {
+		kept := queue[:0]
+		for _, job := range queue {
+			if keep(job) {
+				kept = append(kept, job)
+			}
+		}
+		for i := len(kept); i < len(queue); i++ {
+			queue[i] = nil
+		}
+		if len(kept) == 0 {
+			delete(scheduler.queues, owner)
+		} else {
+			scheduler.queues[owner] = kept
+		}
+		if len(kept) != len(queue) {
+			scheduler.order = nil
+		}
+	}
+}
+
+// the user whose process starts next among the ones eligible
+// the fewest running processes for its share first
+// then the one with the least usage for its share and the one that submitted first
+// the queue of each user starts at heads, at 0 if nil
+// -1 if no user is eligible
+func (scheduler *scheduler) pick(running map[int]int, heads map[int]int, eligible func(int) bool) int {
+	best := -1
+	for owner, queue := range scheduler.queues {
+		if heads[owner] >= len(queue) || !eligible(owner) {
+			continue
+		}
+		if best == -1 {
+			best = owner
+			continue
+		}
+		// running[owner] / share(owner) compared to the best one
+		left := running[owner] * scheduler.share(best)
+		right := running[best] * scheduler.share(owner)
+		if left != right {
+			if left < right {
+				best = owner
+			}
+			continue
+		}
+		used := scheduler.usage[owner] * float64(scheduler.share(best))
+		bestUsed := scheduler.usage[best] * float64(scheduler.share(owner))
+		if used != bestUsed {
+			if used < bestUsed {
+				best = owner
+			}
+			continue
+		}
+		if queue[heads[owner]].seq < scheduler.queues[best][heads[best]].seq {
+			best = owner
+		}
+	}
+	return best
+}
+
+// remove and return the next process to start taking its slot
+// nil if none can start
+func (scheduler *scheduler) next() *queuedJob {
+	owner := scheduler.pick(scheduler.userRunning, nil, scheduler.hasSlot)
+	if owner == -1 {
+		return nil
+	}
+	queue := scheduler.queues[owner]
+	job := queue[0]
+	queue[0] = nil
+	if len(queue) == 1 {
+		delete(scheduler.queues, owner)
+	} else {
+		scheduler.queues[owner] = queue[1:]
+	}
+	scheduler.acquire(owner)
+	return job
+}
+
+// position of the pending process in the order the processes would start
+// if the slots freed up one at a time, starting from 1
+// 0 if it is not queued
+func (scheduler *scheduler) position(job *queuedJob) int {
+	if scheduler.order == nil {
+		scheduler.order = scheduler.dispatchOrder()
+	}
+	return scheduler.order[job]
+}
+
+func (scheduler *scheduler) dispatchOrder() map[*queuedJob]int {
+	running := make(map[int]int)
+	for owner, count := range scheduler.userRunning {
+		running[owner] = count
+	}
+	heads := make(map[int]int)
+	order := make(map[*queuedJob]int)
+	anyone := func(int) bool { return true }
+	for position := 1; ; position++ {
+		owner := scheduler.pick(running, heads, anyone)
+		if owner == -1 {
+			return order
+		}
+		order[scheduler.queues[owner][heads[owner]]] = position
+		heads[owner]++
+		running[owner]++
+	}
+}
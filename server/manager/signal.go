@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// names of the signals a process can be terminated with
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// return the name of the signal like SIGKILL
+func signalName(signal syscall.Signal) string {
+	name, ok := signalNames[signal]
+	if !ok {
+		return fmt.Sprintf("SIG%d", int(signal))
+	}
+	return name
+}
+
+// parse a signal given its name like SIGTERM or TERM or its number
+func ParseSignal(str string) (syscall.Signal, error) {
+	name := strings.ToUpper(str)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	for signal, signalName := range signalNames {
+		if signalName == name {
+			return signal, nil
+		}
+	}
+	number, err := strconv.Atoi(str)
+	if err != nil || number <= 0 || number >= 65 {
+		return 0, fmt.Errorf("unknown signal %s", str)
+	}
+	return syscall.Signal(number), nil
+}
@@ -0,0 +1,164 @@
+package manager
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// OutputStore creates the storage holding the output of each process
+type OutputStore interface {
+	// create an empty storage for the process having the given id
+	Create(id string) (Storage, error)
+	// delete the storage of a process that could not be started or was removed
+	Remove(id string) error
+	// open the storage of a process started before a restart
+	// return also its size
+	Open(id string) (Storage, int64, error)
+}
+
+// Storage holds the output of a single process
+// it is written sequentially and can be read at any time
+type Storage interface {
+	io.Writer
+	io.ReaderAt
+	// called once the process has terminated, no more writes will happen
+	// the storage must remain readable
+	Close() error
+}
+
+// keep the output of the processes in RAM
+type MemoryStore struct{}
+
+func (MemoryStore) Create(id string) (Storage, error) {
+	return new(memoryStorage), nil
+}
+
+func (MemoryStore) Remove(id string) error {
+	return nil
+}
+
+func (MemoryStore) Open(id string) (Storage, int64, error) {
+	return nil, 0, errors.New("the output is not persistent")
+}
+
+type memoryStorage struct {
+	data  []byte
+	mutex sync.RWMutex
+}
+
+func (storage *memoryStorage) Write(p []byte) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.data = append(storage.data, p...)
+	return len(p), nil
+}
+
+func (storage *memoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	if off >= int64(len(storage.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, storage.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (storage *memoryStorage) Close() error {
+	return nil
+}
+
+// spool the output of every process in its own file
+// named after the process id inside the directory Dir
+type FileStore struct {
+	Dir string
+}
+
+// create the store directory if it does not exist
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (store *FileStore) path(id string) string {
+	return filepath.Join(store.Dir, id+".log")
+}
+
+func (store *FileStore) Create(id string) (Storage, error) {
+	path := store.path(id)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStorage{path: path, file: file}, nil
+}
+
+func (store *FileStore) Remove(id string) error {
+	return os.Remove(store.path(id))
+}
+
+// the storage is read only
+func (store *FileStore) Open(id string) (Storage, int64, error) {
+	path := store.path(id)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &fileStorage{path: path}, info.Size(), nil
+}
+
+type fileStorage struct {
+	path string
+	// open only while the process is running
+	// to avoid keeping a descriptor for every terminated process
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func (storage *fileStorage) Write(p []byte) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.file == nil {
+		return 0, os.ErrClosed
+	}
+	return storage.file.Write(p)
+}
+
+func (storage *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.file != nil {
+		return storage.file.ReadAt(p, off)
+	}
+
+	file, err := os.Open(storage.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(p, off)
+}
+
+func (storage *fileStorage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.file == nil {
+		return nil
+	}
+	err := storage.file.Close()
+	storage.file = nil
+	return err
+}
@@ -0,0 +1,420 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
+	uuid "github.com/satori/go.uuid"
+)
+
+// name of the file holding the workflows inside the data directory
+const workflowsName = "workflows.json"
+
+// steps started by the manager as soon as their dependencies succeed
+type workflow struct {
+	// the states of the workflow and of its steps are guarded by the mutex
+	spec apiobj.Workflow
+	// index of every step by name
+	steps map[string]int
+	// processes of the started steps
+	processes []*Process
+	cancelled bool
+	mutex     sync.Mutex
+}
+
+// validate the steps of the workflow and their dependencies
+// the commands are checked by checkCommand
+func newWorkflow(spec apiobj.Workflow) (*workflow, error) {
+	if len(spec.Steps) == 0 {
+		return nil, errors.New("a workflow must have at least a step")
+	}
+	w := &workflow{
+		spec:      spec,
+		steps:     make(map[string]int),
+		processes: make([]*Process, len(spec.Steps)),
+	}
+	w.spec.Steps = append([]apiobj.WorkflowStep{}, spec.Steps...)
+	for i, step := range w.spec.Steps {
+		if step.Name == "" {
+			return nil, fmt.Errorf("the step %d has no name", i+1)
+		}
+		if _, exists := w.steps[step.Name]; exists {
+			return nil, fmt.Errorf("duplicate step %q", step.Name)
+		}
+		w.steps[step.Name] = i
+	}
+	for _, step := range w.spec.Steps {
+		for _, dependency := range step.DependsOn {
+			if _, exists := w.steps[dependency]; !exists {
+				return nil, fmt.Errorf("the step %q depends on the unknown step %q", step.Name, dependency)
+			}
+		}
+	}
+	if cycle := w.cycle(); cycle != "" {
+		return nil, fmt.Errorf("the step %q depends on itself", cycle)
+	}
+	return w, nil
+}
+
+// name of a step in a dependency cycle, empty if there is none
+func (w *workflow) cycle() string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(w.spec.Steps))
+	var visit func(i int) string
+	visit = func(i int) string {
+		switch marks[i] {
+		case visiting:
+			return w.spec.Steps[i].Name
+		case visited:
+			return ""
+		}
+		marks[i] = visiting
+		for _, dependency := range w.spec.Steps[i].DependsOn {
+			if cycle := visit(w.steps[dependency]); cycle != "" {
+				return cycle
+			}
+		}
+		marks[i] = visited
+		return ""
+	}
+	for i := range w.spec.Steps {
+		if cycle := visit(i); cycle != "" {
+			return cycle
+		}
+	}
+	return ""
+}
+
+// snapshot of the workflow
+func (w *workflow) snapshot() apiobj.Workflow {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	spec := w.spec
+	spec.Steps = append([]apiobj.WorkflowStep{}, w.spec.Steps...)
+	return spec
+}
+
+// add a workflow owned by the user starting the steps through Start
+// the steps without dependencies start at once
+// return the workflow with its id
+func (manager *Manager) CreateWorkflow(spec apiobj.Workflow, userid int) (apiobj.Workflow, error) {
+	w, err := newWorkflow(spec)
+	if err != nil {
+		return apiobj.Workflow{}, err
+	}
+	for i := range w.spec.Steps {
+		step := &w.spec.Steps[i]
+		if step.Command.Namespace != "" && step.Command.Namespace != spec.Namespace {
+			return apiobj.Workflow{}, fmt.Errorf("the step %q must run in the namespace of the workflow", step.Name)
+		}
+		step.Command.Namespace = spec.Namespace
+		if err := manager.checkCommand(step.Command, userid); err != nil {
+			return apiobj.Workflow{}, fmt.Errorf("step %q: %v", step.Name, err)
+		}
+		step.State = apiobj.WorkflowWaiting
+		step.ProcessID = ""
+		step.Error = ""
+	}
+	w.spec.ID = uuid.NewV1().String()
+	w.spec.Owner = userid
+	w.spec.Created = time.Now()
+	w.spec.State = apiobj.WorkflowRunning
+	w.spec.EndTime = nil
+
+	manager.mutex.Lock()
+	if manager.closed {
+		manager.mutex.Unlock()
+		return apiobj.Workflow{}, errors.New("the manager is shutting down")
+	}
+	manager.scheduling.Add(1)
+	manager.mutex.Unlock()
+
+	// the first steps are started before returning
+	w.mutex.Lock()
+	manager.startReady(w)
+	w.mutex.Unlock()
+
+	manager.workflowsMutex.Lock()
+	manager.workflows[w.spec.ID] = w
+	manager.workflowsMutex.Unlock()
+	go manager.runWorkflow(w)
+
+	manager.saveWorkflows()
+	return w.snapshot(), nil
+}
+
+// stop the running steps of the workflow and skip the waiting ones
+func (manager *Manager) CancelWorkflow(id string, userid int) error {
+	manager.workflowsMutex.Lock()
+	w, exists := manager.workflows[id]
+	manager.workflowsMutex.Unlock()
+	if !exists || w.spec.Owner != userid {
+		return fmt.Errorf("do not exist workflow id %s", id)
+	}
+
+	w.mutex.Lock()
+	if w.spec.EndTime != nil {
+		w.mutex.Unlock()
+		return errors.New("the workflow has already terminated")
+	}
+	w.cancelled = true
+	for i, step := range w.spec.Steps {
+		switch step.State {
+		case apiobj.WorkflowWaiting:
+			w.spec.Steps[i].State = apiobj.WorkflowSkipped
+			w.spec.Steps[i].Error = "the workflow was cancelled"
+		case apiobj.WorkflowRunning:
+			go func(process *Process) {
+				// the process may terminate meanwhile
+				_ = process.Stop(syscall.SIGTERM, manager.stopTimeout)
+			}(w.processes[i])
+		}
+	}
+	w.mutex.Unlock()
+	manager.saveWorkflows()
+	return nil
+}
+
+// return the snapshots of the workflows of every user selected by match
+// or all of them if match is nil, from the oldest to the newest
+func (manager *Manager) ListWorkflows(match func(apiobj.Workflow) bool) []apiobj.Workflow {
+	manager.workflowsMutex.Lock()
+	list := make([]*workflow, 0, len(manager.workflows))
+	for _, w := range manager.workflows {
+		list = append(list, w)
+	}
+	manager.workflowsMutex.Unlock()
+
+	arr := []apiobj.Workflow{}
+	for _, w := range list {
+		spec := w.snapshot()
+		if match == nil || match(spec) {
+			arr = append(arr, spec)
+		}
+	}
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i].Created.Before(arr[j].Created)
+	})
+	return arr
+}
+
+// return the snapshot of the workflow having that id whoever owns it
+// used to check the access to the workflow
+func (manager *Manager) LookupWorkflow(id string) (apiobj.Workflow, error) {
+	manager.workflowsMutex.Lock()
+	w, exists := manager.workflows[id]
+	manager.workflowsMutex.Unlock()
+	if !exists {
+		return apiobj.Workflow{}, fmt.Errorf("do not exist workflow id %s", id)
+	}
+	return w.snapshot(), nil
+}
+
+// start the steps of the workflow as their processes terminate
+// until every step has succeeded, failed or been skipped
+func (manager *Manager) runWorkflow(w *workflow) {
+	defer manager.scheduling.Done()
+	// index of the step whose process terminated
+	finished := make(chan int, len(w.spec.Steps))
+	watched := make([]bool, len(w.spec.Steps))
+	for {
+		w.mutex.Lock()
+		running := 0
+		for i, step := range w.spec.Steps {
+			if step.State != apiobj.WorkflowRunning {
+				continue
+			}
+			running++
+			if !watched[i] {
+				watched[i] = true
+				go func(i int, process *Process) {
+					<-process.done
+					finished <- i
+				}(i, w.processes[i])
+			}
+		}
+		if running == 0 {
+			w.finish()
+			w.mutex.Unlock()
+			manager.saveWorkflows()
+			return
+		}
+		w.mutex.Unlock()
+
+		select {
+		case i := <-finished:
+			w.mutex.Lock()
+			w.complete(i)
+			manager.startReady(w)
+			w.mutex.Unlock()
+			manager.saveWorkflows()
+		case <-manager.unscheduled:
+			return
+		}
+	}
+}
+
+// start the waiting steps whose dependencies succeeded
+// and skip the ones with a dependency that did not
+// must be called holding the mutex
+func (manager *Manager) startReady(w *workflow) {
+	// a failure or a skip propagates to the steps depending on it
+	for changed := true; changed; {
+		changed = false
+		for i := range w.spec.Steps {
+			step := &w.spec.Steps[i]
+			if step.State != apiobj.WorkflowWaiting {
+				continue
+			}
+			if w.cancelled {
+				step.State = apiobj.WorkflowSkipped
+				step.Error = "the workflow was cancelled"
+				changed = true
+				continue
+			}
+			ready, blocking := true, ""
+			for _, dependency := range step.DependsOn {
+				switch w.spec.Steps[w.steps[dependency]].State {
+				case apiobj.WorkflowSucceeded:
+				case apiobj.WorkflowFailed, apiobj.WorkflowSkipped:
+					blocking = dependency
+				default:
+					ready = false
+				}
+			}
+			switch {
+			case blocking != "":
+				step.State = apiobj.WorkflowSkipped
+				step.Error = fmt.Sprintf("the step %q did not succeed", blocking)
+				changed = true
+			case ready:
+				manager.startStep(w, i)
+				changed = true
+			}
+		}
+	}
+}
+
+// start the process of the step
+// must be called holding the mutex
+func (manager *Manager) startStep(w *workflow, i int) {
+	step := &w.spec.Steps[i]
+	id, err := manager.Start(step.Command, w.spec.Owner)
+	if err == nil {
+		step.ProcessID = id
+		w.processes[i], err = manager.getProcess(id, w.spec.Owner)
+	}
+	if err != nil {
+		step.State = apiobj.WorkflowFailed
+		step.Error = err.Error()
+		return
+	}
+	step.State = apiobj.WorkflowRunning
+}
+
+// set the state of the step whose process terminated
+// must be called holding the mutex
+func (w *workflow) complete(i int) {
+	step := &w.spec.Steps[i]
+	status := w.processes[i].Status()
+	switch {
+	case status.State == apiobj.StateExited:
+		step.State = apiobj.WorkflowSucceeded
+	case status.ExitCode != nil && status.State == apiobj.StateFailed:
+		step.State = apiobj.WorkflowFailed
+		step.Error = fmt.Sprintf("the process exited with code %d", *status.ExitCode)
+	default:
+		step.State = apiobj.WorkflowFailed
+		step.Error = "the process " + status.State
+	}
+}
+
+// set the aggregate state once no step is running
+// must be called holding the mutex
+func (w *workflow) finish() {
+	if w.spec.EndTime != nil {
+		return
+	}
+	now := time.Now()
+	w.spec.EndTime = &now
+	w.spec.State = apiobj.WorkflowSucceeded
+	for _, step := range w.spec.Steps {
+		if step.State != apiobj.WorkflowSucceeded {
+			w.spec.State = apiobj.WorkflowFailed
+		}
+	}
+	if w.cancelled {
+		w.spec.State = apiobj.WorkflowCancelled
+	}
+}
+
+// load the workflows saved in dir
+// the steps running when the server stopped are marked as failed
+// and the waiting ones as skipped since their processes are lost
+func (manager *Manager) restoreWorkflows(dir string) error {
+	manager.workflowsPath = filepath.Join(dir, workflowsName)
+	data, err := ioutil.ReadFile(manager.workflowsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := apiobj.Workflows{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("cannot read the workflows: %v", err)
+	}
+	for _, spec := range saved.Workflows {
+		w, err := newWorkflow(spec)
+		if err != nil {
+			log.Printf("Invalid workflow %s: %v", spec.ID, err)
+			continue
+		}
+		for i, step := range w.spec.Steps {
+			switch step.State {
+			case apiobj.WorkflowRunning:
+				w.spec.Steps[i].State = apiobj.WorkflowFailed
+				w.spec.Steps[i].Error = "the process " + apiobj.StateLost
+			case apiobj.WorkflowWaiting:
+				w.spec.Steps[i].State = apiobj.WorkflowSkipped
+				w.spec.Steps[i].Error = "the server stopped"
+			}
+		}
+		w.finish()
+		manager.workflows[spec.ID] = w
+	}
+	return nil
+}
+
+// write the workflows to disk if they are persistent
+func (manager *Manager) saveWorkflows() {
+	if manager.workflowsPath == "" {
+		return
+	}
+	// the last save wins
+	manager.savingWorkflows.Lock()
+	defer manager.savingWorkflows.Unlock()
+
+	saved := apiobj.Workflows{Workflows: manager.ListWorkflows(nil)}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = WriteFileAtomic(manager.workflowsPath, data)
+	}
+	if err != nil {
+		log.Printf("Cannot save the workflows: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/anterpin/interview/server/apiobj"
+)
+
+// returned when the role of the client does not allow the action
+var errNotPermitted = errors.New("not permitted by the role of the client")
+
+// roles of the clients
+const (
+	// every endpoint on the processes of every user and namespace
+	roleAdmin = "admin"
+	// start and stop its processes and the ones of its namespaces
+	roleOperator = "operator"
+	// read the status and the output of the processes of its namespaces
+	roleViewer = "viewer"
+)
+
+// action of a client on a process
+type permission int
+
+const (
+	// list, status and log
+	permissionRead permission = iota
+	permissionStart
+	permissionStop
+	// the /admin endpoints
+	permissionAdmin
+)
+
+// members of each namespace
+// replaced on every reload of the client registry, guarded by tables_mutex
+var namespace_table map[string]map[int]bool
+
+// validate the role of a registry entry, operator if empty
+// admin is the old way to give the admin role
+func parseRole(role string, admin bool) (string, error) {
+	switch {
+	case role == "" && admin:
+		return roleAdmin, nil
+	case role == "":
+		return roleOperator, nil
+	case admin && role != roleAdmin:
+		return "", fmt.Errorf("admin conflicts with the role %q", role)
+	}
+	switch role {
+	case roleAdmin, roleOperator, roleViewer:
+		return role, nil
+	}
+	return "", fmt.Errorf("unknown role %q, expected admin, operator or viewer", role)
+}
+
+// whether the role of the client allows the action on any process
+func (client Client) allows(action permission) bool {
+	switch client.role {
+	case roleAdmin:
+		return true
+	case roleOperator:
+		return action != permissionAdmin
+	case roleViewer:
+		return action == permissionRead
+	}
+	return false
+}
+
+// whether the client can act on the process
+// a process is personal to its owner unless started into a namespace
+// in that case it is shared with the members of the namespace
+func (client Client) can(action permission, status apiobj.ProcessStatus) bool {
+	if !client.allows(action) {
+		return false
+	}
+	if client.role == roleAdmin || status.Owner == client.id {
+		return true
+	}
+	return status.Namespace != "" && client.member(status.Namespace)
+}
+
+// whether the client can start a process into the namespace, personal if empty
+func (client Client) canStart(namespace string) error {
+	if !client.allows(permissionStart) {
+		return errNotPermitted
+	}
+	if namespace == "" {
+		return nil
+	}
+	tables_mutex.RLock()
+	_, exists := namespace_table[namespace]
+	tables_mutex.RUnlock()
+	if !exists {
+		return fmt.Errorf("unknown namespace %q", namespace)
+	}
+	if client.role != roleAdmin && !client.member(namespace) {
+		return errNotPermitted
+	}
+	return nil
+}
+
+func (client Client) member(namespace string) bool {
+	tables_mutex.RLock()
+	defer tables_mutex.RUnlock()
+	return namespace_table[namespace][client.id]
+}
+
+// whether the client can act on the schedule
+// it is shared like the processes it starts
+func (client Client) canSchedule(action permission, schedule apiobj.Schedule) bool {
+	return client.can(action, apiobj.ProcessStatus{Owner: schedule.Owner, Namespace: schedule.Command.Namespace})
+}
+
+// whether the client can act on the workflow
+// it is shared like the processes of its steps
+func (client Client) canWorkflow(action permission, workflow apiobj.Workflow) bool {
+	return client.can(action, apiobj.ProcessStatus{Owner: workflow.Owner, Namespace: workflow.Namespace})
+}
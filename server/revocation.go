@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anterpin/interview/server/apiobj"
+	"github.com/anterpin/interview/server/manager"
+)
+
+// returned for a client certificate that was revoked
+var errCertificateRevoked = errors.New("certificate revoked")
+
+// certificate listed in the CRL of its issuer
+type crlKey struct {
+	issuer string
+	serial string
+}
+
+var (
+	// certificates revoked through the admin endpoints by serial
+	// they are refused whichever CA issued them
+	revoked_serials map[string]apiobj.Revocation
+	// certificates listed in the CRL file
+	crl_serials map[crlKey]bool
+	// guards revoked_serials and crl_serials
+	revocation_mutex sync.RWMutex
+
+	// file persisting the certificates revoked through the admin endpoints
+	revokedPath string
+	// CRL file, reloaded with the client registry
+	crlPath string
+)
+
+// format the serial of the certificate like openssl does
+func certificateSerial(cert *x509.Certificate) string {
+	return strings.ToUpper(cert.SerialNumber.Text(16))
+}
+
+// parse a hexadecimal serial number like 1a:2b:3c or 0x1A2B3C
+func parseSerial(value string) (string, error) {
+	value = strings.TrimPrefix(strings.ToLower(value), "0x")
+	value = strings.ReplaceAll(value, ":", "")
+	serial, ok := new(big.Int).SetString(value, 16)
+	if !ok || serial.Sign() < 0 {
+		return "", fmt.Errorf("invalid serial %q, expected an hexadecimal number", value)
+	}
+	return strings.ToUpper(serial.Text(16)), nil
+}
+
+// load the certificates revoked through the admin endpoints
+// none are revoked if the file does not exist yet
+func loadRevocations(path string) error {
+	revocations := apiobj.Revocations{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &revocations); err != nil {
+			return fmt.Errorf("invalid revocation list %s: %v", path, err)
+		}
+	}
+
+	serials := make(map[string]apiobj.Revocation)
+	for _, revocation := range revocations.Revocations {
+		serial, err := parseSerial(revocation.Serial)
+		if err != nil {
+			return fmt.Errorf("invalid revocation list %s: %v", path, err)
+		}
+		revocation.Serial = serial
+		serials[serial] = revocation
+	}
+
+	revocation_mutex.Lock()
+	revoked_serials = serials
+	revocation_mutex.Unlock()
+	return nil
+}
+
+// write the revoked serials replacing the file
+// must be called holding revocation_mutex
+func saveRevocations() error {
+	if revokedPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(apiobj.Revocations{Revocations: revocationList()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return manager.WriteFileAtomic(revokedPath, data)
+}
+
+// sorted by serial
+// must be called holding revocation_mutex
+func revocationList() []apiobj.Revocation {
+	revocations := []apiobj.Revocation{}
+	for _, revocation := range revoked_serials {
+		revocations = append(revocations, revocation)
+	}
+	sort.Slice(revocations, func(i, j int) bool {
+		return revocations[i].Serial < revocations[j].Serial
+	})
+	return revocations
+}
+
+// revoke the certificate having the serial and persist it
+func revokeSerial(revocation apiobj.Revocation) (apiobj.Revocation, error) {
+	serial, err := parseSerial(revocation.Serial)
+	if err != nil {
+		return revocation, err
+	}
+	now := time.Now()
+	revocation.Serial = serial
+	revocation.Time = &now
+
+	revocation_mutex.Lock()
+	defer revocation_mutex.Unlock()
+	previous, existed := revoked_serials[serial]
+	if revoked_serials == nil {
+		revoked_serials = make(map[string]apiobj.Revocation)
+	}
+	revoked_serials[serial] = revocation
+	if err := saveRevocations(); err != nil {
+		if existed {
+			revoked_serials[serial] = previous
+		} else {
+			delete(revoked_serials, serial)
+		}
+		return revocation, err
+	}
+	return revocation, nil
+}
+
+// reinstate the certificate having the serial
+func unrevokeSerial(value string) error {
+	serial, err := parseSerial(value)
+	if err != nil {
+		return err
+	}
+
+	revocation_mutex.Lock()
+	defer revocation_mutex.Unlock()
+	previous, existed := revoked_serials[serial]
+	if !existed {
+		return fmt.Errorf("the certificate %s is not revoked", serial)
+	}
+	delete(revoked_serials, serial)
+	if err := saveRevocations(); err != nil {
+		revoked_serials[serial] = previous
+		return err
+	}
+	return nil
+}
+
+// the certificates revoked through the admin endpoints
+func listRevocations() []apiobj.Revocation {
+	revocation_mutex.RLock()
+	defer revocation_mutex.RUnlock()
+	return revocationList()
+}
+
+// load the CRL at path, PEM or DER encoded, replacing the current one
+// it must be signed by one of the CAs of the client registry or of --clientCA
+// the current one is kept if the CRL is invalid
+func reloadCRL(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return fmt.Errorf("invalid CRL %s: %v", path, err)
+	}
+
+	issuer := pkix.Name{}
+	issuer.FillFromRDNSequence(&crl.TBSCertList.Issuer)
+	signed := false
+	for _, ca := range issuerCAs() {
+		if ca.Subject.String() == issuer.String() && ca.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("the CRL %s is not signed by a client CA", path)
+	}
+	if crl.HasExpired(time.Now()) {
+		log.Printf("The CRL %s expired at %v, still using it", path, crl.TBSCertList.NextUpdate)
+	}
+
+	serials := make(map[crlKey]bool)
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		key := crlKey{issuer: issuer.String(), serial: strings.ToUpper(revoked.SerialNumber.Text(16))}
+		serials[key] = true
+	}
+
+	revocation_mutex.Lock()
+	crl_serials = serials
+	revocation_mutex.Unlock()
+	log.Printf("Loaded %d revoked certificates from %s", len(serials), path)
+	return nil
+}
+
+// return errCertificateRevoked if the client certificate or one of its
+// intermediate CAs is revoked and record it in the audit log
+func checkRevoked(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	revocation_mutex.RLock()
+	defer revocation_mutex.RUnlock()
+
+	leaf := chain[0]
+	if revocation, revoked := revoked_serials[certificateSerial(leaf)]; revoked {
+		log.Printf("Audit: refused the revoked certificate %s of %q: %s", revocation.Serial, leaf.Subject, revocation.Reason)
+		return errCertificateRevoked
+	}
+	for _, cert := range chain {
+		key := crlKey{issuer: cert.Issuer.String(), serial: certificateSerial(cert)}
+		if crl_serials[key] {
+			log.Printf("Audit: refused the certificate %s of %q revoked by the CRL", key.serial, leaf.Subject)
+			return errCertificateRevoked
+		}
+	}
+	return nil
+}
+
+// refuse the revoked client certificates during the TLS handshake
+func verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		if err := checkRevoked(chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,32 +1,19 @@
 #!/bin/bash
-size=2048
+# create the CA, the server certificate and two clients
+# the client registry is replaced by the two new clients
+set -e
 cd server
-openssl req -newkey rsa:${size} \
-                               -new -nodes -x509 \
-                               -days 3650 \
-                               -out certs/cert.pem \
-                               -keyout certs/key.pem \
-                               -subj "/C=IT/ST=Brescia/L=Brescia/O=My Organization/OU=Your Unit/CN=localhost" \
-															 -addext "subjectAltName = DNS:localhost"
+go build -o /tmp/job-server .
 
-cd ../client
-openssl req -newkey rsa:${size} \
-                               -new -nodes -x509 \
-                               -days 3650 \
-                               -out cert/cert.pem \
-                               -keyout cert/key.pem \
-                               -subj "/C=IT/ST=Brescia/L=Brescia/O=My Organization/OU=Your Unit/CN=localhost" \
-															 -addext "subjectAltName = DNS:localhost"
-openssl req -newkey rsa:${size} \
-                               -new -nodes -x509 \
-                               -days 3650 \
-                               -out cert2/cert.pem \
-                               -keyout cert2/key.pem \
-                               -subj "/C=IT/ST=Brescia/L=Brescia/O=My Organization/OU=Your Unit/CN=localhost" \
-															 -addext "subjectAltName = DNS:localhost"
-cd ../
+/tmp/job-server ca init
+/tmp/job-server ca issue server --dns localhost --ip 127.0.0.1
 
-cp client/cert/cert.pem server/certs/client_cert.pem
-cp client/cert2/cert.pem server/certs/client_cert2.pem
-cp server/certs/cert.pem client/server_cert.pem
+echo '{"clients": []}' > clients.json
+/tmp/job-server ca issue client client --id 1 --role admin --out ../client/cert
+/tmp/job-server ca issue client client2 --id 2 --out ../client/cert2
 
+cp certs/ca/ca_cert.pem ../client/server_cert.pem
+
+# more clients enroll with a one-time token
+#   server: ./server ca token NAME
+#   client: ./client --certDir DIR enroll TOKEN